@@ -0,0 +1,553 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+// BAI is the index format for coordinate sorted BAM files. For each
+// reference, alignments are assigned to bins in a hierarchy of
+// intervals, and each bin lists the chunks of the file holding its
+// alignments. A linear index of 16kbp windows gives the lowest offset
+// of an alignment overlapping each window, to skip chunks that can't
+// overlap a query.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+var baiMagic = []byte("BAI\x01")
+
+const (
+	baiMetaBin = 37450 // pseudo-bin holding per-reference metadata
+	baiLinearShift = 14 // linear index windows are 16kbp
+	// BAI covers positions below 1<<29, so bin and window counts are
+	// bounded
+	baiMaxIntervals = 1 << (29 - baiLinearShift)
+)
+
+// BAIChunk is a section of a BAM file, from Begin up to but not
+// including End.
+type BAIChunk struct {
+	Begin VirtualOffset
+	End VirtualOffset
+}
+
+// BAIRef is the index of the alignments on one reference.
+type BAIRef struct {
+	Bins map[uint32][]BAIChunk
+	Intervals []VirtualOffset // linear index
+
+	// From the metadata pseudo-bin, if HasMeta
+	HasMeta bool
+	Start, End VirtualOffset // span of the reference's alignments
+	Mapped, Unmapped uint64 // read counts
+}
+
+// BAI is a BAM index, with one BAIRef per reference in the BAM
+// header.
+type BAI struct {
+	Refs []BAIRef
+	// Number of unmapped reads with no reference, if HasNoCoordinate
+	HasNoCoordinate bool
+	NoCoordinate uint64
+}
+
+// ReadBAI reads a .bai index.
+func ReadBAI(r io.Reader) (*BAI, error) {
+	le := binary.LittleEndian
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != string(baiMagic) {
+		return nil, SAMerror{str: "Not a BAI file"}
+	}
+
+	truncated := SAMerror{str: "Truncated BAI file"}
+	var nRef int32
+	if err := binary.Read(r, le, &nRef); err != nil {
+		return nil, truncated
+	}
+	if nRef < 0 {
+		return nil, SAMerror{str: "Invalid BAI reference count"}
+	}
+	// The counts come from the file, so the slices grow as they're
+	// read rather than being allocated up front
+	idx := &BAI{}
+	for i := int32(0); i < nRef; i++ {
+		idx.Refs = append(idx.Refs, BAIRef{Bins: map[uint32][]BAIChunk{}})
+		ref := &idx.Refs[i]
+
+		var nBin int32
+		if err := binary.Read(r, le, &nBin); err != nil {
+			return nil, truncated
+		}
+		if nBin < 0 || nBin > baiMetaBin+1 {
+			return nil, SAMerror{str: "Invalid BAI bin count"}
+		}
+		for j := int32(0); j < nBin; j++ {
+			var bin uint32
+			var nChunk int32
+			if err := binary.Read(r, le, &bin); err != nil {
+				return nil, truncated
+			}
+			if err := binary.Read(r, le, &nChunk); err != nil {
+				return nil, truncated
+			}
+			if nChunk < 0 {
+				return nil, SAMerror{str: "Invalid BAI chunk count"}
+			}
+			chunks, err := readBAIChunks(r, int(nChunk))
+			if err != nil {
+				return nil, truncated
+			}
+			if bin == baiMetaBin && nChunk == 2 {
+				ref.HasMeta = true
+				ref.Start, ref.End = chunks[0].Begin, chunks[0].End
+				ref.Mapped, ref.Unmapped = uint64(chunks[1].Begin), uint64(chunks[1].End)
+				continue
+			}
+			ref.Bins[bin] = chunks
+		}
+
+		var nIntv int32
+		if err := binary.Read(r, le, &nIntv); err != nil {
+			return nil, truncated
+		}
+		if nIntv < 0 || nIntv > baiMaxIntervals {
+			return nil, SAMerror{str: "Invalid BAI linear index size"}
+		}
+		ref.Intervals = make([]VirtualOffset, nIntv)
+		if err := binary.Read(r, le, ref.Intervals); err != nil {
+			return nil, truncated
+		}
+	}
+
+	// The count of reads with no coordinate is optional
+	var noCoor uint64
+	if err := binary.Read(r, le, &noCoor); err == nil {
+		idx.HasNoCoordinate = true
+		idx.NoCoordinate = noCoor
+	}
+	return idx, nil
+}
+
+// readBAIChunks reads n chunks, a batch at a time so that a corrupt
+// count fails at the end of the file instead of allocating for it.
+func readBAIChunks(r io.Reader, n int) ([]BAIChunk, error) {
+	const batch = 1024
+	var chunks []BAIChunk
+	for len(chunks) < n {
+		m := n - len(chunks)
+		if m > batch {
+			m = batch
+		}
+		buf := make([]BAIChunk, m)
+		if err := binary.Read(r, binary.LittleEndian, buf); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, buf...)
+	}
+	return chunks, nil
+}
+
+// reg2bins lists the bins that may hold alignments overlapping the
+// 0-based, half-open interval [beg, end).
+func reg2bins(beg, end uint32) []uint32 {
+	bins := []uint32{0}
+	if end == 0 || beg >= end {
+		return bins
+	}
+	end--
+	for _, level := range []struct{ offset, shift uint32 }{
+		{1, 26}, {9, 23}, {73, 20}, {585, 17}, {4681, 14},
+	} {
+		for k := level.offset + beg>>level.shift; k <= level.offset+end>>level.shift; k++ {
+			bins = append(bins, k)
+		}
+	}
+	return bins
+}
+
+// chunks returns the sorted, merged chunks of the file that may hold
+// alignments on reference refID overlapping [beg, end).
+func (idx *BAI) chunks(refID int, beg, end uint32) []BAIChunk {
+	ref := &idx.Refs[refID]
+
+	// Nothing overlapping the region starts before the linear index
+	// offset of its first window.
+	var minOffset VirtualOffset
+	if n := len(ref.Intervals); n > 0 {
+		w := int(beg >> baiLinearShift)
+		if w >= n {
+			w = n - 1
+		}
+		minOffset = ref.Intervals[w]
+	}
+
+	var chunks []BAIChunk
+	for _, bin := range reg2bins(beg, end) {
+		for _, c := range ref.Bins[bin] {
+			if c.End > minOffset {
+				chunks = append(chunks, c)
+			}
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Begin < chunks[j].Begin })
+
+	var merged []BAIChunk
+	for _, c := range chunks {
+		if n := len(merged); n > 0 && c.Begin <= merged[n-1].End {
+			if c.End > merged[n-1].End {
+				merged[n-1].End = c.End
+			}
+			continue
+		}
+		merged = append(merged, c)
+	}
+	return merged
+}
+
+// AlignmentIterator is anything that returns alignments one at a time,
+// with io.EOF after the last.
+type AlignmentIterator interface {
+	Next() (*Alignment, error)
+}
+
+// SetIndex gives a BAM Reader the index to use in Fetch.
+func (sr *Reader) SetIndex(idx *BAI) {
+	sr.index = idx
+}
+
+// Fetch returns an iterator over the alignments on reference ref that
+// overlap positions start to end (1-based, inclusive). The Reader must
+// be a BAM Reader reading from an io.Seeker, with an index set by
+// SetIndex. The iterator and the Reader share a file position, so
+// Next shouldn't be called on the Reader while the iterator is in
+// use.
+func (sr *Reader) Fetch(ref string, start, end uint32) (AlignmentIterator, error) {
+	if !sr.bam || sr.index == nil {
+		return nil, SAMerror{str: "Fetch needs an indexed BAM file"}
+	}
+	refID := -1
+	for i, name := range sr.refNames {
+		if name == ref {
+			refID = i
+			break
+		}
+	}
+	if refID < 0 {
+		return nil, SAMerror{str: "Reference " + ref + " isn't in the BAM header"}
+	}
+	if refID >= len(sr.index.Refs) {
+		return nil, SAMerror{str: "Reference " + ref + " isn't in the BAM index"}
+	}
+	if start < 1 || end < start {
+		return nil, SAMerror{str: "Invalid region"}
+	}
+	beg := start - 1 // 0-based, half-open from here on
+	it := &fetchIterator{sr: sr, ref: ref, beg: beg, end: end}
+	it.chunks = sr.index.chunks(refID, beg, end)
+	return it, nil
+}
+
+type fetchIterator struct {
+	sr *Reader
+	ref string
+	beg, end uint32
+	chunks []BAIChunk
+	inChunk bool
+}
+
+func (it *fetchIterator) Next() (*Alignment, error) {
+	for len(it.chunks) > 0 {
+		c := it.chunks[0]
+		if !it.inChunk {
+			if err := it.sr.bgzf.Seek(c.Begin); err != nil {
+				return nil, err
+			}
+			it.inChunk = true
+		}
+		if it.sr.bgzf.Tell() >= c.End {
+			it.chunks = it.chunks[1:]
+			it.inChunk = false
+			continue
+		}
+		a, err := it.sr.nextBAM()
+		if err != nil {
+			return a, err
+		}
+		if a.RefName != it.ref || a.Pos == 0 {
+			continue
+		}
+		pos := a.Pos - 1
+		if pos >= it.end {
+			// Alignments are sorted, so there are no more to find
+			it.chunks = nil
+			break
+		}
+		if pos+bamRefSpan(a) > it.beg {
+			it.sr.markCircular(a)
+			return a, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// bamRefSpan is the length of reference an alignment covers for
+// indexing: at least 1, even for unmapped reads placed with their
+// mates.
+func bamRefSpan(a *Alignment) uint32 {
+	ops, _ := a.CigarOps()
+	n := uint32(0)
+	for _, op := range ops {
+		if op.ConsumesReference() {
+			n += uint32(op.Len)
+		}
+	}
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// Reg2Bin returns the number of the smallest bin of the BAM/UCSC
+// binning scheme that holds the 0-based, half-open interval
+// [beg, end), for coordinates up to 2^29. It's the bin stored in BAM
+// records and indexed by BAI files.
+func Reg2Bin(beg, end uint32) uint16 {
+	return uint16(reg2bin(int32(beg), int32(end)))
+}
+
+// Reg2Bins returns the numbers of the bins that may hold alignments
+// overlapping the 0-based, half-open interval [beg, end), in
+// increasing order: the bins, at each of the six levels of the scheme,
+// that the interval overlaps.
+func Reg2Bins(beg, end uint32) []uint16 {
+	bins := reg2bins(beg, end)
+	b := make([]uint16, len(bins))
+	for i, bin := range bins {
+		b[i] = uint16(bin)
+	}
+	return b
+}
+
+// reg2bin gives the smallest bin holding the 0-based, half-open
+// interval [beg, end). Unmapped reads with no position, where beg is
+// -1, go in bin 4680.
+func reg2bin(beg, end int32) uint32 {
+	end--
+	switch {
+	case beg>>14 == end>>14:
+		return uint32(((1<<15)-1)/7 + (beg >> 14))
+	case beg>>17 == end>>17:
+		return uint32(((1<<12)-1)/7 + (beg >> 17))
+	case beg>>20 == end>>20:
+		return uint32(((1<<9)-1)/7 + (beg >> 20))
+	case beg>>23 == end>>23:
+		return uint32(((1<<6)-1)/7 + (beg >> 23))
+	case beg>>26 == end>>26:
+		return uint32(((1<<3)-1)/7 + (beg >> 26))
+	}
+	return 0
+}
+
+// baiBuilder builds an index from the alignments of a coordinate
+// sorted BAM file, as they're written.
+type baiBuilder struct {
+	idx *BAI
+	started bool
+	lastRef, lastPos int32
+}
+
+func newBAIBuilder(nRef int) *baiBuilder {
+	idx := &BAI{Refs: make([]BAIRef, nRef), HasNoCoordinate: true}
+	for i := range idx.Refs {
+		idx.Refs[i].Bins = map[uint32][]BAIChunk{}
+	}
+	return &baiBuilder{idx: idx}
+}
+
+// check returns an error if an alignment on reference refID starting
+// at beg would come out of coordinate order, so that it can be
+// rejected before it's written.
+func (b *baiBuilder) check(refID, beg int32) error {
+	if b.started {
+		// Reads with no reference come last
+		if b.lastRef == -1 && refID != -1 ||
+			refID != -1 && (refID < b.lastRef || refID == b.lastRef && beg < b.lastPos) {
+			return SAMerror{str: "Alignments must be coordinate sorted to be indexed"}
+		}
+	}
+	return nil
+}
+
+// add indexes an alignment on reference refID spanning [beg, end),
+// stored in the file from vbeg up to vend. The alignment must already
+// have passed check.
+func (b *baiBuilder) add(refID, beg, end int32, unmapped bool, vbeg, vend VirtualOffset) {
+	b.started, b.lastRef, b.lastPos = true, refID, beg
+	if refID == -1 {
+		b.idx.NoCoordinate++
+		return
+	}
+
+	ref := &b.idx.Refs[refID]
+	if !ref.HasMeta {
+		ref.HasMeta = true
+		ref.Start = vbeg
+	}
+	ref.End = vend
+	if unmapped {
+		ref.Unmapped++
+	} else {
+		ref.Mapped++
+	}
+
+	bin := reg2bin(beg, end)
+	chunks := ref.Bins[bin]
+	if n := len(chunks); n > 0 && chunks[n-1].End == vbeg {
+		chunks[n-1].End = vend
+	} else {
+		ref.Bins[bin] = append(chunks, BAIChunk{vbeg, vend})
+	}
+
+	// Offsets are never 0, since the BAM header comes first, so 0
+	// marks windows with nothing in them yet. As in samtools, only
+	// mapped reads go in the linear index.
+	if unmapped {
+		return
+	}
+	for w := int(beg >> baiLinearShift); w <= int((end-1)>>baiLinearShift); w++ {
+		for len(ref.Intervals) <= w {
+			ref.Intervals = append(ref.Intervals, 0)
+		}
+		if ref.Intervals[w] == 0 {
+			ref.Intervals[w] = vbeg
+		}
+	}
+}
+
+// finish completes the index the way samtools does, so that it's the
+// same as one samtools would make for the file, and returns it. Empty
+// windows of the linear index take the offset of the window before,
+// or of the reference's first alignment if there's none before. Bins
+// whose chunks lie within 64KB of compressed data are merged into
+// their parent bins, if those have chunks, and then chunks that meet
+// in a BGZF block are merged.
+func (b *baiBuilder) finish() *BAI {
+	for i := range b.idx.Refs {
+		ref := &b.idx.Refs[i]
+		intv := ref.Intervals
+		for j := range intv {
+			if intv[j] != 0 {
+				continue
+			}
+			if j == 0 {
+				intv[j] = ref.Start
+			} else {
+				intv[j] = intv[j-1]
+			}
+		}
+		compressBins(ref.Bins)
+	}
+	return b.idx
+}
+
+// baiMinMarkerDist is the compressed size below which samtools merges
+// a bin's chunks into its parent bin.
+const baiMinMarkerDist = 0x10000
+
+// compressBins merges small bins into their parents, from the
+// smallest bins up, and then merges chunks that meet in a block, as
+// htslib does when it finishes an index.
+func compressBins(bins map[uint32][]BAIChunk) {
+	sortChunks := func(chunks []BAIChunk) {
+		sort.Slice(chunks, func(i, j int) bool { return chunks[i].Begin < chunks[j].Begin })
+	}
+	for level := 5; level > 0; level-- {
+		first := uint32(((1 << (3 * uint(level))) - 1) / 7)
+		for bin, chunks := range bins {
+			if bin < first {
+				continue
+			}
+			sortChunks(chunks)
+			if chunks[len(chunks)-1].End.Coffset()-chunks[0].Begin.Coffset() >= baiMinMarkerDist {
+				continue
+			}
+			parent := (bin - 1) >> 3
+			if _, ok := bins[parent]; !ok {
+				continue
+			}
+			bins[parent] = append(bins[parent], chunks...)
+			delete(bins, bin)
+		}
+	}
+	for bin, chunks := range bins {
+		sortChunks(chunks)
+		merged := chunks[:1]
+		for _, c := range chunks[1:] {
+			last := &merged[len(merged)-1]
+			if last.End.Coffset() >= c.Begin.Coffset() {
+				if c.End > last.End {
+					last.End = c.End
+				}
+			} else {
+				merged = append(merged, c)
+			}
+		}
+		bins[bin] = merged
+	}
+}
+
+// WriteBAI writes idx in .bai format.
+func WriteBAI(w io.Writer, idx *BAI) error {
+	bw := bufio.NewWriter(w)
+	le := binary.LittleEndian
+	bw.Write(baiMagic)
+	binary.Write(bw, le, int32(len(idx.Refs)))
+	for _, ref := range idx.Refs {
+		bins := make([]uint32, 0, len(ref.Bins))
+		for bin := range ref.Bins {
+			bins = append(bins, bin)
+		}
+		sort.Slice(bins, func(i, j int) bool { return bins[i] < bins[j] })
+
+		nBin := len(bins)
+		if ref.HasMeta {
+			nBin++
+		}
+		binary.Write(bw, le, int32(nBin))
+		for _, bin := range bins {
+			binary.Write(bw, le, bin)
+			binary.Write(bw, le, int32(len(ref.Bins[bin])))
+			binary.Write(bw, le, ref.Bins[bin])
+		}
+		if ref.HasMeta {
+			binary.Write(bw, le, uint32(baiMetaBin))
+			binary.Write(bw, le, int32(2))
+			binary.Write(bw, le, []VirtualOffset{ref.Start, ref.End, VirtualOffset(ref.Mapped), VirtualOffset(ref.Unmapped)})
+		}
+		binary.Write(bw, le, int32(len(ref.Intervals)))
+		binary.Write(bw, le, ref.Intervals)
+	}
+	if idx.HasNoCoordinate {
+		binary.Write(bw, le, idx.NoCoordinate)
+	}
+	return bw.Flush()
+}
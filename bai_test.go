@@ -0,0 +1,66 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import "testing"
+
+func TestReg2Bin(t *testing.T) {
+	for _, tc := range []struct {
+		beg, end uint32
+		bin      uint16
+	}{
+		{0, 1, 4681},
+		{0, 1 << 14, 4681},
+		{0, 1<<14 + 1, 585},
+		{1 << 14, 1 << 15, 4682},
+		{0, 1 << 17, 585},
+		{0, 1<<17 + 1, 73},
+		{0, 1 << 20, 73},
+		{0, 1 << 23, 9},
+		{0, 1 << 26, 1},
+		{0, 1<<26 + 1, 0},
+		{0, 1 << 29, 0},
+		{1<<29 - 1, 1 << 29, 37448},
+	} {
+		if bin := Reg2Bin(tc.beg, tc.end); bin != tc.bin {
+			t.Errorf("Reg2Bin(%d, %d) = %d, want %d", tc.beg, tc.end, bin, tc.bin)
+		}
+	}
+}
+
+func TestReg2Bins(t *testing.T) {
+	for _, tc := range []struct {
+		beg, end uint32
+		bins     []uint16
+	}{
+		{0, 1, []uint16{0, 1, 9, 73, 585, 4681}},
+		{0, 1<<14 + 1, []uint16{0, 1, 9, 73, 585, 4681, 4682}},
+		{1<<26 - 1, 1<<26 + 1, []uint16{0, 1, 2, 16, 17, 136, 137, 1096, 1097, 8776, 8777}},
+	} {
+		bins := Reg2Bins(tc.beg, tc.end)
+		if len(bins) != len(tc.bins) {
+			t.Errorf("Reg2Bins(%d, %d) = %v, want %v", tc.beg, tc.end, bins, tc.bins)
+			continue
+		}
+		for i := range bins {
+			if bins[i] != tc.bins[i] {
+				t.Errorf("Reg2Bins(%d, %d) = %v, want %v", tc.beg, tc.end, bins, tc.bins)
+				break
+			}
+		}
+	}
+}
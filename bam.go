@@ -0,0 +1,443 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var bamMagic = []byte("BAM\x01")
+
+// 4-bit encoding of SEQ bases, and the CIGAR operations by op code
+const (
+	bamSeqBases = "=ACMGRSVTWYHKDBN"
+	bamCigarOps = "MIDNSHP=X"
+)
+
+// Codes for CIGAR operations in BAM, indexes into bamCigarOps, for the
+// CG tag placeholder.
+const (
+	bamCigarN = 3
+	bamCigarS = 4
+)
+
+// Limits on the lengths read from a BAM file, far above anything real,
+// so that a corrupt length is an error rather than a huge allocation.
+const (
+	bamMaxTextLen   = 1 << 30
+	bamMaxNameLen   = 1 << 16
+	bamMaxRecordLen = 1 << 28
+)
+
+// readBAMBytes reads n bytes of a BAM file, checking n against max
+// first. Lengths over 64KB are read into a buffer that grows as the
+// data arrives, so that a length past the end of a truncated file
+// fails without allocating for all of it.
+func readBAMBytes(r io.Reader, n, max int32, what string) ([]byte, error) {
+	if n < 0 || n > max {
+		return nil, SAMerror{str: fmt.Sprintf("Invalid BAM %s length %d", what, n), err: ErrOutOfRange}
+	}
+	truncated := SAMerror{str: "Truncated BAM " + what, err: ErrTruncatedRecord}
+	if n <= 0x10000 {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, truncated
+		}
+		return b, nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		return nil, truncated
+	}
+	return buf.Bytes(), nil
+}
+
+// NewBAMReader reads the header of a BAM file from r, returning a
+// Reader whose Next method decodes the binary alignment records. If r
+// is an io.Seeker, the Reader can be given an index with SetIndex to
+// fetch alignments by region.
+func NewBAMReader(r io.Reader) (*Reader, error) {
+	br := NewBlockReader(r)
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != string(bamMagic) {
+		return nil, SAMerror{str: "Not a BAM file"}
+	}
+
+	// The header text is the same as a SAM header, so it's parsed by
+	// the SAM reader. It may be padded with NULs.
+	var lText int32
+	if err := binary.Read(br, binary.LittleEndian, &lText); err != nil {
+		return nil, err
+	}
+	text, err := readBAMBytes(br, lText, bamMaxTextLen, "header")
+	if err != nil {
+		return nil, err
+	}
+	hr, err := NewReader(strings.NewReader(strings.TrimRight(string(text), "\x00")))
+	if err != nil {
+		return nil, err
+	}
+	sr := &Reader{Header: hr.Header, bgzf: br, bam: true}
+
+	// The binary reference list is what alignment records refer to.
+	// The text is allowed to leave out @SQ lines, in which case the
+	// dictionary is built from the binary list.
+	var nRef int32
+	if err := binary.Read(br, binary.LittleEndian, &nRef); err != nil {
+		return sr, err
+	}
+	names := newHeaderNames()
+	for i := int32(0); i < nRef; i++ {
+		var lName int32
+		if err := binary.Read(br, binary.LittleEndian, &lName); err != nil {
+			return sr, err
+		}
+		if lName < 1 {
+			return sr, SAMerror{str: "Invalid BAM reference name length"}
+		}
+		name, err := readBAMBytes(br, lName, bamMaxNameLen, "reference name")
+		if err != nil {
+			return sr, err
+		}
+		var lRef int32
+		if err := binary.Read(br, binary.LittleEndian, &lRef); err != nil {
+			return sr, err
+		}
+		sr.refNames = append(sr.refNames, strings.TrimRight(string(name), "\x00"))
+		if len(hr.Header.SQ) == 0 {
+			rsd := &RefSeqDict{Name: sr.refNames[i], Length: uint32(lRef)}
+			if valid, err := validateRefSeqDict(rsd); !valid {
+				return sr, err
+			}
+			if err := names.addRef(rsd.Name); err != nil {
+				return sr, err
+			}
+			sr.Header.SQ = append(sr.Header.SQ, rsd)
+		}
+	}
+	if len(hr.Header.SQ) != 0 && len(hr.Header.SQ) != len(sr.refNames) {
+		return sr, SAMerror{str: "BAM reference list doesn't match the @SQ lines in its header"}
+	}
+	sr.Header.indexRefs()
+	return sr, nil
+}
+
+// nextBAM reads and decodes the next binary alignment record.
+func (sr *Reader) nextBAM() (*Alignment, error) {
+	var blockSize int32
+	if err := binary.Read(sr.bgzf, binary.LittleEndian, &blockSize); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, SAMerror{str: "Truncated BAM record", err: ErrTruncatedRecord}
+		}
+		return nil, err // io.EOF at the end of the file
+	}
+	if blockSize < 32 {
+		return nil, SAMerror{str: "Invalid BAM record size"}
+	}
+	rec, err := readBAMBytes(sr.bgzf, blockSize, bamMaxRecordLen, "record")
+	if err != nil {
+		return nil, err
+	}
+	sr.line++
+	a, err := decodeBAMRecord(rec, sr.refNames)
+	if err != nil {
+		return nil, err
+	}
+	if valid, err := validateAlignment(a); !valid {
+		return a, err
+	}
+	return a, nil
+}
+
+// bamRefName translates a BAM reference ID into a name, with -1
+// meaning the reference is unavailable.
+func bamRefName(id int32, refNames []string) (string, error) {
+	if id == -1 {
+		return "*", nil
+	}
+	if id < 0 || int(id) >= len(refNames) {
+		return "", SAMerror{str: fmt.Sprintf("Invalid BAM reference ID %d", id)}
+	}
+	return refNames[id], nil
+}
+
+// decodeBAMRecord decodes a binary alignment record, excluding its
+// leading block_size, into the text forms Alignment uses.
+func decodeBAMRecord(rec []byte, refNames []string) (*Alignment, error) {
+	le := binary.LittleEndian
+	refID := int32(le.Uint32(rec[0:]))
+	pos := int32(le.Uint32(rec[4:]))
+	lReadName := int(rec[8])
+	mapq := rec[9]
+	// rec[10:12] is the bin, which can be computed from the alignment
+	nCigarOp := int(le.Uint16(rec[12:]))
+	flag := le.Uint16(rec[14:])
+	lSeq := int(int32(le.Uint32(rec[16:])))
+	nextRefID := int32(le.Uint32(rec[20:]))
+	nextPos := int32(le.Uint32(rec[24:]))
+	tlen := int32(le.Uint32(rec[28:]))
+
+	if lSeq < 0 || lReadName < 1 {
+		return nil, SAMerror{str: "Invalid BAM record"}
+	}
+	fixedLen := 32 + lReadName + 4*nCigarOp + (lSeq+1)/2 + lSeq
+	if len(rec) < fixedLen {
+		return nil, SAMerror{str: "Truncated BAM record", err: ErrTruncatedRecord}
+	}
+
+	a := Alignment{Flag: flag, Mapq: mapq, TemplateLen: tlen}
+	var err error
+	if a.RefName, err = bamRefName(refID, refNames); err != nil {
+		return nil, err
+	}
+	if a.NextRef, err = bamRefName(nextRefID, refNames); err != nil {
+		return nil, err
+	}
+	if nextRefID != -1 && nextRefID == refID {
+		a.NextRef = "="
+	}
+	// BAM positions are 0-based, with -1 for unavailable
+	a.Pos = uint32(pos + 1)
+	a.NextPos = uint32(nextPos + 1)
+
+	p := 32
+	a.Qname = strings.TrimRight(string(rec[p:p+lReadName]), "\x00")
+	p += lReadName
+
+	cigar := make([]uint32, nCigarOp)
+	for i := range cigar {
+		cigar[i] = le.Uint32(rec[p:])
+		p += 4
+	}
+	if a.Cigar, err = decodeBAMCigar(cigar); err != nil {
+		return nil, err
+	}
+
+	if lSeq == 0 {
+		a.Seq = "*"
+		a.Qual = "*"
+	} else {
+		seq := make([]byte, lSeq)
+		for i := range seq {
+			packed := rec[p+i/2]
+			if i%2 == 0 {
+				seq[i] = bamSeqBases[packed>>4]
+			} else {
+				seq[i] = bamSeqBases[packed&0xF]
+			}
+		}
+		a.Seq = string(seq)
+		p += (lSeq + 1) / 2
+
+		if rec[p] == 0xFF {
+			a.Qual = "*"
+		} else {
+			qual := make([]byte, lSeq)
+			for i := range qual {
+				qual[i] = rec[p+i] + 33
+			}
+			a.Qual = string(qual)
+		}
+		p += lSeq
+	}
+
+	a.OptFields = map[string]OptField{}
+	for p < len(rec) {
+		of, n, err := decodeBAMTag(rec[p:])
+		if err != nil {
+			return nil, err
+		}
+		a.SetTag(of)
+		p += n
+	}
+
+	// A CIGAR of more operations than the 16-bit count allows is kept
+	// in a CG tag, with a placeholder CIGAR of kSmN, where k is the
+	// length of SEQ and m the length of reference the alignment
+	// covers. The placeholder can't be a real CIGAR, since N would be
+	// last.
+	if of, ok := a.OptFields["CG"]; ok && nCigarOp == 2 &&
+		cigar[0] == uint32(lSeq)<<4|bamCigarS && cigar[1]&0xF == bamCigarN {
+		ops, isArray := of.Value.([]uint32)
+		if !isArray {
+			return nil, SAMerror{str: "CG tag in BAM record isn't an array of uint32", Field: "CG"}
+		}
+		if a.Cigar, err = decodeBAMCigar(ops); err != nil {
+			return nil, err
+		}
+		a.DeleteTag("CG")
+	}
+	return &a, nil
+}
+
+// decodeBAMCigar converts binary CIGAR operations, each a length
+// shifted left by 4 and an operation code, to a CIGAR string.
+func decodeBAMCigar(cigar []uint32) (string, error) {
+	if len(cigar) == 0 {
+		return "*", nil
+	}
+	var b strings.Builder
+	for _, c := range cigar {
+		if c&0xF >= uint32(len(bamCigarOps)) {
+			return "", SAMerror{str: "Invalid CIGAR operation in BAM record"}
+		}
+		b.WriteString(strconv.FormatUint(uint64(c>>4), 10))
+		b.WriteByte(bamCigarOps[c&0xF])
+	}
+	return b.String(), nil
+}
+
+// bamArrayElemSize gives the size in bytes of each B array subtype
+var bamArrayElemSize = map[byte]int{
+	'c': 1, 'C': 1, 's': 2, 'S': 2, 'i': 4, 'I': 4, 'f': 4,
+}
+
+// decodeBAMTag decodes one binary optional field from the start of b,
+// returning it and its length in bytes. BAM's sized integer types are
+// all mapped onto SAM's single 'i' type.
+func decodeBAMTag(b []byte) (OptField, int, error) {
+	le := binary.LittleEndian
+	truncated := SAMerror{str: "Truncated optional field in BAM record", err: ErrTruncatedRecord}
+	if len(b) < 4 {
+		return OptField{}, 0, truncated
+	}
+	of := OptField{Tag: string(b[0:2])}
+	valType := b[2]
+	v := b[3:]
+	switch valType {
+	case 'A':
+		of.Type = 'A'
+		of.Value = string(v[0:1])
+		return of, 4, nil
+	case 'c', 'C', 's', 'S', 'i', 'I':
+		size := bamArrayElemSize[valType]
+		if len(v) < size {
+			return of, 0, truncated
+		}
+		of.Type = 'i'
+		of.Value = bamInt(valType, v)
+		return of, 3 + size, nil
+	case 'f':
+		if len(v) < 4 {
+			return of, 0, truncated
+		}
+		of.Type = 'f'
+		of.Value = float64(math.Float32frombits(le.Uint32(v)))
+		return of, 7, nil
+	case 'Z', 'H':
+		end := bytes.IndexByte(v, 0)
+		if end < 0 {
+			return of, 0, truncated
+		}
+		// H is stored in BAM as a hex string, so it's decoded the
+		// same way as in SAM
+		parsed := parseOptField(of.Tag + ":" + string(valType) + ":" + string(v[:end]))
+		return parsed, 3 + end + 1, nil
+	case 'B':
+		if len(v) < 5 {
+			return of, 0, truncated
+		}
+		subtype := v[0]
+		size, ok := bamArrayElemSize[subtype]
+		if !ok {
+			return of, 0, SAMerror{str: "Invalid array type in BAM optional field"}
+		}
+		count := int(le.Uint32(v[1:]))
+		elems := v[5:]
+		if count < 0 || len(elems) < count*size {
+			return of, 0, truncated
+		}
+		of.Type = 'B'
+		of.Value = bamArray(subtype, count, elems)
+		return of, 3 + 5 + count*size, nil
+	}
+	return of, 0, SAMerror{str: fmt.Sprintf("Unknown optional field type %q in BAM record", valType)}
+}
+
+func bamInt(valType byte, v []byte) int64 {
+	le := binary.LittleEndian
+	switch valType {
+	case 'c':
+		return int64(int8(v[0]))
+	case 'C':
+		return int64(v[0])
+	case 's':
+		return int64(int16(le.Uint16(v)))
+	case 'S':
+		return int64(le.Uint16(v))
+	case 'i':
+		return int64(int32(le.Uint32(v)))
+	}
+	return int64(le.Uint32(v)) // 'I'
+}
+
+// bamArray decodes a B array into the same slice types as
+// parseOptArray.
+func bamArray(subtype byte, count int, v []byte) interface{} {
+	le := binary.LittleEndian
+	switch subtype {
+	case 'c':
+		a := make([]int8, count)
+		for i := range a {
+			a[i] = int8(v[i])
+		}
+		return a
+	case 'C':
+		a := make([]uint8, count)
+		copy(a, v)
+		return a
+	case 's':
+		a := make([]int16, count)
+		for i := range a {
+			a[i] = int16(le.Uint16(v[2*i:]))
+		}
+		return a
+	case 'S':
+		a := make([]uint16, count)
+		for i := range a {
+			a[i] = le.Uint16(v[2*i:])
+		}
+		return a
+	case 'i':
+		a := make([]int32, count)
+		for i := range a {
+			a[i] = int32(le.Uint32(v[4*i:]))
+		}
+		return a
+	case 'I':
+		a := make([]uint32, count)
+		for i := range a {
+			a[i] = le.Uint32(v[4*i:])
+		}
+		return a
+	}
+	a := make([]float32, count) // 'f'
+	for i := range a {
+		a[i] = math.Float32frombits(le.Uint32(v[4*i:]))
+	}
+	return a
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// bgzfBytes compresses data as a BGZF file.
+func bgzfBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := NewBlockWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBAMLengthLimits(t *testing.T) {
+	le := binary.LittleEndian
+	header := func(lText int32, text string) []byte {
+		b := append([]byte(nil), bamMagic...)
+		b = le.AppendUint32(b, uint32(lText))
+		return append(b, text...)
+	}
+	withRef := func(b []byte, lName int32, name string) []byte {
+		b = le.AppendUint32(b, 1) // n_ref
+		b = le.AppendUint32(b, uint32(lName))
+		b = append(b, name...)
+		return le.AppendUint32(b, 1000)
+	}
+	valid := withRef(header(0, ""), 5, "chr1\x00")
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"huge header", header(0x7fffffff, "@HD"), ErrOutOfRange},
+		{"truncated header", header(1<<20, "@HD\tVN:1.6\n"), ErrTruncatedRecord},
+		{"huge reference name", withRef(header(0, ""), 0x7fffffff, "chr1"), ErrOutOfRange},
+		{"huge record", le.AppendUint32(append([]byte(nil), valid...), 0x7fffffff), ErrOutOfRange},
+		{"truncated record", le.AppendUint32(append([]byte(nil), valid...), 1<<20), ErrTruncatedRecord},
+	} {
+		sr, err := NewBAMReader(bytes.NewReader(bgzfBytes(t, tc.data)))
+		if err == nil {
+			_, err = sr.Next()
+		}
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
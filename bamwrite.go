@@ -0,0 +1,305 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// BAMWriter writes alignments to a BAM file, optionally building a BAI
+// index of the file as it goes.
+type BAMWriter struct {
+	bgzf     *BlockWriter
+	refIDs   map[string]int
+	index    *baiBuilder
+	indexOut io.Writer
+}
+
+// NewBAMWriter writes the header to w as the start of a BAM file. If
+// index isn't nil, a BAI index is built while alignments are written,
+// and written to index by Close. Alignments must then be written in
+// coordinate order.
+func NewBAMWriter(w io.Writer, header *Header, index io.Writer) (*BAMWriter, error) {
+	bw := &BAMWriter{bgzf: NewBlockWriter(w), refIDs: header.RefIndex(), indexOut: index}
+
+	var text bytes.Buffer
+	if err := writeHeaderSection(&text, header); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	b.Write(bamMagic)
+	binary.Write(&b, le, int32(text.Len()))
+	b.Write(text.Bytes())
+	binary.Write(&b, le, int32(len(header.SQ)))
+	for _, rsd := range header.SQ {
+		binary.Write(&b, le, int32(len(rsd.Name)+1))
+		b.WriteString(rsd.Name)
+		b.WriteByte(0)
+		binary.Write(&b, le, int32(rsd.Length))
+	}
+	if _, err := bw.bgzf.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	// Alignments start in a new block, as samtools does
+	if err := bw.bgzf.Flush(); err != nil {
+		return nil, err
+	}
+	if index != nil {
+		bw.index = newBAIBuilder(len(header.SQ))
+	}
+	return bw, nil
+}
+
+func (bw *BAMWriter) refID(name string) (int32, error) {
+	if name == "*" {
+		return -1, nil
+	}
+	id, ok := bw.refIDs[name]
+	if !ok {
+		return 0, SAMerror{str: "Reference " + name + " isn't in the BAM header"}
+	}
+	return int32(id), nil
+}
+
+// Write encodes a as a binary alignment record.
+func (bw *BAMWriter) Write(a *Alignment) error {
+	refID, err := bw.refID(a.RefName)
+	if err != nil {
+		return err
+	}
+	nextRefID := refID
+	if a.NextRef != "=" {
+		if nextRefID, err = bw.refID(a.NextRef); err != nil {
+			return err
+		}
+	}
+	rec, err := encodeBAMRecord(a, refID, nextRefID)
+	if err != nil {
+		return err
+	}
+
+	// Check the order before writing, so an out-of-order alignment
+	// doesn't end up in the file without being in the index
+	pos := int32(a.Pos) - 1
+	if bw.index != nil {
+		if err := bw.index.check(refID, pos); err != nil {
+			return err
+		}
+	}
+	beg := bw.bgzf.Tell()
+	if _, err := bw.bgzf.Write(rec); err != nil {
+		return err
+	}
+	if bw.index != nil {
+		bw.index.add(refID, pos, pos+int32(bamRefSpan(a)), a.IsUnmapped(), beg, bw.bgzf.Tell())
+	}
+	return nil
+}
+
+// Close finishes the BAM file, and writes the index if one is being
+// built. It doesn't close the underlying writers.
+func (bw *BAMWriter) Close() error {
+	if err := bw.bgzf.Close(); err != nil {
+		return err
+	}
+	if bw.index != nil {
+		return WriteBAI(bw.indexOut, bw.index.finish())
+	}
+	return nil
+}
+
+// encodeBAMRecord is the inverse of decodeBAMRecord, including the
+// leading block_size.
+func encodeBAMRecord(a *Alignment, refID, nextRefID int32) ([]byte, error) {
+	ops, err := a.CigarOps()
+	if err != nil {
+		return nil, err
+	}
+	if len(a.Qname)+1 > 0xFF {
+		return nil, SAMerror{str: "QNAME too long for a BAM record"}
+	}
+	seq := a.Seq
+	if seq == "*" {
+		seq = ""
+	}
+	// BAM stores a quality for each base, so they have to agree
+	if a.Qual != "*" && len(a.Qual) != len(seq) {
+		return nil, SAMerror{str: fmt.Sprintf("Alignment %s has %d qualities for %d bases", a.Qname, len(a.Qual), len(seq)), Field: "QUAL"}
+	}
+	cigar := make([]uint32, len(ops))
+	for i, op := range ops {
+		cigar[i] = uint32(op.Len)<<4 | uint32(strings.IndexByte(bamCigarOps, op.Op))
+	}
+	// Too many operations for the 16-bit count go in a CG tag, as
+	// decodeBAMRecord expects
+	var cg []uint32
+	if len(cigar) > 0xFFFF {
+		cg = cigar
+		cigar = []uint32{uint32(len(seq))<<4 | bamCigarS, bamRefSpan(a)<<4 | bamCigarN}
+	}
+
+	le := binary.LittleEndian
+	pos := int32(a.Pos) - 1
+	var b bytes.Buffer
+	b.Write(make([]byte, 4)) // block_size, filled in at the end
+	binary.Write(&b, le, refID)
+	binary.Write(&b, le, pos)
+	b.WriteByte(byte(len(a.Qname) + 1))
+	b.WriteByte(a.Mapq)
+	binary.Write(&b, le, uint16(reg2bin(pos, pos+int32(bamRefSpan(a)))))
+	binary.Write(&b, le, uint16(len(cigar)))
+	binary.Write(&b, le, a.Flag)
+	binary.Write(&b, le, int32(len(seq)))
+	binary.Write(&b, le, nextRefID)
+	binary.Write(&b, le, int32(a.NextPos)-1)
+	binary.Write(&b, le, a.TemplateLen)
+	b.WriteString(a.Qname)
+	b.WriteByte(0)
+	binary.Write(&b, le, cigar)
+
+	packed := make([]byte, (len(seq)+1)/2)
+	for i := 0; i < len(seq); i++ {
+		code := strings.IndexByte(bamSeqBases, seq[i]&^0x20) // uppercase
+		if seq[i] == '=' {
+			code = 0
+		}
+		if code < 0 {
+			code = 15 // N
+		}
+		if i%2 == 0 {
+			packed[i/2] = byte(code) << 4
+		} else {
+			packed[i/2] |= byte(code)
+		}
+	}
+	b.Write(packed)
+	if a.Qual == "*" {
+		b.Write(bytes.Repeat([]byte{0xFF}, len(seq)))
+	} else {
+		for i := 0; i < len(a.Qual); i++ {
+			b.WriteByte(a.Qual[i] - 33)
+		}
+	}
+
+	for _, of := range a.Tags() {
+		if cg != nil && of.Tag == "CG" {
+			continue
+		}
+		if err := encodeBAMTag(&b, of); err != nil {
+			return nil, err
+		}
+	}
+	if cg != nil {
+		if err := encodeBAMTag(&b, OptField{Tag: "CG", Type: 'B', Value: cg}); err != nil {
+			return nil, err
+		}
+	}
+
+	rec := b.Bytes()
+	le.PutUint32(rec, uint32(len(rec)-4))
+	return rec, nil
+}
+
+// encodeBAMTag writes of in binary form. Integers are stored in the
+// smallest type that holds them, as samtools does.
+func encodeBAMTag(b *bytes.Buffer, of OptField) error {
+	le := binary.LittleEndian
+	if len(of.Tag) != 2 {
+		return SAMerror{str: fmt.Sprintf("Invalid optional field tag %q", of.Tag)}
+	}
+	b.WriteString(of.Tag)
+	switch v := of.Value.(type) {
+	case string:
+		if of.Type == 'A' {
+			if len(v) != 1 {
+				return SAMerror{str: fmt.Sprintf("Optional field %s of type A has value %q, not one character", of.Tag, v), Field: of.Tag}
+			}
+			b.WriteByte('A')
+			b.WriteString(v)
+			return nil
+		}
+		if of.Type != 'Z' {
+			return SAMerror{str: fmt.Sprintf("Optional field %s has unknown type %c, which can't be stored in BAM", of.Tag, of.Type)}
+		}
+		b.WriteByte('Z')
+		b.WriteString(v)
+		b.WriteByte(0)
+	case int64:
+		switch {
+		case v >= 0 && v <= math.MaxUint8:
+			b.WriteByte('C')
+			b.WriteByte(uint8(v))
+		case v >= math.MinInt8 && v < 0:
+			b.WriteByte('c')
+			b.WriteByte(uint8(int8(v)))
+		case v >= 0 && v <= math.MaxUint16:
+			b.WriteByte('S')
+			binary.Write(b, le, uint16(v))
+		case v >= math.MinInt16 && v < 0:
+			b.WriteByte('s')
+			binary.Write(b, le, int16(v))
+		case v >= 0 && v <= math.MaxUint32:
+			b.WriteByte('I')
+			binary.Write(b, le, uint32(v))
+		case v >= math.MinInt32 && v < 0:
+			b.WriteByte('i')
+			binary.Write(b, le, int32(v))
+		default:
+			return SAMerror{str: "Optional field " + of.Tag + " is out of range for BAM"}
+		}
+	case float64:
+		b.WriteByte('f')
+		binary.Write(b, le, float32(v))
+	case []byte:
+		if of.Type == 'H' {
+			b.WriteByte('H')
+			b.WriteString(strings.ToUpper(hex.EncodeToString(v)))
+			b.WriteByte(0)
+			return nil
+		}
+		return encodeBAMArray(b, 'C', len(v), v)
+	case []int8:
+		return encodeBAMArray(b, 'c', len(v), v)
+	case []int16:
+		return encodeBAMArray(b, 's', len(v), v)
+	case []uint16:
+		return encodeBAMArray(b, 'S', len(v), v)
+	case []int32:
+		return encodeBAMArray(b, 'i', len(v), v)
+	case []uint32:
+		return encodeBAMArray(b, 'I', len(v), v)
+	case []float32:
+		return encodeBAMArray(b, 'f', len(v), v)
+	default:
+		return SAMerror{str: "Optional field " + of.Tag + " has no BAM encoding"}
+	}
+	return nil
+}
+
+func encodeBAMArray(b *bytes.Buffer, subtype byte, count int, data interface{}) error {
+	b.WriteByte('B')
+	b.WriteByte(subtype)
+	binary.Write(b, binary.LittleEndian, int32(count))
+	return binary.Write(b, binary.LittleEndian, data)
+}
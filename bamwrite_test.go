@@ -0,0 +1,263 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func indexTestHeader() *Header {
+	return &Header{
+		HD: &HeaderLine{Version: "1.6", SortOrder: SortCoordinate},
+		SQ: []*RefSeqDict{{Name: "chr1", Length: 1000000}, {Name: "chr2", Length: 50000}},
+	}
+}
+
+func indexTestRead(qname string, flag uint16, ref string, pos uint32, cigar string) *Alignment {
+	return &Alignment{Qname: qname, Flag: flag, RefName: ref, Pos: pos, Mapq: 60, Cigar: cigar,
+		NextRef: "*", Seq: "*", Qual: "*", OptFields: map[string]OptField{}}
+}
+
+// writeIndexedBAM writes alignments as a BAM file, returning it and
+// its index.
+func writeIndexedBAM(t *testing.T, alignments []*Alignment) ([]byte, *BAI) {
+	var bam, bai bytes.Buffer
+	bw, err := NewBAMWriter(&bam, indexTestHeader(), &bai)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range alignments {
+		if err := bw.Write(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ReadBAI(&bai)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bam.Bytes(), idx
+}
+
+func TestBAMWriterIndex(t *testing.T) {
+	alignments := []*Alignment{
+		indexTestRead("r1", 0, "chr1", 100, "50M"),
+		indexTestRead("r2", 16, "chr1", 16370, "30M"), // crosses the first 16kbp window
+		indexTestRead("r3", 0, "chr1", 20000, "50M"),
+		indexTestRead("r4", 0, "chr2", 5, "10M"),
+		indexTestRead("r5", FlagUnmapped, "chr2", 5, "*"), // placed with its mate
+		indexTestRead("r6", FlagUnmapped, "*", 0, "*"),
+	}
+	data, idx := writeIndexedBAM(t, alignments)
+
+	// Find where each record starts by reading the file back
+	sr, err := NewBAMReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []VirtualOffset
+	for {
+		offsets = append(offsets, sr.bgzf.Tell())
+		if _, err := sr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(idx.Refs) != 2 {
+		t.Fatalf("index has %d references, want 2", len(idx.Refs))
+	}
+	chr1, chr2 := idx.Refs[0], idx.Refs[1]
+	if !chr1.HasMeta || chr1.Mapped != 3 || chr1.Unmapped != 0 || chr1.Start != offsets[0] || chr1.End != offsets[3] {
+		t.Errorf("chr1 metadata = %v %v %d %d, want %v %v 3 0", chr1.Start, chr1.End, chr1.Mapped, chr1.Unmapped, offsets[0], offsets[3])
+	}
+	if !chr2.HasMeta || chr2.Mapped != 1 || chr2.Unmapped != 1 || chr2.Start != offsets[3] || chr2.End != offsets[5] {
+		t.Errorf("chr2 metadata = %v %v %d %d, want %v %v 1 1", chr2.Start, chr2.End, chr2.Mapped, chr2.Unmapped, offsets[3], offsets[5])
+	}
+	if !idx.HasNoCoordinate || idx.NoCoordinate != 1 {
+		t.Errorf("NoCoordinate = %d, want 1", idx.NoCoordinate)
+	}
+
+	// The reads are all in one BGZF block, so samtools merges the
+	// small bins of chr1 into 585, the bin of r2, and every chunk
+	// into one. chr2's bin has no parent to merge into.
+	checkBins(t, "chr1", chr1.Bins, map[uint32][]BAIChunk{585: {{offsets[0], offsets[3]}}})
+	checkBins(t, "chr2", chr2.Bins, map[uint32][]BAIChunk{4681: {{offsets[3], offsets[5]}}})
+
+	// r5 is unmapped, so it's left out of the linear index
+	checkOffsets(t, "chr1 linear index", chr1.Intervals, []VirtualOffset{offsets[0], offsets[1]})
+	checkOffsets(t, "chr2 linear index", chr2.Intervals, []VirtualOffset{offsets[3]})
+
+	// Fetch finds reads by the index
+	sr, err = NewBAMReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr.SetIndex(idx)
+	for _, tc := range []struct {
+		ref        string
+		start, end uint32
+		want       []string
+	}{
+		{"chr1", 1, 1000000, []string{"r1", "r2", "r3"}},
+		{"chr1", 16390, 16400, []string{"r2"}},
+		{"chr1", 150, 16369, nil},
+		{"chr2", 1, 10, []string{"r4", "r5"}},
+	} {
+		it, err := sr.Fetch(tc.ref, tc.start, tc.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for {
+			a, err := it.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, a.Qname)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("Fetch(%s, %d, %d) = %v, want %v", tc.ref, tc.start, tc.end, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("Fetch(%s, %d, %d) = %v, want %v", tc.ref, tc.start, tc.end, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestBAMWriterIndexUnsorted(t *testing.T) {
+	var bam, bai bytes.Buffer
+	bw, err := NewBAMWriter(&bam, indexTestHeader(), &bai)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Write(indexTestRead("r1", 0, "chr1", 200, "10M")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Write(indexTestRead("r2", 0, "chr1", 100, "10M")); err == nil {
+		t.Fatal("out of order alignment written to an indexed BAM")
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The rejected alignment isn't in the file
+	sr, err := NewBAMReader(bytes.NewReader(bam.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		a, err := sr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, a.Qname)
+	}
+	if len(names) != 1 || names[0] != "r1" {
+		t.Errorf("BAM has alignments %v, want just r1", names)
+	}
+}
+
+func TestEncodeBAMRecordErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  func(a *Alignment)
+	}{
+		{"empty A tag", func(a *Alignment) { a.SetTag(OptField{Tag: "XA", Type: 'A', Value: ""}) }},
+		{"long A tag", func(a *Alignment) { a.SetTag(OptField{Tag: "XA", Type: 'A', Value: "ab"}) }},
+		{"short QUAL", func(a *Alignment) { a.Qual = "III" }},
+		{"QUAL without SEQ", func(a *Alignment) { a.Seq = "*" }},
+	} {
+		a := indexTestRead("r1", 0, "chr1", 100, "4M")
+		a.Seq, a.Qual = "ACGT", "IIII"
+		tc.set(a)
+		if _, err := encodeBAMRecord(a, 0, -1); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
+
+func checkBins(t *testing.T, name string, got, want map[uint32][]BAIChunk) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s bins = %v, want %v", name, got, want)
+		return
+	}
+	for bin, chunks := range want {
+		if len(got[bin]) != len(chunks) {
+			t.Errorf("%s bins = %v, want %v", name, got, want)
+			return
+		}
+		for i := range chunks {
+			if got[bin][i] != chunks[i] {
+				t.Errorf("%s bins = %v, want %v", name, got, want)
+				return
+			}
+		}
+	}
+}
+
+func checkOffsets(t *testing.T, name string, got, want []VirtualOffset) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s = %v, want %v", name, got, want)
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s = %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func TestBAIBuilderFinish(t *testing.T) {
+	v := func(block int64, offset uint16) VirtualOffset { return MakeVirtualOffset(block, offset) }
+	b := newBAIBuilder(1)
+	// Alignments in bins 4681 and 585 close together, then one in
+	// bin 4683, then bin 4685 over 64KB of data, and one last read in
+	// 4685 in the same block as the one before.
+	b.add(0, 100, 150, false, v(100, 0), v(100, 50))
+	b.add(0, 16370, 16400, false, v(100, 50), v(100, 90))
+	b.add(0, 40000, 40050, false, v(100, 90), v(200, 10))
+	b.add(0, 70000, 70050, false, v(200, 10), v(300000, 20))
+	b.add(0, 70100, 70150, true, v(300000, 40), v(300000, 60))
+	idx := b.finish()
+	ref := idx.Refs[0]
+	checkBins(t, "finished", ref.Bins, map[uint32][]BAIChunk{
+		585:  {{v(100, 0), v(200, 10)}},
+		4685: {{v(200, 10), v(300000, 60)}},
+	})
+	// Windows 0 to 4 from the mapped reads, with 2 and 3 filled in
+	checkOffsets(t, "linear index", ref.Intervals, []VirtualOffset{v(100, 0), v(100, 50), v(100, 90), v(100, 90), v(200, 10)})
+	if ref.Mapped != 4 || ref.Unmapped != 1 || ref.Start != v(100, 0) || ref.End != v(300000, 60) {
+		t.Errorf("metadata = %v %v %d %d", ref.Start, ref.End, ref.Mapped, ref.Unmapped)
+	}
+}
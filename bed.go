@@ -0,0 +1,72 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// WriteBED writes the interval of the reference a is aligned to as a
+// BED6 line: chrom, 0-based start, end, QNAME as the name, MAPQ as the
+// score, and strand, as bedtools bamtobed does. The end comes from
+// POS and the reference length of the CIGAR. Nothing is written for
+// an unmapped read.
+func WriteBED(w io.Writer, a *Alignment) error {
+	if !isPlaced(a) {
+		return nil
+	}
+	strand := bedStrand(a)
+	_, err := fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%c\n", a.RefName, a.Pos-1, a.linearEnd(), a.Qname, a.Mapq, strand)
+	return err
+}
+
+// WriteBED12 writes a as a BED12 line, with a block for each of the
+// stretches of reference given by ReferenceBlocks, so that a spliced
+// read is drawn as exons joined by introns. The first six columns are
+// as for WriteBED, the thick part is the whole alignment, and itemRgb
+// is 0. Nothing is written for an unmapped read or one whose CIGAR
+// covers no reference.
+func WriteBED12(w io.Writer, a *Alignment) error {
+	if !isPlaced(a) {
+		return nil
+	}
+	blocks := a.ReferenceBlocks()
+	if len(blocks) == 0 {
+		return nil
+	}
+	start, end := blocks[0][0], blocks[len(blocks)-1][1]
+	sizes := make([]string, len(blocks))
+	starts := make([]string, len(blocks))
+	for i, b := range blocks {
+		sizes[i] = strconv.FormatUint(uint64(b[1]-b[0]), 10)
+		starts[i] = strconv.FormatUint(uint64(b[0]-start), 10)
+	}
+	_, err := fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%c\t%d\t%d\t0\t%d\t%s\t%s\n",
+		a.RefName, start, end, a.Qname, a.Mapq, bedStrand(a), start, end,
+		len(blocks), strings.Join(sizes, ","), strings.Join(starts, ","))
+	return err
+}
+
+func bedStrand(a *Alignment) byte {
+	if a.IsReverse() {
+		return '-'
+	}
+	return '+'
+}
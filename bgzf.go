@@ -0,0 +1,274 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+// BGZF is the block compression format used by BAM: a series of gzip
+// members, each holding at most 64KB, whose compressed size is stored
+// in a gzip extra field. Positions in a BGZF file are given as
+// virtual offsets, so an index can point into the middle of a block.
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	bgzfHeaderLen = 18
+	bgzfTrailerLen = 8
+	bgzfMaxBlockLen = 0x10000
+	// Uncompressed data per block, leaving room for deflate to expand
+	// incompressible data without the block overflowing 64KB.
+	bgzfMaxDataLen = 0xff00
+)
+
+// The empty block that marks the end of a BGZF file
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// VirtualOffset is a position in a BGZF file: the offset of the start
+// of a compressed block in the upper 48 bits, and the offset into the
+// block's uncompressed data in the lower 16.
+type VirtualOffset uint64
+
+func MakeVirtualOffset(coffset int64, uoffset uint16) VirtualOffset {
+	return VirtualOffset(uint64(coffset)<<16 | uint64(uoffset))
+}
+
+// Coffset is the file offset of the compressed block.
+func (v VirtualOffset) Coffset() int64 {
+	return int64(v >> 16)
+}
+
+// Uoffset is the offset within the block's uncompressed data.
+func (v VirtualOffset) Uoffset() uint16 {
+	return uint16(v & 0xFFFF)
+}
+
+// BlockReader reads a BGZF file a block at a time, keeping track of
+// virtual offsets. It also implements io.Reader over the decompressed
+// stream.
+type BlockReader struct {
+	r io.Reader
+	coffset int64 // file offset of the next block to be read
+
+	block []byte // decompressed data of the current block
+	blockStart int64 // file offset of the current block
+	pos int // read position in block
+}
+
+func NewBlockReader(r io.Reader) *BlockReader {
+	return &BlockReader{r: r}
+}
+
+// ReadBlock reads and decompresses the next block, returning its data
+// and the virtual offset of its start. It returns io.EOF when there
+// are no more blocks.
+func (br *BlockReader) ReadBlock() ([]byte, VirtualOffset, error) {
+	start := br.coffset
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(br.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, SAMerror{str: "Truncated BGZF block"}
+		}
+		return nil, 0, err
+	}
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 || header[3]&4 == 0 {
+		return nil, 0, SAMerror{str: "Invalid BGZF block header"}
+	}
+	extra := make([]byte, binary.LittleEndian.Uint16(header[10:]))
+	if _, err := io.ReadFull(br.r, extra); err != nil {
+		return nil, 0, SAMerror{str: "Truncated BGZF block"}
+	}
+
+	// Find the BC subfield holding the block size
+	bsize := -1
+	for len(extra) >= 4 {
+		slen := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+slen {
+			break
+		}
+		if extra[0] == 'B' && extra[1] == 'C' && slen == 2 {
+			bsize = int(binary.LittleEndian.Uint16(extra[4:])) + 1
+		}
+		extra = extra[4+slen:]
+	}
+	rest := bsize - 12 - int(binary.LittleEndian.Uint16(header[10:]))
+	if bsize < 0 || rest < bgzfTrailerLen {
+		return nil, 0, SAMerror{str: "Invalid BGZF block header"}
+	}
+
+	body := make([]byte, rest)
+	if _, err := io.ReadFull(br.r, body); err != nil {
+		return nil, 0, SAMerror{str: "Truncated BGZF block"}
+	}
+	cdata := body[:rest-bgzfTrailerLen]
+	crc := binary.LittleEndian.Uint32(body[rest-8:])
+	isize := binary.LittleEndian.Uint32(body[rest-4:])
+	if isize > bgzfMaxBlockLen {
+		return nil, 0, SAMerror{str: "Invalid BGZF block size"}
+	}
+
+	data := make([]byte, isize)
+	fr := flate.NewReader(bytes.NewReader(cdata))
+	if _, err := io.ReadFull(fr, data); err != nil {
+		return nil, 0, SAMerror{str: "Invalid BGZF block data"}
+	}
+	fr.Close()
+	if crc32.ChecksumIEEE(data) != crc {
+		return nil, 0, SAMerror{str: "BGZF block checksum mismatch"}
+	}
+
+	br.coffset += int64(bsize)
+	br.block, br.blockStart, br.pos = data, start, 0
+	return data, MakeVirtualOffset(start, 0), nil
+}
+
+// Read reads decompressed data, moving across block boundaries as
+// needed.
+func (br *BlockReader) Read(p []byte) (int, error) {
+	for br.pos == len(br.block) {
+		if _, _, err := br.ReadBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, br.block[br.pos:])
+	br.pos += n
+	return n, nil
+}
+
+// Tell returns the virtual offset of the next byte Read will return.
+func (br *BlockReader) Tell() VirtualOffset {
+	if br.pos == len(br.block) {
+		return MakeVirtualOffset(br.coffset, 0)
+	}
+	return MakeVirtualOffset(br.blockStart, uint16(br.pos))
+}
+
+// Seek moves to virtual offset v, which requires the underlying reader
+// to be an io.Seeker.
+func (br *BlockReader) Seek(v VirtualOffset) error {
+	s, ok := br.r.(io.Seeker)
+	if !ok {
+		return SAMerror{str: "BGZF reader can't seek"}
+	}
+	if _, err := s.Seek(v.Coffset(), io.SeekStart); err != nil {
+		return err
+	}
+	br.coffset = v.Coffset()
+	br.block, br.pos = nil, 0
+	if _, _, err := br.ReadBlock(); err != nil {
+		return err
+	}
+	if int(v.Uoffset()) > len(br.block) {
+		return SAMerror{str: "Virtual offset is past the end of its BGZF block"}
+	}
+	br.pos = int(v.Uoffset())
+	return nil
+}
+
+// BlockWriter compresses data written to it into BGZF blocks. Each
+// block is written when it fills up, or when Flush is called.
+type BlockWriter struct {
+	w io.Writer
+	level int
+	coffset int64 // file offset of the block being filled
+	buf []byte // uncompressed data for the block being filled
+}
+
+func NewBlockWriter(w io.Writer) *BlockWriter {
+	return NewBlockWriterLevel(w, flate.DefaultCompression)
+}
+
+// NewBlockWriterLevel is like NewBlockWriter, but uses the given
+// compress/flate compression level.
+func NewBlockWriterLevel(w io.Writer, level int) *BlockWriter {
+	return &BlockWriter{w: w, level: level, buf: make([]byte, 0, bgzfMaxDataLen)}
+}
+
+func (bw *BlockWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m := copy(bw.buf[len(bw.buf):cap(bw.buf)], p)
+		bw.buf = bw.buf[:len(bw.buf)+m]
+		p = p[m:]
+		n += m
+		if len(bw.buf) == cap(bw.buf) {
+			if err := bw.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Tell returns the virtual offset that the next byte written will
+// have.
+func (bw *BlockWriter) Tell() VirtualOffset {
+	return MakeVirtualOffset(bw.coffset, uint16(len(bw.buf)))
+}
+
+// Flush writes any buffered data as a block. Flushing an empty buffer
+// does nothing, since an empty block marks the end of the file.
+func (bw *BlockWriter) Flush() error {
+	if len(bw.buf) == 0 {
+		return nil
+	}
+	var cdata bytes.Buffer
+	fw, err := flate.NewWriter(&cdata, bw.level)
+	if err != nil {
+		return err
+	}
+	fw.Write(bw.buf)
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	bsize := bgzfHeaderLen + cdata.Len() + bgzfTrailerLen
+	if bsize > bgzfMaxBlockLen {
+		return SAMerror{str: "BGZF block too large"}
+	}
+
+	block := make([]byte, 0, bsize)
+	block = append(block, 0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0)
+	block = binary.LittleEndian.AppendUint16(block, uint16(bsize-1))
+	block = append(block, cdata.Bytes()...)
+	block = binary.LittleEndian.AppendUint32(block, crc32.ChecksumIEEE(bw.buf))
+	block = binary.LittleEndian.AppendUint32(block, uint32(len(bw.buf)))
+	if _, err := bw.w.Write(block); err != nil {
+		return err
+	}
+	bw.coffset += int64(bsize)
+	bw.buf = bw.buf[:0]
+	return nil
+}
+
+// Close flushes any buffered data and writes the end-of-file marker.
+// It doesn't close the underlying writer.
+func (bw *BlockWriter) Close() error {
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(bgzfEOF); err != nil {
+		return err
+	}
+	bw.coffset += int64(len(bgzfEOF))
+	return nil
+}
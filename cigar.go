@@ -0,0 +1,372 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CigarOp is a single operation from a CIGAR string, e.g. 10M.
+type CigarOp struct {
+	Op  byte // one of MIDNSHP=X
+	Len int
+}
+
+// ParseCigar splits a CIGAR string into its operations. The
+// unavailable CIGAR "*" has no operations.
+func ParseCigar(cigar string) ([]CigarOp, error) {
+	if cigar == "*" {
+		return nil, nil
+	}
+	var ops []CigarOp
+	start := 0
+	for i := 0; i < len(cigar); i++ {
+		c := cigar[i]
+		if c >= '0' && c <= '9' {
+			continue
+		}
+		if !strings.ContainsRune("MIDNSHP=X", rune(c)) {
+			return nil, SAMerror{str: fmt.Sprintf("Invalid CIGAR operation %q", c)}
+		}
+		n, err := strconv.Atoi(cigar[start:i])
+		if err != nil {
+			return nil, SAMerror{str: fmt.Sprintf("Invalid CIGAR operation length at %d", start)}
+		}
+		ops = append(ops, CigarOp{Op: c, Len: n})
+		start = i + 1
+	}
+	if start != len(cigar) {
+		return nil, SAMerror{str: "CIGAR string ends without an operation"}
+	}
+	return ops, nil
+}
+
+// FormatCigar is the inverse of ParseCigar, giving "*" for no
+// operations.
+func FormatCigar(ops []CigarOp) string {
+	if len(ops) == 0 {
+		return "*"
+	}
+	var b strings.Builder
+	for _, op := range ops {
+		b.WriteString(strconv.Itoa(op.Len))
+		b.WriteByte(op.Op)
+	}
+	return b.String()
+}
+
+// ValidateCigar checks the rules for where operations can go in a
+// CIGAR string: H only at either end, S only at either end or next to
+// an H there, and at least one operation that consumes SEQ. The error
+// gives the 1-based number of the operation at fault.
+func ValidateCigar(cigar string) error {
+	ops, err := ParseCigar(cigar)
+	if err != nil {
+		return err
+	}
+	if ops == nil {
+		return nil
+	}
+	last := len(ops) - 1
+	consumes := false
+	for i, op := range ops {
+		switch op.Op {
+		case 'H':
+			if i != 0 && i != last {
+				return SAMerror{str: fmt.Sprintf("Hard clip %v at CIGAR operation %d isn't at either end", op, i+1), Field: "CIGAR"}
+			}
+		case 'S':
+			if !(i == 0 || i == last || i == 1 && ops[0].Op == 'H' || i == last-1 && ops[last].Op == 'H') {
+				return SAMerror{str: fmt.Sprintf("Soft clip %v at CIGAR operation %d isn't at either end", op, i+1), Field: "CIGAR"}
+			}
+		}
+		if op.ConsumesQuery() {
+			consumes = true
+		}
+	}
+	if !consumes {
+		return SAMerror{str: "CIGAR string has no operations that consume SEQ", Field: "CIGAR"}
+	}
+	return nil
+}
+
+// ConsumesQuery reports whether the operation uses up bases of SEQ.
+func (op CigarOp) ConsumesQuery() bool {
+	return strings.IndexByte("MIS=X", op.Op) >= 0
+}
+
+// ConsumesReference reports whether the operation advances along the
+// reference.
+func (op CigarOp) ConsumesReference() bool {
+	return strings.IndexByte("MDN=X", op.Op) >= 0
+}
+
+func (op CigarOp) String() string {
+	return strconv.Itoa(op.Len) + string(op.Op)
+}
+
+// queryLength sums the lengths of the operations that consume SEQ.
+func queryLength(ops []CigarOp) int {
+	n := 0
+	for _, op := range ops {
+		if op.ConsumesQuery() {
+			n += op.Len
+		}
+	}
+	return n
+}
+
+// QueryLength returns the number of bases of SEQ the CIGAR accounts
+// for, from its M, I, S, = and X operations, which for a valid
+// alignment is the length of SEQ unless that's "*". It returns 0 if the
+// CIGAR is unavailable or invalid.
+func (a *Alignment) QueryLength() int {
+	ops, err := a.CigarOps()
+	if err != nil {
+		return 0
+	}
+	return queryLength(ops)
+}
+
+// QueryLengthNoClips is like QueryLength, but leaves out soft clipped
+// bases, giving the length of the part of the read that's aligned.
+// Hard clipped bases aren't in SEQ, and neither method counts them.
+func (a *Alignment) QueryLengthNoClips() int {
+	ops, err := a.CigarOps()
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, op := range ops {
+		if op.ConsumesQuery() && op.Op != 'S' {
+			n += op.Len
+		}
+	}
+	return n
+}
+
+// CigarOps parses the alignment's CIGAR string.
+func (a *Alignment) CigarOps() ([]CigarOp, error) {
+	return ParseCigar(a.Cigar)
+}
+
+// AlignedPair matches a base of SEQ with a reference position.
+// QueryPos is a 0-based index into SEQ, and RefPos is a 1-based
+// position like POS. For bases of an insertion or soft clip, RefPos
+// is -1, and for reference positions in a deletion or skipped region,
+// QueryPos is -1.
+type AlignedPair struct {
+	QueryPos int
+	RefPos   int
+	Op       byte // the CIGAR operation, so I and D mark indels
+}
+
+// AlignedPairs lays the read out along the reference by walking the
+// CIGAR string. Hard clips and padding don't appear in the result.
+// It returns nil for an unmapped read or an invalid CIGAR.
+func (a *Alignment) AlignedPairs() []AlignedPair {
+	if a.IsUnmapped() || a.Pos == 0 {
+		return nil
+	}
+	ops, err := a.CigarOps()
+	if err != nil {
+		return nil
+	}
+	var pairs []AlignedPair
+	q, r := 0, int(a.Pos)
+	for _, op := range ops {
+		for i := 0; i < op.Len; i++ {
+			switch {
+			case op.ConsumesQuery() && op.ConsumesReference():
+				pairs = append(pairs, AlignedPair{q, r, op.Op})
+				q++
+				r++
+			case op.ConsumesQuery():
+				pairs = append(pairs, AlignedPair{q, -1, op.Op})
+				q++
+			case op.ConsumesReference():
+				pairs = append(pairs, AlignedPair{-1, r, op.Op})
+				r++
+			}
+		}
+	}
+	return pairs
+}
+
+// BaseAt returns the base of SEQ aligned to the 1-based reference
+// position refPos, and its quality score, which is 255, as in BAM, if
+// QUAL is "*". It returns false if the read doesn't cover refPos, or
+// has it in a deletion or skipped region, or if SEQ is "*", the read
+// is unmapped, or the CIGAR is invalid.
+func (a *Alignment) BaseAt(refPos uint32) (byte, uint8, bool) {
+	if a.IsUnmapped() || a.Pos == 0 || a.Seq == "*" || refPos < a.Pos {
+		return 0, 0, false
+	}
+	ops, err := a.CigarOps()
+	if err != nil {
+		return 0, 0, false
+	}
+	q, r := 0, a.Pos
+	for _, op := range ops {
+		n := uint32(op.Len)
+		switch {
+		case op.ConsumesQuery() && op.ConsumesReference():
+			if refPos < r+n {
+				i := q + int(refPos-r)
+				if i >= len(a.Seq) {
+					return 0, 0, false
+				}
+				qual := uint8(0xFF)
+				if a.Qual != "*" && i < len(a.Qual) {
+					qual = a.Qual[i] - 33
+				}
+				return a.Seq[i], qual, true
+			}
+			q += op.Len
+			r += n
+		case op.ConsumesQuery():
+			q += op.Len
+		case op.ConsumesReference():
+			if refPos < r+n {
+				return 0, 0, false
+			}
+			r += n
+		}
+	}
+	return 0, 0, false
+}
+
+// ReferenceBlocks returns the contiguous stretches of reference the
+// alignment covers, as 0-based, half-open [start, end) intervals like
+// those of BED. The alignment is split into blocks at N operations,
+// the skipped regions between the exons of a spliced read; M, =, X,
+// and D operations stay within a block. It returns nil for an
+// unmapped read or an invalid or unavailable CIGAR.
+func (a *Alignment) ReferenceBlocks() [][2]uint32 {
+	return a.referenceBlocks(false)
+}
+
+// ReferenceBlocksSplitDeletions is like ReferenceBlocks, but splits at
+// D operations as well as N ones, as bedtools bamtobed -splitD does.
+func (a *Alignment) ReferenceBlocksSplitDeletions() [][2]uint32 {
+	return a.referenceBlocks(true)
+}
+
+func (a *Alignment) referenceBlocks(splitD bool) [][2]uint32 {
+	if a.IsUnmapped() || a.Pos == 0 {
+		return nil
+	}
+	ops, err := a.CigarOps()
+	if err != nil {
+		return nil
+	}
+	var blocks [][2]uint32
+	start := a.Pos - 1
+	end := start
+	for _, op := range ops {
+		if !op.ConsumesReference() {
+			continue
+		}
+		if op.Op == 'N' || (splitD && op.Op == 'D') {
+			if end > start {
+				blocks = append(blocks, [2]uint32{start, end})
+			}
+			end += uint32(op.Len)
+			start = end
+			continue
+		}
+		end += uint32(op.Len)
+	}
+	if end > start {
+		blocks = append(blocks, [2]uint32{start, end})
+	}
+	return blocks
+}
+
+// Start returns the 1-based position of the first reference base the
+// alignment covers, which is POS, or 0 for an unmapped read.
+func (a *Alignment) Start() uint32 {
+	if a.IsUnmapped() {
+		return 0
+	}
+	return a.Pos
+}
+
+// End returns the 1-based position of the last reference base the
+// alignment covers, from POS and the CIGAR, or 0 for an unmapped
+// read. An alignment whose CIGAR covers no reference, or is
+// unavailable, is taken to cover just POS, as BAM indexing does. If
+// the alignment is marked as being to a circular reference (see
+// SetCircular), one that runs past the end of the reference carries on
+// from its start, so End is wrapped around to be within the reference,
+// and is less than Start for an alignment that spans the origin.
+func (a *Alignment) End() uint32 {
+	end := a.linearEnd()
+	if end == 0 || a.circularLen == 0 {
+		return end
+	}
+	return (end-1)%a.circularLen + 1
+}
+
+// linearEnd is End without wrapping around a circular reference, so
+// it's never less than Start.
+func (a *Alignment) linearEnd() uint32 {
+	if a.IsUnmapped() || a.Pos == 0 {
+		return 0
+	}
+	return a.Pos + bamRefSpan(a) - 1
+}
+
+// Overlaps reports whether the alignment covers any of the region
+// start to end (1-based, inclusive) of reference ref. Unmapped reads
+// never overlap. If the alignment is marked as being to a circular
+// reference (see SetCircular), the part of it that wraps around to the
+// start of the reference overlaps regions there, which must be within
+// the reference.
+func (a *Alignment) Overlaps(ref string, start, end uint32) bool {
+	if a.IsUnmapped() || a.Pos == 0 || a.RefName != ref {
+		return false
+	}
+	s, e := a.Start(), a.linearEnd()
+	if a.circularLen == 0 {
+		return s <= end && e >= start
+	}
+	// The region, and its copies further along the unwrapped
+	// coordinates, up to the end of the alignment
+	n := uint64(a.circularLen)
+	for rs, re := uint64(start), uint64(end); rs <= uint64(e); rs, re = rs+n, re+n {
+		if re >= uint64(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCircular records that the alignment's reference is circular, of
+// length refLen, as for a mitochondrial genome or a plasmid, so that
+// End, Overlaps and Coverage wrap positions past its end around to its
+// start; refLen 0 makes the reference linear again. This is state
+// carried on the alignment, not looked up in a header when it's used:
+// a Reader and ParseConcurrent set it for alignments to references with
+// TP circular and LN in their @SQ lines, but an Alignment made any
+// other way is linear, and one moved to another reference keeps the
+// length it had, until SetCircular is called on it.
+func (a *Alignment) SetCircular(refLen uint32) {
+	a.circularLen = refLen
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"strings"
+	"testing"
+)
+
+// A read on chrM, 16569bp, covering 16560 to 16569 and then 1 to 10
+func junctionRead() *Alignment {
+	a := &Alignment{Qname: "r1", RefName: "chrM", Pos: 16560, Cigar: "20M", NextRef: "*", Seq: "*", Qual: "*"}
+	a.SetCircular(16569)
+	return a
+}
+
+func TestEndCircular(t *testing.T) {
+	a := junctionRead()
+	if end := a.End(); end != 10 {
+		t.Errorf("End() = %d, want 10", end)
+	}
+	a.SetCircular(0)
+	if end := a.End(); end != 16579 {
+		t.Errorf("End() on a linear reference = %d, want 16579", end)
+	}
+}
+
+func TestOverlapsCircular(t *testing.T) {
+	a := junctionRead()
+	for _, tc := range []struct {
+		start, end uint32
+		want       bool
+	}{
+		{1, 5, true},
+		{10, 10, true},
+		{11, 100, false},
+		{16000, 16559, false},
+		{16565, 16569, true},
+	} {
+		if got := a.Overlaps("chrM", tc.start, tc.end); got != tc.want {
+			t.Errorf("Overlaps(chrM, %d, %d) = %v, want %v", tc.start, tc.end, got, tc.want)
+		}
+	}
+	if a.Overlaps("chr1", 1, 5) {
+		t.Error("Overlaps matched another reference")
+	}
+}
+
+func TestReaderMarksCircular(t *testing.T) {
+	sam := "@SQ\tSN:chrM\tLN:16569\tTP:circular\n" +
+		"@SQ\tSN:chr1\tLN:100000\n" +
+		"r1\t0\tchrM\t16560\t60\t20M\t*\t0\t0\t*\t*\n" +
+		"r2\t0\tchr1\t16560\t60\t20M\t*\t0\t0\t*\t*\n"
+	sr, err := NewReader(strings.NewReader(sam))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []uint32{10, 16579} {
+		a, err := sr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end := a.End(); end != want {
+			t.Errorf("%s: End() = %d, want %d", a.Qname, end, want)
+		}
+	}
+}
+
+func TestParseConcurrentMarksCircular(t *testing.T) {
+	sam := "@SQ\tSN:chrM\tLN:16569\tTP:circular\n" +
+		"@SQ\tSN:chr1\tLN:100000\n" +
+		"r1\t0\tchrM\t16560\t60\t20M\t*\t0\t0\t*\t*\n" +
+		"r2\t0\tchr1\t16560\t60\t20M\t*\t0\t0\t*\t*\n"
+	_, alignments, err := ParseConcurrent(strings.NewReader(sam), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alignments) != 2 {
+		t.Fatalf("got %d alignments, want 2", len(alignments))
+	}
+	for i, want := range []uint32{10, 16579} {
+		a := alignments[i]
+		if end := a.End(); end != want {
+			t.Errorf("%s: End() = %d, want %d", a.Qname, end, want)
+		}
+	}
+}
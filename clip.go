@@ -0,0 +1,130 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+// TrimSoftClips returns a copy of a with its soft clips made hard: the
+// clipped bases are removed from SEQ and QUAL, and each S operation
+// becomes an H, merged with any hard clip already at that end of the
+// CIGAR. POS is unchanged, since soft clips don't consume the
+// reference. a itself isn't modified. If a has no CIGAR, or its CIGAR
+// is invalid, doesn't match SEQ, or is all clips, the copy is left as
+// it is.
+func (a *Alignment) TrimSoftClips() *Alignment {
+	b := *a
+	if a.OptFields != nil {
+		b.OptFields = make(map[string]OptField, len(a.OptFields))
+		for tag, of := range a.OptFields {
+			b.OptFields[tag] = of
+		}
+		b.tagOrder = append([]string(nil), a.tagOrder...)
+	}
+
+	ops, err := a.CigarOps()
+	if err != nil || len(ops) == 0 {
+		return &b
+	}
+	if a.Seq != "*" && queryLength(ops) != len(a.Seq) {
+		return &b
+	}
+
+	// ops[i:j] is what's left between the clips.
+	i, j := 0, len(ops)
+	leadH, leadS, trailH, trailS := 0, 0, 0, 0
+	if i < j && ops[i].Op == 'H' {
+		leadH = ops[i].Len
+		i++
+	}
+	if i < j && ops[i].Op == 'S' {
+		leadS = ops[i].Len
+		i++
+	}
+	if i < j && ops[j-1].Op == 'H' {
+		trailH = ops[j-1].Len
+		j--
+	}
+	if i < j && ops[j-1].Op == 'S' {
+		trailS = ops[j-1].Len
+		j--
+	}
+	if i == j || leadS == 0 && trailS == 0 {
+		return &b
+	}
+
+	var trimmed []CigarOp
+	if leadH+leadS > 0 {
+		trimmed = append(trimmed, CigarOp{Op: 'H', Len: leadH + leadS})
+	}
+	trimmed = append(trimmed, ops[i:j]...)
+	if trailH+trailS > 0 {
+		trimmed = append(trimmed, CigarOp{Op: 'H', Len: trailH + trailS})
+	}
+	b.Cigar = FormatCigar(trimmed)
+
+	if a.Seq != "*" {
+		b.Seq = a.Seq[leadS : len(a.Seq)-trailS]
+		if a.Qual != "*" && len(a.Qual) == len(a.Seq) {
+			b.Qual = a.Qual[leadS : len(a.Qual)-trailS]
+		}
+	}
+	return &b
+}
+
+// LeadingClip returns the number of bases clipped from the start of
+// the alignment, in reference order: the lengths of the H and S
+// operations at the start of the CIGAR. It's 0 if the CIGAR is
+// unavailable or invalid.
+func (a *Alignment) LeadingClip() int {
+	leading, _ := a.clips()
+	return leading
+}
+
+// TrailingClip is like LeadingClip, but for the end of the alignment.
+func (a *Alignment) TrailingClip() int {
+	_, trailing := a.clips()
+	return trailing
+}
+
+// ReadClips returns the number of bases clipped from the start and
+// end of the read in the orientation it was sequenced in, which for a
+// reverse strand read is the opposite of the CIGAR's: its start clip
+// is TrailingClip, and its end clip LeadingClip.
+func (a *Alignment) ReadClips() (start, end int) {
+	leading, trailing := a.clips()
+	if a.IsReverse() {
+		return trailing, leading
+	}
+	return leading, trailing
+}
+
+// clips sums the H and S operations at either end of the CIGAR. For a
+// CIGAR of nothing but clips, they're all leading.
+func (a *Alignment) clips() (leading, trailing int) {
+	ops, err := a.CigarOps()
+	if err != nil {
+		return 0, 0
+	}
+	i, j := 0, len(ops)
+	for i < j && (ops[i].Op == 'H' || ops[i].Op == 'S') {
+		leading += ops[i].Len
+		i++
+	}
+	for i < j && (ops[j-1].Op == 'H' || ops[j-1].Op == 'S') {
+		trailing += ops[j-1].Len
+		j--
+	}
+	return leading, trailing
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import "testing"
+
+func TestTrimSoftClips(t *testing.T) {
+	for _, tc := range []struct {
+		cigar, seq, qual string
+		wantCigar        string
+		wantSeq          string
+		wantQual         string
+	}{
+		{"2S5M3S", "AAcgtacTTT", "!!IIIII###", "2H5M3H", "cgtac", "IIIII"},
+		{"3H2S5M", "AAcgtac", "!!IIIII", "5H5M", "cgtac", "IIIII"},
+		{"5M1S2H", "cgtacT", "IIIII#", "5M3H", "cgtac", "IIIII"},
+		{"2S5M", "AAcgtac", "*", "2H5M", "cgtac", "*"},
+		{"2S5M", "*", "*", "2H5M", "*", "*"},
+		{"2S3M1I2M", "AAcgtTac", "!!IIIIII", "2H3M1I2M", "cgtTac", "IIIIII"},
+		{"5M", "cgtac", "IIIII", "5M", "cgtac", "IIIII"},
+		{"4S", "ACGT", "IIII", "4S", "ACGT", "IIII"},     // all clips
+		{"2S5M", "AAcg", "IIII", "2S5M", "AAcg", "IIII"}, // CIGAR doesn't match SEQ
+		{"*", "ACGT", "IIII", "*", "ACGT", "IIII"},
+	} {
+		a := &Alignment{Qname: "r1", RefName: "chr1", Pos: 100, Cigar: tc.cigar, Seq: tc.seq, Qual: tc.qual,
+			OptFields: map[string]OptField{}}
+		a.SetTag(OptField{Tag: "NM", Type: 'i', Value: int64(0)})
+		b := a.TrimSoftClips()
+		if b.Cigar != tc.wantCigar || b.Seq != tc.wantSeq || b.Qual != tc.wantQual || b.Pos != 100 {
+			t.Errorf("TrimSoftClips(%s %s %s) = %s %s %s at %d, want %s %s %s at 100",
+				tc.cigar, tc.seq, tc.qual, b.Cigar, b.Seq, b.Qual, b.Pos, tc.wantCigar, tc.wantSeq, tc.wantQual)
+		}
+		if a.Cigar != tc.cigar || a.Seq != tc.seq || a.Qual != tc.qual {
+			t.Errorf("TrimSoftClips modified the original, now %s %s %s", a.Cigar, a.Seq, a.Qual)
+		}
+		// The copy has its own tags
+		b.SetTag(OptField{Tag: "XT", Type: 'A', Value: "U"})
+		if _, ok := a.OptFields["XT"]; ok || len(a.Tags()) != 1 {
+			t.Error("the copy shares its tags with the original")
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Equal reports whether a and other have the same mandatory fields and
+// the same optional fields, in any order. Two nil alignments are equal.
+func (a *Alignment) Equal(other *Alignment) bool {
+	return len(a.Diff(other)) == 0
+}
+
+// Diff describes how other differs from a, one line per field, e.g.
+// "POS: 100 != 101", or "tag NM: missing" for an optional field of a
+// that other doesn't have. Optional fields are listed by tag, in
+// alphabetical order, after the mandatory fields. It returns nil if
+// they're equal.
+func (a *Alignment) Diff(other *Alignment) []string {
+	if a == nil || other == nil {
+		if a == other {
+			return nil
+		}
+		return []string{fmt.Sprintf("alignment: %v != %v", a, other)}
+	}
+
+	var diffs []string
+	field := func(name string, x, y interface{}) {
+		if x != y {
+			diffs = append(diffs, fmt.Sprintf("%s: %v != %v", name, x, y))
+		}
+	}
+	field("QNAME", a.Qname, other.Qname)
+	field("FLAG", a.Flag, other.Flag)
+	field("RNAME", a.RefName, other.RefName)
+	field("POS", a.Pos, other.Pos)
+	field("MAPQ", a.Mapq, other.Mapq)
+	field("CIGAR", a.Cigar, other.Cigar)
+	field("RNEXT", a.NextRef, other.NextRef)
+	field("PNEXT", a.NextPos, other.NextPos)
+	field("TLEN", a.TemplateLen, other.TemplateLen)
+	field("SEQ", a.Seq, other.Seq)
+	field("QUAL", a.Qual, other.Qual)
+
+	tags := make(map[string]bool, len(a.OptFields))
+	for tag := range a.OptFields {
+		tags[tag] = true
+	}
+	for tag := range other.OptFields {
+		tags[tag] = true
+	}
+	sorted := make([]string, 0, len(tags))
+	for tag := range tags {
+		sorted = append(sorted, tag)
+	}
+	sort.Strings(sorted)
+	for _, tag := range sorted {
+		x, inA := a.OptFields[tag]
+		y, inOther := other.OptFields[tag]
+		switch {
+		case !inOther:
+			diffs = append(diffs, fmt.Sprintf("tag %s: missing", tag))
+		case !inA:
+			diffs = append(diffs, fmt.Sprintf("tag %s: unexpected %s", tag, formatOptField(y)))
+		case x.Type != y.Type || !reflect.DeepEqual(x.Value, y.Value):
+			diffs = append(diffs, fmt.Sprintf("tag %s: %s != %s", tag, formatOptField(x), formatOptField(y)))
+		}
+	}
+	return diffs
+}
+
+// Diff describes how other differs from header h, one line per
+// difference, e.g. "@SQ 2: SN:chr2 LN:1000 != SN:chr2 LN:2000", or
+// "@RG x: missing" for a read group of h that other doesn't have. @SQ
+// lines are compared in order, since their order defines the sort
+// order, and @RG and @PG lines by ID. With ignorePG, the CL field of
+// @PG lines, whose command lines usually differ from run to run, is
+// left out, but the programs are still compared by ID. It returns nil
+// if they're the same.
+func (h *Header) Diff(other *Header, ignorePG bool) []string {
+	var diffs []string
+	if x, y := hdString(h), hdString(other); x != y {
+		diffs = append(diffs, fmt.Sprintf("@HD: %s != %s", x, y))
+	}
+
+	for i := 0; i < len(h.SQ) || i < len(other.SQ); i++ {
+		switch {
+		case i >= len(other.SQ):
+			diffs = append(diffs, fmt.Sprintf("@SQ %d: missing %s", i+1, h.SQ[i].Name))
+		case i >= len(h.SQ):
+			diffs = append(diffs, fmt.Sprintf("@SQ %d: unexpected %s", i+1, headerString(other.SQ[i], "SQ")))
+		default:
+			if x, y := headerString(h.SQ[i], "SQ"), headerString(other.SQ[i], "SQ"); x != y {
+				diffs = append(diffs, fmt.Sprintf("@SQ %d: %s != %s", i+1, x, y))
+			}
+		}
+	}
+
+	var ids, otherIDs []string
+	lines, otherLines := map[string]string{}, map[string]string{}
+	for _, rg := range h.RG {
+		ids = append(ids, rg.ID)
+		lines[rg.ID] = headerString(rg, "RG")
+	}
+	for _, rg := range other.RG {
+		otherIDs = append(otherIDs, rg.ID)
+		otherLines[rg.ID] = headerString(rg, "RG")
+	}
+	diffs = append(diffs, diffByID("RG", ids, otherIDs, lines, otherLines)...)
+
+	ids, otherIDs = nil, nil
+	lines, otherLines = map[string]string{}, map[string]string{}
+	for _, prog := range h.PG {
+		ids = append(ids, prog.ID)
+		lines[prog.ID] = pgString(prog, ignorePG)
+	}
+	for _, prog := range other.PG {
+		otherIDs = append(otherIDs, prog.ID)
+		otherLines[prog.ID] = pgString(prog, ignorePG)
+	}
+	diffs = append(diffs, diffByID("PG", ids, otherIDs, lines, otherLines)...)
+	return diffs
+}
+
+// diffByID compares header lines of record type rt by ID: those of one
+// header, with IDs ids, against those of the other.
+func diffByID(rt string, ids, otherIDs []string, lines, otherLines map[string]string) []string {
+	var diffs []string
+	for _, id := range ids {
+		y, ok := otherLines[id]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("@%s %s: missing", rt, id))
+		case lines[id] != y:
+			diffs = append(diffs, fmt.Sprintf("@%s %s: %s != %s", rt, id, lines[id], y))
+		}
+	}
+	for _, id := range otherIDs {
+		if _, ok := lines[id]; !ok {
+			diffs = append(diffs, fmt.Sprintf("@%s %s: unexpected %s", rt, id, otherLines[id]))
+		}
+	}
+	return diffs
+}
+
+// headerString formats a header line of record type rt, without the
+// record type, and with spaces between the fields, for diffs.
+func headerString(line interface{}, rt string) string {
+	var b strings.Builder
+	var w io.Writer = &b
+	switch l := line.(type) {
+	case *HeaderLine:
+		WriteHeader(w, l)
+	case *RefSeqDict:
+		WriteRefSeqDict(w, l)
+	case *ReadGroup:
+		WriteReadGroup(w, l)
+	case *Program:
+		WriteProgram(w, l)
+	}
+	s := strings.TrimSuffix(strings.TrimPrefix(b.String(), "@"+rt+"\t"), "\n")
+	return strings.ReplaceAll(s, "\t", " ")
+}
+
+// pgString formats a @PG line for diffs, leaving out its command line
+// if noCmdLine is set.
+func pgString(prog *Program, noCmdLine bool) string {
+	if noCmdLine {
+		p := *prog
+		p.CmdLine = ""
+		prog = &p
+	}
+	return headerString(prog, "PG")
+}
+
+// hdString formats h's @HD line for diffs, or is "none" if it has none.
+func hdString(h *Header) string {
+	if h.HD == nil {
+		return "none"
+	}
+	return headerString(h.HD, "HD")
+}
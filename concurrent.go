@@ -0,0 +1,166 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// parseBatchSize is how many lines are handed to a worker at a time.
+const parseBatchSize = 4096
+
+// parseBatch is a run of alignment lines, and the results of parsing
+// them.
+type parseBatch struct {
+	index     int
+	firstLine int
+	lines     []string
+	circular  map[string]uint32 // from circularRefs, shared by all batches
+	al        []*Alignment
+	err       error
+}
+
+// ParseConcurrent is like ReadSAM2, but parses and validates the
+// alignment lines with workers goroutines, or one per CPU if workers
+// is 0 or less. The header is read first, as NewReader does, and the
+// same normalizations are made as by a Reader that isn't Strict.
+// Alignments to references the header gives as circular are marked so,
+// as a Reader marks them, for End, Overlaps and Coverage. The
+// alignments are returned in input order, and if any line has an
+// error, the first is returned, with its line number, along with the
+// alignments before it.
+func ParseConcurrent(r io.Reader, workers int) (*Header, []*Alignment, error) {
+	sr, err := NewReader(r)
+	if err != nil {
+		return sr.Header, nil, err
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	jobs := make(chan *parseBatch, workers)
+	done := make(chan *parseBatch, workers)
+	var failed int32
+	circular := circularRefs(sr.Header)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				b.parse()
+				if b.err != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+				done <- b
+			}
+		}()
+	}
+
+	// Lines are read here, in order, and batched. Once a batch has
+	// failed, there's no need for later ones, since the earlier
+	// batches have all been read already.
+	var readErr error
+	nBatches := 0
+	go func() {
+		defer close(jobs)
+		for atomic.LoadInt32(&failed) == 0 {
+			b := &parseBatch{index: nBatches, firstLine: sr.line + 1, circular: circular}
+			for len(b.lines) < parseBatchSize {
+				s, err := sr.readLine()
+				if err != nil {
+					if err != io.EOF {
+						readErr = err
+					}
+					break
+				}
+				b.lines = append(b.lines, sr.trimLine(s, true))
+			}
+			// A worker may clear b.lines once it has b
+			n := len(b.lines)
+			if n > 0 {
+				nBatches++
+				jobs <- b
+			}
+			if n < parseBatchSize {
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var batches []*parseBatch
+	for b := range done {
+		for len(batches) <= b.index {
+			batches = append(batches, nil)
+		}
+		batches[b.index] = b
+	}
+
+	var alignments []*Alignment
+	for _, b := range batches {
+		if b == nil {
+			continue // after a failed batch
+		}
+		alignments = append(alignments, b.al...)
+		if b.err != nil {
+			return sr.Header, alignments, b.err
+		}
+	}
+	return sr.Header, alignments, readErr
+}
+
+// parse parses and validates the lines of b, stopping at the first
+// error.
+func (b *parseBatch) parse() {
+	b.al = make([]*Alignment, 0, len(b.lines))
+	for i, s := range b.lines {
+		var a *Alignment
+		var err error
+		if strings.HasPrefix(s, "@") {
+			err = errHeaderInAlignments
+		} else {
+			a, err = parseAlignment(s)
+		}
+		if err == nil {
+			normalizeSeq(a)
+			if a.RefName == "*" {
+				unplace(a)
+			}
+			a.circularLen = b.circular[a.RefName]
+			_, err = validateAlignment(a)
+		}
+		if err != nil {
+			if se, ok := err.(SAMerror); ok {
+				se.Line = b.firstLine + i
+				err = se
+			}
+			b.err = err
+			return
+		}
+		b.al = append(b.al, a)
+	}
+	b.lines = nil
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+// Coverage returns the read depth at each position of the region
+// start to end (1-based, inclusive) of reference ref, so that element
+// i is the depth at position start+i. Only bases aligned by M, = and X
+// operations count; deletions and skipped regions don't. Unmapped
+// reads are ignored. For alignments marked as being to a circular
+// reference (see SetCircular), bases past the end of the reference
+// wrap around to its start, so reads spanning the origin count at both
+// ends.
+func Coverage(alignments []*Alignment, ref string, start, end uint32) ([]uint32, error) {
+	return coverage(alignments, ref, start, end, false)
+}
+
+// CoverageNoDuplicates is like Coverage, but also ignores reads marked
+// as duplicates.
+func CoverageNoDuplicates(alignments []*Alignment, ref string, start, end uint32) ([]uint32, error) {
+	return coverage(alignments, ref, start, end, true)
+}
+
+// coverage computes Coverage, wrapping positions of alignments to
+// circular references around.
+func coverage(alignments []*Alignment, ref string, start, end uint32, skipDups bool) ([]uint32, error) {
+	if start < 1 || end < start {
+		return nil, SAMerror{str: "Invalid coverage region"}
+	}
+	depth := make([]uint32, end-start+1)
+	for _, a := range alignments {
+		if a.IsUnmapped() || a.RefName != ref || a.Pos == 0 {
+			continue
+		}
+		if skipDups && a.IsDuplicate() {
+			continue
+		}
+		ops, err := a.CigarOps()
+		if err != nil {
+			return nil, err
+		}
+		refLen := a.circularLen
+		refPos := a.Pos
+		for _, op := range ops {
+			if !op.ConsumesReference() {
+				continue
+			}
+			if op.Op == 'M' || op.Op == '=' || op.Op == 'X' {
+				for p := refPos; p < refPos+uint32(op.Len); p++ {
+					q := p
+					if refLen != 0 {
+						q = (p-1)%refLen + 1
+					}
+					if q >= start && q <= end {
+						depth[q-start]++
+					}
+				}
+			}
+			refPos += uint32(op.Len)
+			if refLen == 0 && refPos > end {
+				break
+			}
+		}
+	}
+	return depth, nil
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import "testing"
+
+func TestCoverageCircular(t *testing.T) {
+	depth, err := Coverage([]*Alignment{junctionRead()}, "chrM", 1, 16569)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pos := uint32(1); pos <= 16569; pos++ {
+		want := uint32(0)
+		if pos <= 10 || pos >= 16560 {
+			want = 1
+		}
+		if depth[pos-1] != want {
+			t.Fatalf("depth at %d = %d, want %d", pos, depth[pos-1], want)
+		}
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	alignments := []*Alignment{
+		{Qname: "r1", RefName: "chr1", Pos: 2, Cigar: "2M1D2M"},
+		{Qname: "r2", RefName: "chr1", Pos: 4, Cigar: "1S3M", Flag: FlagDuplicate},
+		{Qname: "r3", RefName: "chr1", Pos: 1, Cigar: "*", Flag: FlagUnmapped},
+	}
+	depth, err := Coverage(alignments, "chr1", 1, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{0, 1, 1, 1, 2, 2, 0, 0}
+	for i := range want {
+		if depth[i] != want[i] {
+			t.Errorf("Coverage = %v, want %v", depth, want)
+			break
+		}
+	}
+	depth, _ = CoverageNoDuplicates(alignments, "chr1", 1, 8)
+	if depth[4] != 1 {
+		t.Errorf("CoverageNoDuplicates counted a duplicate: %v", depth)
+	}
+}
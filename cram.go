@@ -0,0 +1,880 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+// Reading CRAM 3 files. Only decoding is supported, and only the
+// codecs and block compression methods of the CRAM 3.0 specification
+// that are in common use: the Golomb codecs, LZMA and the CRAM 3.1
+// compression methods aren't. MD and NM tags that the writer left out
+// to be recomputed aren't restored.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var cramMagic = []byte("CRAM")
+
+// ReferenceSource supplies the reference sequences that CRAM reads
+// are compressed against.
+type ReferenceSource interface {
+	// Sequence returns the bases of the reference sequence rsd.
+	Sequence(rsd *RefSeqDict) ([]byte, error)
+}
+
+// URIReferenceSource is a ReferenceSource that reads each sequence
+// from its UR tag, with FetchReference.
+type URIReferenceSource struct{}
+
+func (URIReferenceSource) Sequence(rsd *RefSeqDict) ([]byte, error) {
+	return rsd.FetchReference()
+}
+
+// CRAM block content types
+const (
+	cramFileHeader        = 0
+	cramCompressionHeader = 1
+	cramMappedSlice       = 2
+	cramExternalData      = 4
+	cramCoreData          = 5
+)
+
+// CRAM compression bit flags, the CF data series
+const (
+	cramQualArray      = 0x1
+	cramDetached       = 0x2
+	cramMateDownstream = 0x4
+	cramNoSeq          = 0x8
+)
+
+// cramReader is the state of a Reader for a CRAM file.
+type cramReader struct {
+	r       *bufio.Reader
+	refs    ReferenceSource
+	pending []*Alignment // decoded from the last container
+
+	// the last reference sequence used
+	refID  int32
+	refSeq []byte
+}
+
+// cramBlock is a block of a container, uncompressed.
+type cramBlock struct {
+	contentType byte
+	contentID   int32
+	data        []byte
+}
+
+// cramCompHeader is a container's compression header, which says how
+// the records of its slices are encoded.
+type cramCompHeader struct {
+	readNames   bool // RN: read names are stored
+	apDelta     bool // AP: positions are relative to the previous record
+	refRequired bool // RR
+	subst       [5][4]byte
+	tagDict     [][]int32 // lines of tag IDs, tag<<8 | type
+	series      map[string]*cramEncoding
+	tags        map[int32]*cramEncoding
+}
+
+// cramSliceHeader describes one slice of a container.
+type cramSliceHeader struct {
+	refID         int32 // -1 for unmapped reads, -2 for several references
+	start         int32
+	span          int32
+	nRecords      int32
+	recordCounter int64
+	nBlocks       int32
+	embeddedRef   int32 // content ID of a block holding the reference, or -1
+}
+
+// NewCRAMReader reads the header of a CRAM file from r, returning a
+// Reader whose Next method decodes its records. Reads are restored
+// using reference sequences from ref, which may be nil if the file
+// doesn't need a reference.
+func NewCRAMReader(r io.Reader, ref ReferenceSource) (*Reader, error) {
+	cr := &cramReader{r: bufio.NewReader(r), refs: ref, refID: -1}
+
+	def := make([]byte, 26) // magic, version, and file ID
+	if _, err := io.ReadFull(cr.r, def); err != nil {
+		return nil, err
+	}
+	if string(def[:4]) != string(cramMagic) {
+		return nil, SAMerror{str: "Not a CRAM file"}
+	}
+	if def[4] != 3 {
+		return nil, SAMerror{str: fmt.Sprintf("Unsupported CRAM version %d.%d", def[4], def[5])}
+	}
+
+	// The header text is the same as a SAM header, so it's parsed by
+	// the SAM reader.
+	_, data, err := cr.readContainer()
+	if err != nil {
+		if err == io.EOF {
+			err = errCRAMTruncated
+		}
+		return nil, err
+	}
+	c := &cramBuf{b: data}
+	block, err := readCRAMBlock(c)
+	if err != nil {
+		return nil, err
+	}
+	if block.contentType != cramFileHeader || len(block.data) < 4 {
+		return nil, SAMerror{str: "CRAM file has no header"}
+	}
+	lText := int(binary.LittleEndian.Uint32(block.data))
+	if lText < 0 || lText > len(block.data)-4 {
+		return nil, SAMerror{str: "Invalid CRAM header length"}
+	}
+	text := string(block.data[4 : 4+lText])
+	hr, err := NewReader(strings.NewReader(strings.TrimRight(text, "\x00")))
+	if err != nil {
+		return nil, err
+	}
+	sr := &Reader{Header: hr.Header, cram: cr}
+	for _, rsd := range hr.Header.SQ {
+		sr.refNames = append(sr.refNames, rsd.Name)
+	}
+	return sr, nil
+}
+
+// readContainer reads a container header, returning the number of
+// records in the container and its data.
+func (cr *cramReader) readContainer() (int32, []byte, error) {
+	var length int32
+	if err := binary.Read(cr.r, binary.LittleEndian, &length); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, errCRAMTruncated
+		}
+		return 0, nil, err // io.EOF at the end of the file
+	}
+	truncated := func(err error) (int32, []byte, error) {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errCRAMTruncated
+		}
+		return 0, nil, err
+	}
+	// reference ID, start, span, records, record counter, bases,
+	// blocks, landmarks and CRC32; only the record count matters when
+	// reading sequentially.
+	var nRecords int32
+	for i := 0; i < 4; i++ {
+		v, err := readITF8(cr.r)
+		if err != nil {
+			return truncated(err)
+		}
+		if i == 3 {
+			nRecords = v
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := readLTF8(cr.r); err != nil {
+			return truncated(err)
+		}
+	}
+	if _, err := readITF8(cr.r); err != nil {
+		return truncated(err)
+	}
+	nLandmarks, err := readITF8(cr.r)
+	if err != nil {
+		return truncated(err)
+	}
+	for i := int32(0); i < nLandmarks; i++ {
+		if _, err := readITF8(cr.r); err != nil {
+			return truncated(err)
+		}
+	}
+	if _, err := cr.r.Discard(4); err != nil {
+		return truncated(err)
+	}
+	if length < 0 {
+		return 0, nil, SAMerror{str: "Invalid CRAM container length"}
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(cr.r, data); err != nil {
+		return truncated(err)
+	}
+	return nRecords, data, nil
+}
+
+// readCRAMBlock reads and uncompresses a block, checking its CRC32.
+func readCRAMBlock(c *cramBuf) (*cramBlock, error) {
+	start := c.p
+	method := c.byte()
+	b := &cramBlock{contentType: c.byte(), contentID: c.itf8()}
+	size := c.itf8()
+	rawSize := c.itf8()
+	data := c.bytes(int(size))
+	end := c.p
+	crc := c.uint32()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if rawSize < 0 || rawSize > cramMaxBlockSize {
+		return nil, SAMerror{str: fmt.Sprintf("Invalid CRAM block size %d", rawSize)}
+	}
+	if crc32.ChecksumIEEE(c.b[start:end]) != crc {
+		return nil, SAMerror{str: "CRAM block fails its CRC32 check"}
+	}
+	var err error
+	b.data, err = decompressCRAMBlock(method, data, int(rawSize))
+	return b, err
+}
+
+// readCompHeader reads a container's compression header.
+func readCompHeader(data []byte) (*cramCompHeader, error) {
+	h := &cramCompHeader{
+		readNames:   true,
+		apDelta:     true,
+		refRequired: true,
+		series:      map[string]*cramEncoding{},
+		tags:        map[int32]*cramEncoding{},
+	}
+	setSubst(h, [5]byte{0x1b, 0x1b, 0x1b, 0x1b, 0x1b})
+	c := &cramBuf{b: data}
+
+	c.itf8() // size in bytes
+	for n := c.itf8(); n > 0 && c.err == nil; n-- {
+		switch key := string(c.bytes(2)); key {
+		case "RN":
+			h.readNames = c.byte() != 0
+		case "AP":
+			h.apDelta = c.byte() != 0
+		case "RR":
+			h.refRequired = c.byte() != 0
+		case "SM":
+			var sm [5]byte
+			copy(sm[:], c.bytes(5))
+			setSubst(h, sm)
+		case "TD":
+			td := c.bytes(int(c.itf8()))
+			for len(td) > 0 {
+				var line []int32
+				for len(td) >= 3 && td[0] != 0 {
+					line = append(line, int32(td[0])<<16|int32(td[1])<<8|int32(td[2]))
+					td = td[3:]
+				}
+				h.tagDict = append(h.tagDict, line)
+				td = td[1:]
+			}
+		default:
+			return nil, SAMerror{str: fmt.Sprintf("Unknown CRAM preservation key %q", key)}
+		}
+	}
+
+	c.itf8()
+	for n := c.itf8(); n > 0 && c.err == nil; n-- {
+		key := string(c.bytes(2))
+		h.series[key] = readCRAMEncoding(c)
+	}
+
+	c.itf8()
+	for n := c.itf8(); n > 0 && c.err == nil; n-- {
+		key := c.itf8()
+		h.tags[key] = readCRAMEncoding(c)
+	}
+	return h, c.err
+}
+
+// setSubst decodes a substitution matrix. For each reference base, in
+// the order ACGTN, a byte gives the 2-bit codes of the other four
+// bases, in the same order.
+func setSubst(h *cramCompHeader, sm [5]byte) {
+	const bases = "ACGTN"
+	for i := range sm {
+		shift := uint(6)
+		for j := 0; j < 5; j++ {
+			if j == i {
+				continue
+			}
+			h.subst[i][(sm[i]>>shift)&3] = bases[j]
+			shift -= 2
+		}
+	}
+}
+
+// readSliceHeader reads the header block of a slice.
+func readSliceHeader(data []byte) (*cramSliceHeader, error) {
+	c := &cramBuf{b: data}
+	s := &cramSliceHeader{refID: c.itf8(), start: c.itf8(), span: c.itf8()}
+	s.nRecords = c.itf8()
+	s.recordCounter = c.ltf8()
+	s.nBlocks = c.itf8()
+	c.itf8Array() // block content IDs
+	s.embeddedRef = c.itf8()
+	return s, c.err
+}
+
+// nextCRAM returns the next CRAM record, decoding another container
+// when those already decoded run out.
+func (sr *Reader) nextCRAM() (*Alignment, error) {
+	cr := sr.cram
+	for len(cr.pending) == 0 {
+		if err := sr.readCRAMContainer(); err != nil {
+			return nil, err
+		}
+	}
+	a := cr.pending[0]
+	cr.pending[0] = nil
+	cr.pending = cr.pending[1:]
+	sr.line++
+	if valid, err := validateAlignment(a); !valid {
+		return a, err
+	}
+	return a, nil
+}
+
+// readCRAMContainer decodes all the records of the next container,
+// skipping empty ones, such as the end-of-file container.
+func (sr *Reader) readCRAMContainer() error {
+	cr := sr.cram
+	nRecords, data, err := cr.readContainer()
+	if err != nil {
+		return err
+	}
+	if nRecords == 0 {
+		return nil
+	}
+	c := &cramBuf{b: data}
+	block, err := readCRAMBlock(c)
+	if err != nil {
+		return err
+	}
+	if block.contentType != cramCompressionHeader {
+		return SAMerror{str: "CRAM container has no compression header"}
+	}
+	ch, err := readCompHeader(block.data)
+	if err != nil {
+		return err
+	}
+	for c.p < len(c.b) {
+		block, err := readCRAMBlock(c)
+		if err != nil {
+			return err
+		}
+		if block.contentType != cramMappedSlice {
+			return SAMerror{str: "Expected a CRAM slice header"}
+		}
+		sh, err := readSliceHeader(block.data)
+		if err != nil {
+			return err
+		}
+		d := &cramSliceData{core: &cramBits{}, ext: map[int32]*cramBuf{}}
+		for i := int32(0); i < sh.nBlocks; i++ {
+			block, err := readCRAMBlock(c)
+			if err != nil {
+				return err
+			}
+			switch block.contentType {
+			case cramCoreData:
+				d.core = &cramBits{b: block.data}
+			case cramExternalData:
+				d.ext[block.contentID] = &cramBuf{b: block.data}
+			}
+		}
+		al, err := sr.decodeCRAMSlice(ch, sh, d)
+		if err != nil {
+			return err
+		}
+		cr.pending = append(cr.pending, al...)
+	}
+	return nil
+}
+
+// cramRecord is a record being decoded, with what's needed to link it
+// to its mate.
+type cramRecord struct {
+	a        *Alignment
+	refID    int32
+	mate     int // the next record of the template, or -1
+	detached bool
+}
+
+// cramDecoder decodes the data series of a slice. The first error is
+// kept in err, after which reads return zeros.
+type cramDecoder struct {
+	sr  *Reader
+	ch  *cramCompHeader
+	sh  *cramSliceHeader
+	d   *cramSliceData
+	err error
+}
+
+func (dec *cramDecoder) series(key string) *cramEncoding {
+	if dec.err != nil {
+		return nil
+	}
+	e := dec.ch.series[key]
+	if e == nil {
+		dec.err = SAMerror{str: fmt.Sprintf("CRAM data series %s has no encoding", key)}
+	}
+	return e
+}
+
+func (dec *cramDecoder) int(key string) int32 {
+	e := dec.series(key)
+	if e == nil {
+		return 0
+	}
+	v, err := e.int(dec.d)
+	dec.err = err
+	return v
+}
+
+func (dec *cramDecoder) byte(key string) byte {
+	e := dec.series(key)
+	if e == nil {
+		return 0
+	}
+	v, err := e.byte(dec.d)
+	dec.err = err
+	return v
+}
+
+func (dec *cramDecoder) bytes(key string) []byte {
+	e := dec.series(key)
+	if e == nil {
+		return nil
+	}
+	v, err := e.bytes(dec.d)
+	dec.err = err
+	return v
+}
+
+func (dec *cramDecoder) fill(key string, out []byte) {
+	if e := dec.series(key); e != nil {
+		dec.err = e.fill(dec.d, out)
+	}
+}
+
+// decodeCRAMSlice decodes the records of a slice.
+func (sr *Reader) decodeCRAMSlice(ch *cramCompHeader, sh *cramSliceHeader, d *cramSliceData) ([]*Alignment, error) {
+	dec := &cramDecoder{sr: sr, ch: ch, sh: sh, d: d}
+	// Every record, and every base not restored from the reference,
+	// takes at least a bit of the slice's data, which bounds the
+	// counts read from it before anything is allocated from them.
+	bits := 8 * d.size()
+	if sh.nRecords < 0 || int(sh.nRecords) > bits {
+		return nil, SAMerror{str: fmt.Sprintf("Invalid CRAM slice record count %d", sh.nRecords)}
+	}
+	recs := make([]cramRecord, sh.nRecords)
+	pos := sh.start
+	for i := range recs {
+		rec := &recs[i]
+		rec.mate = -1
+		a := &Alignment{Qname: "*", RefName: "*", NextRef: "*", Cigar: "*", Seq: "*", Qual: "*", OptFields: map[string]OptField{}}
+		rec.a = a
+
+		a.Flag = uint16(dec.int("BF"))
+		cf := dec.int("CF")
+		rec.refID = sh.refID
+		if sh.refID == -2 {
+			rec.refID = dec.int("RI")
+		}
+		rl := int(dec.int("RL"))
+		if ch.apDelta {
+			pos += dec.int("AP")
+		} else {
+			pos = dec.int("AP")
+		}
+		rg := dec.int("RG")
+		if ch.readNames {
+			a.Qname = strings.TrimRight(string(dec.bytes("RN")), "\x00")
+		}
+
+		if cf&cramDetached != 0 {
+			rec.detached = true
+			mf := dec.int("MF")
+			if mf&1 != 0 {
+				a.Flag |= FlagMateReverse
+			}
+			if mf&2 != 0 {
+				a.Flag |= FlagMateUnmapped
+			}
+			if !ch.readNames {
+				a.Qname = strings.TrimRight(string(dec.bytes("RN")), "\x00")
+			}
+			ns := dec.int("NS")
+			a.NextPos = uint32(dec.int("NP"))
+			a.TemplateLen = dec.int("TS")
+			if dec.err == nil {
+				a.NextRef, dec.err = bamRefName(ns, sr.refNames)
+				if ns != -1 && ns == rec.refID {
+					a.NextRef = "="
+				}
+			}
+		} else if cf&cramMateDownstream != 0 {
+			rec.mate = i + int(dec.int("NF")) + 1
+		}
+
+		dec.tags(a, dec.int("TL"))
+		if dec.err != nil {
+			return nil, dec.err
+		}
+		if rg >= 0 {
+			if int(rg) >= len(sr.Header.RG) {
+				return nil, SAMerror{str: fmt.Sprintf("Invalid CRAM read group %d", rg)}
+			}
+			a.SetTag(OptField{Tag: "RG", Type: 'Z', Value: sr.Header.RG[rg].ID})
+		}
+		var err error
+		if a.RefName, err = bamRefName(rec.refID, sr.refNames); err != nil {
+			return nil, err
+		}
+		a.Pos = uint32(pos)
+
+		if rl < 0 || rl > int(sh.span)+bits {
+			return nil, SAMerror{str: fmt.Sprintf("Invalid CRAM read length %d", rl)}
+		}
+		seq := make([]byte, rl)
+		qual := make([]byte, rl)
+		for j := range qual {
+			qual[j] = 0xff
+		}
+		if !a.IsUnmapped() {
+			dec.features(rec, cf, seq, qual)
+			a.Mapq = uint8(dec.int("MQ"))
+		} else if cf&cramNoSeq == 0 {
+			dec.fill("BA", seq)
+		}
+		if cf&cramQualArray != 0 {
+			dec.fill("QS", qual)
+		}
+		if dec.err != nil {
+			return nil, dec.err
+		}
+		if rl > 0 && cf&cramNoSeq == 0 {
+			a.Seq = string(seq)
+		}
+		if rl > 0 && qual[0] != 0xff {
+			for j := range qual {
+				qual[j] += 33
+			}
+			a.Qual = string(qual)
+		}
+	}
+
+	linkCRAMMates(recs, sh)
+	al := make([]*Alignment, len(recs))
+	for i := range recs {
+		al[i] = recs[i].a
+	}
+	return al, nil
+}
+
+// tags decodes the optional fields listed in line tl of the tag
+// dictionary. Their values are stored as in BAM.
+func (dec *cramDecoder) tags(a *Alignment, tl int32) {
+	if dec.err != nil {
+		return
+	}
+	if tl < 0 || int(tl) >= len(dec.ch.tagDict) {
+		if tl != 0 {
+			dec.err = SAMerror{str: "Invalid CRAM tag line"}
+		}
+		return
+	}
+	for _, id := range dec.ch.tagDict[tl] {
+		e := dec.ch.tags[id]
+		if e == nil {
+			dec.err = SAMerror{str: "CRAM tag has no encoding"}
+			return
+		}
+		v, err := e.bytes(dec.d)
+		if err != nil {
+			dec.err = err
+			return
+		}
+		of, _, err := decodeBAMTag(append([]byte{byte(id >> 16), byte(id >> 8), byte(id)}, v...))
+		if err != nil {
+			dec.err = err
+			return
+		}
+		a.SetTag(of)
+	}
+}
+
+// features rebuilds the CIGAR and, unless the read has no
+// sequence, SEQ of a mapped read from its read features: the ways it
+// differs from the reference.
+func (dec *cramDecoder) features(rec *cramRecord, cf int32, seq, qual []byte) {
+	a := rec.a
+	noSeq := cf&cramNoSeq != 0
+	var ref []byte
+	refOffset := 1 // ref[0] is this reference position
+	if !noSeq {
+		var err error
+		if ref, refOffset, err = dec.reference(rec.refID); err != nil {
+			dec.err = err
+			return
+		}
+	}
+	refBase := func(p int) byte {
+		if p-refOffset < 0 || p-refOffset >= len(ref) {
+			return 'N'
+		}
+		return ref[p-refOffset]
+	}
+
+	var ops []CigarOp
+	addOp := func(op byte, n int) {
+		if n <= 0 {
+			return
+		}
+		if len(ops) > 0 && ops[len(ops)-1].Op == op {
+			ops[len(ops)-1].Len += n
+		} else {
+			ops = append(ops, CigarOp{Op: op, Len: n})
+		}
+	}
+	// put copies b into the read at 1-based position p.
+	put := func(dst []byte, p int, b []byte) bool {
+		if p < 1 || p-1+len(b) > len(dst) {
+			return false
+		}
+		copy(dst[p-1:], b)
+		return true
+	}
+
+	readPos, refPos := 1, int(a.Pos) // the next read and reference positions
+	match := func(n int) {
+		for i := 0; i < n; i++ {
+			if readPos-1+i < len(seq) {
+				seq[readPos-1+i] = refBase(refPos + i)
+			}
+		}
+		addOp('M', n)
+		readPos += n
+		refPos += n
+	}
+
+	p := 0
+	nFeatures := dec.int("FN")
+	for f := int32(0); f < nFeatures; f++ {
+		code := dec.byte("FC")
+		p += int(dec.int("FP"))
+		if p > readPos {
+			match(p - readPos)
+		}
+		ok := true
+		switch code {
+		case 'X':
+			bs := dec.byte("BS")
+			base := cramBaseIndex(refBase(refPos))
+			ok = bs < 4 && put(seq, p, []byte{dec.ch.subst[base][bs]})
+			addOp('M', 1)
+			readPos++
+			refPos++
+		case 'I', 'S':
+			key := "IN"
+			if code == 'S' {
+				key = "SC"
+			}
+			b := dec.bytes(key)
+			ok = put(seq, p, b)
+			addOp(code, len(b))
+			readPos += len(b)
+		case 'i':
+			ok = put(seq, p, []byte{dec.byte("BA")})
+			addOp('I', 1)
+			readPos++
+		case 'D', 'N':
+			key := "DL"
+			if code == 'N' {
+				key = "RS"
+			}
+			n := int(dec.int(key))
+			addOp(code, n)
+			refPos += n
+		case 'P':
+			addOp('P', int(dec.int("PD")))
+		case 'H':
+			addOp('H', int(dec.int("HC")))
+		case 'B':
+			ok = put(seq, p, []byte{dec.byte("BA")}) && put(qual, p, []byte{dec.byte("QS")})
+			addOp('M', 1)
+			readPos++
+			refPos++
+		case 'b':
+			b := dec.bytes("BB")
+			ok = put(seq, p, b)
+			addOp('M', len(b))
+			readPos += len(b)
+			refPos += len(b)
+		case 'q':
+			ok = put(qual, p, dec.bytes("QQ"))
+		case 'Q':
+			ok = put(qual, p, []byte{dec.byte("QS")})
+		default:
+			dec.err = SAMerror{str: fmt.Sprintf("Unknown CRAM read feature %q in %s", code, a.Qname)}
+		}
+		if dec.err != nil {
+			return
+		}
+		if !ok {
+			dec.err = SAMerror{str: fmt.Sprintf("Invalid CRAM read feature in %s", a.Qname)}
+			return
+		}
+	}
+	if readPos <= len(seq) {
+		match(len(seq) - readPos + 1)
+	}
+	if len(ops) > 0 {
+		a.Cigar = FormatCigar(ops)
+	}
+}
+
+// cramBaseIndex gives the row of the substitution matrix for a
+// reference base.
+func cramBaseIndex(b byte) int {
+	switch b {
+	case 'A', 'a':
+		return 0
+	case 'C', 'c':
+		return 1
+	case 'G', 'g':
+		return 2
+	case 'T', 't':
+		return 3
+	}
+	return 4
+}
+
+// reference returns the bases of reference refID, and the
+// position of the first of them. The reference is either embedded in
+// the slice, starting at the slice's position, or from the
+// ReferenceSource, in which case the last one used is kept. A file
+// that doesn't require a reference can be read without one, with any
+// bases not otherwise stored read as N.
+func (dec *cramDecoder) reference(refID int32) ([]byte, int, error) {
+	sr, ch, sh, cr := dec.sr, dec.ch, dec.sh, dec.sr.cram
+	if sh.embeddedRef >= 0 && refID == sh.refID {
+		c, err := dec.d.external(sh.embeddedRef)
+		if err != nil {
+			return nil, 1, err
+		}
+		return c.b, int(sh.start), nil
+	}
+	if refID == cr.refID && cr.refSeq != nil {
+		return cr.refSeq, 1, nil
+	}
+	if refID < 0 || int(refID) >= len(sr.Header.SQ) {
+		return nil, 1, nil
+	}
+	if cr.refs == nil {
+		if ch.refRequired {
+			return nil, 1, SAMerror{str: "CRAM file needs a reference sequence to be read"}
+		}
+		return nil, 1, nil
+	}
+	seq, err := cr.refs.Sequence(sr.Header.SQ[refID])
+	if err != nil {
+		return nil, 1, err
+	}
+	seq = []byte(strings.ToUpper(string(seq)))
+	cr.refID, cr.refSeq = refID, seq
+	return seq, 1, nil
+}
+
+// linkCRAMMates fills in the mate fields of records whose mates are
+// in the same slice, and numbers unnamed reads. The records of a
+// template form a chain through their mate indexes, with the last
+// record's mate being the first.
+func linkCRAMMates(recs []cramRecord, sh *cramSliceHeader) {
+	isMate := make([]bool, len(recs))
+	for i := range recs {
+		if m := recs[i].mate; m > i && m < len(recs) {
+			isMate[m] = true
+		} else {
+			recs[i].mate = -1
+		}
+	}
+	for i := range recs {
+		if isMate[i] {
+			continue
+		}
+		chain := []int{i}
+		for m := recs[i].mate; m >= 0; m = recs[m].mate {
+			chain = append(chain, m)
+		}
+		name := recs[i].a.Qname
+		if name == "*" && !recs[i].detached {
+			name = strconv.FormatInt(sh.recordCounter+int64(i)+1, 10)
+		}
+		for _, j := range chain {
+			if recs[j].a.Qname == "*" {
+				recs[j].a.Qname = name
+			}
+		}
+		if len(chain) == 1 {
+			continue
+		}
+
+		// The template length spans the template, if all of its reads
+		// are mapped to the same reference, and is positive for the
+		// leftmost read.
+		left, right, sameRef := uint32(0), uint32(0), true
+		for k, j := range chain {
+			a := recs[j].a
+			if a.IsUnmapped() || recs[j].refID != recs[i].refID {
+				sameRef = false
+				break
+			}
+			end := a.linearEnd()
+			if k == 0 || a.Pos < left {
+				left = a.Pos
+			}
+			if k == 0 || end > right {
+				right = end
+			}
+		}
+		leftmost := true
+		for k, j := range chain {
+			a := recs[j].a
+			mrec := recs[chain[(k+1)%len(chain)]]
+			m := mrec.a
+			a.Flag |= FlagPaired
+			if m.IsUnmapped() {
+				a.Flag |= FlagMateUnmapped
+			}
+			if m.IsReverse() {
+				a.Flag |= FlagMateReverse
+			}
+			a.NextRef = m.RefName
+			if mrec.refID != -1 && mrec.refID == recs[j].refID {
+				a.NextRef = "="
+			}
+			a.NextPos = m.Pos
+			if !sameRef {
+				continue
+			}
+			tlen := int32(right - left + 1)
+			if a.Pos == left && leftmost {
+				a.TemplateLen = tlen
+				leftmost = false
+			} else {
+				a.TemplateLen = -tlen
+			}
+		}
+	}
+}
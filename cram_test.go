@@ -0,0 +1,251 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReadITF8(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int32
+	}{
+		{"00", 0},
+		{"7f", 127},
+		{"8080", 128},
+		{"bfff", 16383},
+		{"c04000", 16384},
+		{"dfffff", 0x1fffff},
+		{"e0200000", 0x200000},
+		{"efffffff", 0x0fffffff},
+		{"f100000000", 0x10000000},
+		{"f7ffffff0f", 0x7fffffff},
+		{"ffffffff0f", -1},
+		{"fffffffff0", -16}, // only the low 4 bits of the fifth byte count
+	} {
+		in, _ := hex.DecodeString(tc.in)
+		v, err := readITF8(bytes.NewReader(in))
+		if err != nil || v != tc.want {
+			t.Errorf("readITF8(%s) = %d, %v, want %d", tc.in, v, err, tc.want)
+		}
+	}
+	if _, err := readITF8(bytes.NewReader([]byte{0xe0, 0x01})); err != errCRAMTruncated {
+		t.Errorf("truncated ITF8: error %v", err)
+	}
+}
+
+func TestReadLTF8(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+	}{
+		{"00", 0},
+		{"7f", 127},
+		{"8080", 128},
+		{"bfff", 0x3fff},
+		{"c04000", 0x4000},
+		{"e0200000", 0x200000},
+		{"f010000000", 0x10000000},
+		{"f80100000000", 1 << 32},
+		{"fc010000000000", 1 << 40},
+		{"fe00ffffffffffff", 1<<48 - 1},
+		{"fe01000000000000", 1 << 48},
+		{"ff0100000000000000", 1 << 56},
+		{"ffffffffffffffffff", -1},
+	} {
+		in, _ := hex.DecodeString(tc.in)
+		v, err := readLTF8(bytes.NewReader(in))
+		if err != nil || v != tc.want {
+			t.Errorf("readLTF8(%s) = %d, %v, want %d", tc.in, v, err, tc.want)
+		}
+	}
+}
+
+// bitString packs a string of 0s and 1s into bytes, most significant
+// bit first, as CRAM's core block is read.
+func bitString(s string) []byte {
+	b := make([]byte, (len(s)+7)/8)
+	for i := range s {
+		if s[i] == '1' {
+			b[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return b
+}
+
+// decodeInts decodes n integers with e from the bits in core.
+func decodeInts(t *testing.T, e *cramEncoding, core string, n int) []int32 {
+	t.Helper()
+	d := &cramSliceData{core: &cramBits{b: bitString(core)}, ext: map[int32]*cramBuf{}}
+	var vs []int32
+	for i := 0; i < n; i++ {
+		v, err := e.int(d)
+		if err != nil {
+			t.Fatalf("decoding %d of %s: %v", i, core, err)
+		}
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+func checkInts(t *testing.T, name string, got, want []int32) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s = %v, want %v", name, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s = %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func TestCanonicalHuffman(t *testing.T) {
+	// Codes go to shorter lengths first, then to lower symbols
+	codes := canonicalHuffman([]int32{67, 65, 68, 66}, []int32{3, 1, 2, 3})
+	want := []cramCode{{65, 1, 0}, {68, 2, 2}, {66, 3, 6}, {67, 3, 7}}
+	if len(codes) != len(want) {
+		t.Fatalf("canonicalHuffman = %v, want %v", codes, want)
+	}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Fatalf("canonicalHuffman = %v, want %v", codes, want)
+		}
+	}
+	// A, D, B, C, A: 0 10 110 111 0
+	e := &cramEncoding{codec: cramHuffman, huffman: codes}
+	checkInts(t, "Huffman", decodeInts(t, e, "0101101110", 5), []int32{65, 68, 66, 67, 65})
+
+	// A single symbol takes no bits
+	e = &cramEncoding{codec: cramHuffman, huffman: canonicalHuffman([]int32{-7}, []int32{0})}
+	checkInts(t, "one-symbol Huffman", decodeInts(t, e, "", 3), []int32{-7, -7, -7})
+}
+
+func TestCRAMBitCodecs(t *testing.T) {
+	beta := &cramEncoding{codec: cramBeta, offset: 2, nbits: 5}
+	checkInts(t, "Beta", decodeInts(t, beta, "00000"+"00010"+"11111", 3), []int32{-2, 0, 29})
+
+	// With k 2: values below 4 take a 0 and 2 bits, and then each
+	// leading 1 bit adds a bit to the value
+	subexp := &cramEncoding{codec: cramSubexp, offset: 1, nbits: 2}
+	checkInts(t, "Subexp", decodeInts(t, subexp, "000"+"011"+"1000"+"1011"+"110001", 5), []int32{-1, 2, 3, 6, 8})
+
+	// Gamma codes n zeros, then n+1 bits of the value starting with 1
+	gamma := &cramEncoding{codec: cramGamma, offset: 1}
+	checkInts(t, "Gamma", decodeInts(t, gamma, "1"+"010"+"011"+"00101"+"0001000", 5), []int32{0, 1, 2, 4, 7})
+}
+
+func TestRANS(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		// One symbol with all 4096 of the frequency leaves the
+		// states unchanged: worked out from the spec.
+		{"order 0, one symbol", "00" + "14000000" + "05000000" + "41900000" + strings.Repeat("00008000", 4), "AAAAA"},
+		// From the encoder in testdata/mkcram.py. 11 bytes leaves a
+		// remainder of 3 for the last state in order 1, and 3 bytes
+		// is all remainder.
+		{"order 0", "001f0000000b000000618747620282e8817481747282e800d202a4420d3a5221d0fea14240a66a02", "abracadabra"},
+		{"order 1", "01380000000b000000006184026383ff640083ff7283ff0061628fff006202728fff00618fff00618fff0072618fff00001c20ff010aac00020ca4000215080102", "abracadabra"},
+		{"order 1, short", "01210000000300000000618fff0061628fff006200638fff000000008000000080000000800002188000", "abc"},
+		{"order 1, contexts run", "014200000018000000002083ff6188016483ff0020618fff00612c81ff628802630183ff81ff006202728fff00618fff00618fff0072618fff0000ffa70008a30f16208e500710e8390510", "abracadabra, abracadabra"},
+	} {
+		in, err := hex.DecodeString(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ransDecode4x8(in, len(tc.want))
+		if err != nil || string(out) != tc.want {
+			t.Errorf("%s: decoded %q, %v, want %q", tc.name, out, err, tc.want)
+		}
+		if _, err := ransDecode4x8(in, len(tc.want)+1); err == nil {
+			t.Errorf("%s: no error for the wrong size", tc.name)
+		}
+	}
+}
+
+// sortedTags orders an alignment's tags, for comparing records whose
+// tags come in different orders.
+func sortedTags(a *Alignment) []OptField {
+	tags := a.Tags()
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+	return tags
+}
+
+// TestCRAMFixture decodes testdata/mixed.cram and checks that it gives
+// the records of testdata/mixed.sam, restoring bases from the
+// reference in testdata/mixed.fa.
+func TestCRAMFixture(t *testing.T) {
+	header, want, err := ReadSAMFile2("testdata/mixed.sam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa, err := OpenFASTA("testdata/mixed.fa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fa.Close()
+	f, err := os.Open("testdata/mixed.cram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sr, err := NewCRAMReader(f, fa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sr.Header.SQ) != len(header.SQ) || len(sr.Header.RG) != len(header.RG) {
+		t.Errorf("CRAM header has %d @SQ and %d @RG lines, want %d and %d",
+			len(sr.Header.SQ), len(sr.Header.RG), len(header.SQ), len(header.RG))
+	}
+
+	n := 0
+	for ; ; n++ {
+		a, err := sr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("record %d: %v", n, err)
+		}
+		if n >= len(want) {
+			t.Fatalf("more than the %d records of the SAM file", len(want))
+		}
+		w := want[n]
+		if a.Qname != w.Qname || a.Flag != w.Flag || a.RefName != w.RefName || a.Pos != w.Pos ||
+			a.Mapq != w.Mapq || a.Cigar != w.Cigar || a.NextRef != w.NextRef || a.NextPos != w.NextPos ||
+			a.TemplateLen != w.TemplateLen || a.Seq != w.Seq || a.Qual != w.Qual {
+			t.Errorf("record %d:\n got %+v\nwant %+v", n, *a, *w)
+			continue
+		}
+		if got, exp := sortedTags(a), sortedTags(w); !reflect.DeepEqual(got, exp) {
+			t.Errorf("record %d %s: tags %v, want %v", n, a.Qname, got, exp)
+		}
+	}
+	if n != len(want) {
+		t.Errorf("decoded %d records, want %d", n, len(want))
+	}
+}
@@ -0,0 +1,652 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+// The integer, bit and block encodings used by CRAM, as described in
+// the CRAM format specification, version 3.0.
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+var errCRAMTruncated = SAMerror{str: "Truncated CRAM data", err: ErrTruncatedRecord}
+
+// readITF8 reads a CRAM ITF8 integer, which takes 1 to 5 bytes, with
+// the number of leading 1 bits in the first byte giving the number of
+// bytes that follow.
+func readITF8(r io.ByteReader) (int32, error) {
+	b0, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := bits.LeadingZeros8(^b0)
+	if n > 4 {
+		n = 4
+	}
+	v := uint32(b0 & (0xff >> uint(n+1)))
+	if n == 4 {
+		v = uint32(b0 & 0x0f)
+	}
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errCRAMTruncated
+		}
+		if i == 3 { // the fifth byte only contributes its low 4 bits
+			v = v<<4 | uint32(b&0x0f)
+		} else {
+			v = v<<8 | uint32(b)
+		}
+	}
+	return int32(v), nil
+}
+
+// readLTF8 reads a CRAM LTF8 integer, the 64-bit version of ITF8,
+// which takes 1 to 9 bytes.
+func readLTF8(r io.ByteReader) (int64, error) {
+	b0, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := bits.LeadingZeros8(^b0)
+	v := uint64(b0 & (0xff >> uint(n+1)))
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errCRAMTruncated
+		}
+		v = v<<8 | uint64(b)
+	}
+	return int64(v), nil
+}
+
+// cramBuf reads CRAM values from a byte slice. The first error is
+// kept in err, after which reads return zeros, so that a structure
+// can be read field by field and checked once at the end.
+type cramBuf struct {
+	b   []byte
+	p   int
+	err error
+}
+
+func (c *cramBuf) ReadByte() (byte, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.p >= len(c.b) {
+		return 0, errCRAMTruncated
+	}
+	c.p++
+	return c.b[c.p-1], nil
+}
+
+func (c *cramBuf) fail(err error) {
+	if c.err == nil && err != nil {
+		if err == io.EOF {
+			err = errCRAMTruncated
+		}
+		c.err = err
+	}
+}
+
+func (c *cramBuf) byte() byte {
+	v, err := c.ReadByte()
+	c.fail(err)
+	return v
+}
+
+func (c *cramBuf) itf8() int32 {
+	v, err := readITF8(c)
+	c.fail(err)
+	return v
+}
+
+func (c *cramBuf) ltf8() int64 {
+	v, err := readLTF8(c)
+	c.fail(err)
+	return v
+}
+
+func (c *cramBuf) bytes(n int) []byte {
+	if c.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(c.b)-c.p {
+		c.fail(errCRAMTruncated)
+		return nil
+	}
+	c.p += n
+	return c.b[c.p-n : c.p]
+}
+
+func (c *cramBuf) uint32() uint32 {
+	b := c.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// itf8Array reads an ITF8 count followed by that many ITF8 values.
+func (c *cramBuf) itf8Array() []int32 {
+	n := c.itf8()
+	if n < 0 || int(n) > len(c.b)-c.p {
+		c.fail(SAMerror{str: "Invalid CRAM array length"})
+		return nil
+	}
+	a := make([]int32, n)
+	for i := range a {
+		a[i] = c.itf8()
+	}
+	return a
+}
+
+// cramBits reads the bit-packed values of a slice's core data block,
+// most significant bit first.
+type cramBits struct {
+	b   []byte
+	p   int  // byte
+	bit uint // bits of b[p] already used
+}
+
+func (r *cramBits) readBit() (uint32, error) {
+	if r.p >= len(r.b) {
+		return 0, errCRAMTruncated
+	}
+	v := uint32(r.b[r.p]>>(7-r.bit)) & 1
+	r.bit++
+	if r.bit == 8 {
+		r.bit = 0
+		r.p++
+	}
+	return v, nil
+}
+
+func (r *cramBits) readBits(n int32) (uint32, error) {
+	if n < 0 || n > 32 {
+		return 0, SAMerror{str: "Invalid CRAM bit count"}
+	}
+	v := uint32(0)
+	for i := int32(0); i < n; i++ {
+		b, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+// cramSliceData is where a slice's data series are decoded from: the
+// core block and the external blocks, by content ID.
+type cramSliceData struct {
+	core *cramBits
+	ext  map[int32]*cramBuf
+}
+
+// size returns the number of bytes of data in the slice's blocks.
+func (d *cramSliceData) size() int {
+	n := len(d.core.b)
+	for _, c := range d.ext {
+		n += len(c.b)
+	}
+	return n
+}
+
+func (d *cramSliceData) external(id int32) (*cramBuf, error) {
+	c := d.ext[id]
+	if c == nil {
+		return nil, SAMerror{str: fmt.Sprintf("CRAM slice has no external block %d", id)}
+	}
+	return c, nil
+}
+
+// CRAM codec IDs
+const (
+	cramNull          = 0
+	cramExternal      = 1
+	cramGolomb        = 2
+	cramHuffman       = 3
+	cramByteArrayLen  = 4
+	cramByteArrayStop = 5
+	cramBeta          = 6
+	cramSubexp        = 7
+	cramGolombRice    = 8
+	cramGamma         = 9
+)
+
+// cramEncoding is how a data series or tag is encoded, with the
+// parameters of its codec.
+type cramEncoding struct {
+	codec     int32
+	contentID int32         // EXTERNAL, BYTE_ARRAY_STOP
+	huffman   []cramCode    // HUFFMAN
+	offset    int32         // BETA, SUBEXP, GAMMA
+	nbits     int32         // BETA, and k for SUBEXP
+	stop      byte          // BYTE_ARRAY_STOP
+	lenEnc    *cramEncoding // BYTE_ARRAY_LEN
+	valEnc    *cramEncoding // BYTE_ARRAY_LEN
+}
+
+// cramCode is a canonical Huffman code for a symbol.
+type cramCode struct {
+	symbol int32
+	len    int32
+	code   uint32
+}
+
+// readCRAMEncoding reads a codec ID and its parameters.
+func readCRAMEncoding(c *cramBuf) *cramEncoding {
+	e := &cramEncoding{codec: c.itf8()}
+	p := &cramBuf{b: c.bytes(int(c.itf8()))}
+	switch e.codec {
+	case cramNull:
+	case cramExternal:
+		e.contentID = p.itf8()
+	case cramHuffman:
+		symbols := p.itf8Array()
+		lens := p.itf8Array()
+		if len(symbols) != len(lens) {
+			p.fail(SAMerror{str: "Invalid CRAM Huffman code"})
+			break
+		}
+		e.huffman = canonicalHuffman(symbols, lens)
+	case cramByteArrayLen:
+		e.lenEnc = readCRAMEncoding(p)
+		e.valEnc = readCRAMEncoding(p)
+	case cramByteArrayStop:
+		e.stop = p.byte()
+		e.contentID = p.itf8()
+	case cramBeta:
+		e.offset = p.itf8()
+		e.nbits = p.itf8()
+	case cramSubexp:
+		e.offset = p.itf8()
+		e.nbits = p.itf8()
+	case cramGamma:
+		e.offset = p.itf8()
+	default:
+		p.fail(SAMerror{str: fmt.Sprintf("Unsupported CRAM codec %d", e.codec)})
+	}
+	c.fail(p.err)
+	return e
+}
+
+// canonicalHuffman assigns canonical codes to symbols with the given
+// code lengths, ordered by length and then by symbol.
+func canonicalHuffman(symbols, lens []int32) []cramCode {
+	codes := make([]cramCode, len(symbols))
+	for i := range symbols {
+		codes[i] = cramCode{symbol: symbols[i], len: lens[i]}
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if codes[i].len != codes[j].len {
+			return codes[i].len < codes[j].len
+		}
+		return codes[i].symbol < codes[j].symbol
+	})
+	code := uint32(0)
+	for i := range codes {
+		if i > 0 {
+			code = (code + 1) << uint(codes[i].len-codes[i-1].len)
+		}
+		codes[i].code = code
+	}
+	return codes
+}
+
+// int decodes an integer data series value.
+func (e *cramEncoding) int(d *cramSliceData) (int32, error) {
+	switch e.codec {
+	case cramExternal:
+		c, err := d.external(e.contentID)
+		if err != nil {
+			return 0, err
+		}
+		return readITF8(c)
+	case cramHuffman:
+		if len(e.huffman) == 1 && e.huffman[0].len == 0 {
+			return e.huffman[0].symbol, nil
+		}
+		v, n := uint32(0), int32(0)
+		for _, hc := range e.huffman {
+			for n < hc.len {
+				b, err := d.core.readBit()
+				if err != nil {
+					return 0, err
+				}
+				v = v<<1 | b
+				n++
+			}
+			if hc.code == v {
+				return hc.symbol, nil
+			}
+		}
+		return 0, SAMerror{str: "Invalid CRAM Huffman code"}
+	case cramBeta:
+		v, err := d.core.readBits(e.nbits)
+		return int32(v) - e.offset, err
+	case cramSubexp:
+		i := int32(0)
+		for {
+			b, err := d.core.readBit()
+			if err != nil {
+				return 0, err
+			}
+			if b == 0 {
+				break
+			}
+			i++
+		}
+		if i == 0 {
+			v, err := d.core.readBits(e.nbits)
+			return int32(v) - e.offset, err
+		}
+		b := i + e.nbits - 1
+		v, err := d.core.readBits(b)
+		return int32(1<<uint(b)|v) - e.offset, err
+	case cramGamma:
+		n := int32(0)
+		for {
+			b, err := d.core.readBit()
+			if err != nil {
+				return 0, err
+			}
+			if b == 1 {
+				break
+			}
+			n++
+		}
+		v, err := d.core.readBits(n)
+		return int32(1<<uint(n)|v) - e.offset, err
+	}
+	return 0, SAMerror{str: fmt.Sprintf("CRAM codec %d can't decode an integer", e.codec)}
+}
+
+// byte decodes a byte data series value.
+func (e *cramEncoding) byte(d *cramSliceData) (byte, error) {
+	if e.codec == cramExternal {
+		c, err := d.external(e.contentID)
+		if err != nil {
+			return 0, err
+		}
+		return c.ReadByte()
+	}
+	v, err := e.int(d)
+	return byte(v), err
+}
+
+// fill decodes len(out) byte values.
+func (e *cramEncoding) fill(d *cramSliceData, out []byte) error {
+	if e.codec == cramExternal {
+		c, err := d.external(e.contentID)
+		if err != nil {
+			return err
+		}
+		copy(out, c.bytes(len(out)))
+		return c.err
+	}
+	for i := range out {
+		b, err := e.byte(d)
+		if err != nil {
+			return err
+		}
+		out[i] = b
+	}
+	return nil
+}
+
+// bytes decodes a byte array data series value.
+func (e *cramEncoding) bytes(d *cramSliceData) ([]byte, error) {
+	switch e.codec {
+	case cramByteArrayLen:
+		n, err := e.lenEnc.int(d)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, SAMerror{str: "Invalid CRAM byte array length"}
+		}
+		out := make([]byte, n)
+		return out, e.valEnc.fill(d, out)
+	case cramByteArrayStop:
+		c, err := d.external(e.contentID)
+		if err != nil {
+			return nil, err
+		}
+		if c.err != nil {
+			return nil, c.err
+		}
+		i := bytes.IndexByte(c.b[c.p:], e.stop)
+		if i < 0 {
+			return nil, errCRAMTruncated
+		}
+		out := c.b[c.p : c.p+i]
+		c.p += i + 1
+		return out, nil
+	}
+	return nil, SAMerror{str: fmt.Sprintf("CRAM codec %d can't decode a byte array", e.codec)}
+}
+
+// CRAM block compression methods
+const (
+	cramRaw     = 0
+	cramGzip    = 1
+	cramBzip2   = 2
+	cramLZMA    = 3
+	cramRANS4x8 = 4
+)
+
+// decompressCRAMBlock uncompresses the data of a block, which should
+// be rawSize bytes.
+func decompressCRAMBlock(method byte, data []byte, rawSize int) ([]byte, error) {
+	var out []byte
+	var err error
+	switch method {
+	case cramRaw:
+		out = data
+	case cramGzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			out, err = io.ReadAll(zr)
+		}
+	case cramBzip2:
+		out, err = io.ReadAll(bzip2.NewReader(bytes.NewReader(data)))
+	case cramRANS4x8:
+		out, err = ransDecode4x8(data, rawSize)
+	default:
+		return nil, SAMerror{str: fmt.Sprintf("Unsupported CRAM block compression method %d", method)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != rawSize {
+		return nil, SAMerror{str: "CRAM block has the wrong uncompressed size"}
+	}
+	return out, nil
+}
+
+// cramMaxBlockSize is the largest uncompressed block accepted, well
+// above what CRAM writers produce.
+const cramMaxBlockSize = 1 << 30
+
+// rANS 4x8 uses frequencies that sum to 1<<ransTFShift, and keeps its
+// states at least ransLower.
+const (
+	ransTFShift = 12
+	ransLower   = 1 << 23
+)
+
+// ransDecode4x8 decodes data compressed with CRAM's order-0 or
+// order-1 rANS codec, with 4 interleaved states, into rawSize bytes.
+func ransDecode4x8(in []byte, rawSize int) ([]byte, error) {
+	if len(in) < 9 {
+		return nil, errCRAMTruncated
+	}
+	order := in[0]
+	outSize := int(binary.LittleEndian.Uint32(in[5:]))
+	if outSize != rawSize {
+		return nil, SAMerror{str: "CRAM block has the wrong uncompressed size"}
+	}
+	c := &cramBuf{b: in[9:]}
+	if order == 0 {
+		return rans0(c, outSize)
+	}
+	return rans1(c, outSize)
+}
+
+// ransFreqs reads a frequency table: symbols with their frequencies,
+// where runs of consecutive symbols are run-length encoded, up to a 0
+// symbol. It calls set for each symbol.
+func ransFreqs(c *cramBuf, set func(sym int, f uint32)) {
+	sym, rle := int(c.byte()), 0
+	for c.err == nil {
+		f := uint32(c.byte())
+		if f >= 128 {
+			f = (f&0x7f)<<8 | uint32(c.byte())
+		}
+		set(sym, f)
+		if rle == 0 && c.p < len(c.b) && sym+1 == int(c.b[c.p]) {
+			sym = int(c.byte())
+			rle = int(c.byte())
+		} else if rle > 0 {
+			rle--
+			sym++
+		} else {
+			sym = int(c.byte())
+		}
+		if sym == 0 || sym > 255 {
+			break
+		}
+	}
+}
+
+// ransTable holds the frequencies for one context.
+type ransTable struct {
+	freq, cum [256]uint32
+	lookup    [1 << ransTFShift]byte
+	total     uint32
+}
+
+func (t *ransTable) set(sym int, f uint32, c *cramBuf) {
+	if t.total+f > 1<<ransTFShift {
+		c.fail(SAMerror{str: "Invalid rANS frequency table"})
+		return
+	}
+	t.freq[sym] = f
+	t.cum[sym] = t.total
+	for i := t.total; i < t.total+f; i++ {
+		t.lookup[i] = byte(sym)
+	}
+	t.total += f
+}
+
+// ransStates reads the 4 initial states.
+func ransStates(c *cramBuf) [4]uint32 {
+	var R [4]uint32
+	for i := range R {
+		R[i] = c.uint32()
+	}
+	return R
+}
+
+// ransStep decodes a symbol from state x with table t.
+func ransStep(x *uint32, t *ransTable, c *cramBuf) byte {
+	m := *x & (1<<ransTFShift - 1)
+	s := t.lookup[m]
+	*x = t.freq[s]*(*x>>ransTFShift) + m - t.cum[s]
+	for *x < ransLower && c.p < len(c.b) {
+		*x = *x<<8 | uint32(c.b[c.p])
+		c.p++
+	}
+	return s
+}
+
+func rans0(c *cramBuf, n int) ([]byte, error) {
+	t := &ransTable{}
+	ransFreqs(c, func(sym int, f uint32) { t.set(sym, f, c) })
+	R := ransStates(c)
+	if c.err != nil {
+		return nil, c.err
+	}
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = ransStep(&R[i&3], t, c)
+	}
+	return out, nil
+}
+
+func rans1(c *cramBuf, n int) ([]byte, error) {
+	var tables [256]*ransTable
+	ctx, rle := int(c.byte()), 0
+	for c.err == nil {
+		t := &ransTable{}
+		tables[ctx] = t
+		ransFreqs(c, func(sym int, f uint32) { t.set(sym, f, c) })
+		if rle == 0 && c.p < len(c.b) && ctx+1 == int(c.b[c.p]) {
+			ctx = int(c.byte())
+			rle = int(c.byte())
+		} else if rle > 0 {
+			rle--
+			ctx++
+		} else {
+			ctx = int(c.byte())
+		}
+		if ctx == 0 || ctx > 255 {
+			break
+		}
+	}
+	R := ransStates(c)
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	// Each state decodes a quarter of the output, and the last takes
+	// any remainder too. Each symbol is the context for the next.
+	out := make([]byte, n)
+	q := n / 4
+	var last [4]byte
+	step := func(j, i int) error {
+		t := tables[last[j]]
+		if t == nil {
+			return SAMerror{str: "rANS data uses an undefined context"}
+		}
+		last[j] = ransStep(&R[j], t, c)
+		out[i] = last[j]
+		return nil
+	}
+	for i := 0; i < q; i++ {
+		for j := 0; j < 4; j++ {
+			if err := step(j, j*q+i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i := 4 * q; i < n; i++ {
+		if err := step(3, i); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
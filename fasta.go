@@ -0,0 +1,179 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// faiEntry is a line of a samtools .fai index, locating a sequence in
+// a FASTA file.
+type faiEntry struct {
+	name      string
+	length    uint32
+	offset    int64 // of the first base
+	lineBases int64 // bases on each full line
+	lineWidth int64 // bytes in each full line, with its newline
+}
+
+// parseFAILine parses a line of a .fai index: the sequence name, its
+// length, the offset of its first base, and the bases and bytes in
+// each line. Only the name and length are needed for a dictionary, so
+// the other fields are only checked if they're there.
+func parseFAILine(text string) (faiEntry, error) {
+	fields := strings.Split(text, "\t")
+	if len(fields) < 2 {
+		return faiEntry{}, SAMerror{str: fmt.Sprintf("Malformed FASTA index line %q", text)}
+	}
+	length, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return faiEntry{}, SAMerror{str: fmt.Sprintf("Invalid sequence length %q in FASTA index", fields[1]), Field: "LN"}
+	}
+	e := faiEntry{name: fields[0], length: uint32(length)}
+	if len(fields) >= 5 {
+		var nums [3]int64
+		for i, f := range fields[2:5] {
+			if nums[i], err = strconv.ParseInt(f, 10, 64); err != nil || nums[i] < 0 {
+				return faiEntry{}, SAMerror{str: fmt.Sprintf("Invalid number %q in FASTA index line for %s", f, e.name)}
+			}
+		}
+		e.offset, e.lineBases, e.lineWidth = nums[0], nums[1], nums[2]
+		if e.length > 0 && (e.lineBases == 0 || e.lineWidth < e.lineBases) {
+			return faiEntry{}, SAMerror{str: fmt.Sprintf("Invalid line lengths in FASTA index line for %s", e.name)}
+		}
+	}
+	return e, nil
+}
+
+// FASTA gives random access to the sequences of a FASTA file through
+// its samtools .fai index, so that regions can be read without reading
+// the whole file. It's a ReferenceSource, for reading CRAM files.
+type FASTA struct {
+	f     *os.File
+	index map[string]faiEntry
+}
+
+// OpenFASTA opens the FASTA file path, with its index, which must be
+// path + ".fai", as samtools faidx makes it. The file isn't read
+// until sequences are fetched.
+func OpenFASTA(path string) (*FASTA, error) {
+	fai, err := os.Open(path + ".fai")
+	if err != nil {
+		return nil, err
+	}
+	defer fai.Close()
+
+	index := map[string]faiEntry{}
+	s := bufio.NewScanner(fai)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSuffix(s.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		e, err := parseFAILine(text)
+		if err == nil && e.lineWidth == 0 && e.length > 0 {
+			err = SAMerror{str: fmt.Sprintf("FASTA index line for %s has no offsets", e.name)}
+		}
+		if err != nil {
+			if se, ok := err.(SAMerror); ok {
+				se.Line = line
+				err = se
+			}
+			return nil, err
+		}
+		index[e.name] = e
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FASTA{f: f, index: index}, nil
+}
+
+// Close closes the FASTA file.
+func (fa *FASTA) Close() error {
+	return fa.f.Close()
+}
+
+// Length returns the length of sequence ref, and whether the index has
+// it.
+func (fa *FASTA) Length(ref string) (uint32, bool) {
+	e, ok := fa.index[ref]
+	return e.length, ok
+}
+
+// Fetch returns the bases at positions start to end (1-based,
+// inclusive) of sequence ref, uppercased. As with samtools faidx, a
+// region running off the end of the sequence is cut short there, but
+// one that starts past the end is an error.
+func (fa *FASTA) Fetch(ref string, start, end uint32) ([]byte, error) {
+	e, ok := fa.index[ref]
+	if !ok {
+		return nil, SAMerror{str: fmt.Sprintf("Reference sequence %s isn't in the FASTA index", ref), Field: "SN"}
+	}
+	if start < 1 || end < start || start > e.length {
+		return nil, SAMerror{str: fmt.Sprintf("Invalid region %s:%d-%d of a %d base sequence", ref, start, end, e.length)}
+	}
+	if end > e.length {
+		end = e.length
+	}
+
+	// Byte offsets of the first base, and just past the last
+	beg := e.offset + int64(start-1)/e.lineBases*e.lineWidth + int64(start-1)%e.lineBases
+	last := e.offset + int64(end-1)/e.lineBases*e.lineWidth + int64(end-1)%e.lineBases
+	buf := make([]byte, last+1-beg)
+	if _, err := fa.f.ReadAt(buf, beg); err != nil {
+		if err == io.EOF {
+			err = SAMerror{str: fmt.Sprintf("FASTA file is shorter than its index says, reading %s", ref)}
+		}
+		return nil, err
+	}
+
+	seq := buf[:0]
+	for _, c := range buf {
+		if c == '\n' || c == '\r' {
+			continue
+		}
+		seq = append(seq, upperBase(c))
+	}
+	if len(seq) != int(end-start+1) {
+		return nil, SAMerror{str: fmt.Sprintf("FASTA file doesn't match its index, reading %s", ref)}
+	}
+	return seq, nil
+}
+
+// Sequence returns the whole of sequence rsd, so that FASTA can be used
+// as a ReferenceSource.
+func (fa *FASTA) Sequence(rsd *RefSeqDict) ([]byte, error) {
+	e, ok := fa.index[rsd.Name]
+	if !ok {
+		return nil, SAMerror{str: fmt.Sprintf("Reference sequence %s isn't in the FASTA index", rsd.Name), Field: "SN"}
+	}
+	if e.length == 0 {
+		return []byte{}, nil
+	}
+	return fa.Fetch(rsd.Name, 1, e.length)
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"io"
+	"strings"
+)
+
+// Quality used when an alignment has no QUAL, the same default as
+// samtools fastq.
+const defaultFASTQQual = '!' + 1
+
+// WriteFASTQ writes a as a FASTQ record, in the orientation the read
+// was sequenced in: reverse strand reads are reverse complemented
+// back. Paired reads get a /1 or /2 suffix. Secondary and
+// supplementary alignments are skipped, since the primary alignment
+// already has the read, so nothing is written for them.
+func WriteFASTQ(w io.Writer, a *Alignment) error {
+	if a.IsSecondary() || a.IsSupplementary() {
+		return nil
+	}
+	if a.Seq == "*" {
+		return SAMerror{str: "Alignment " + a.Qname + " has no sequence to write as FASTQ"}
+	}
+
+	name := a.Qname
+	if a.IsRead1() {
+		name += "/1"
+	} else if a.IsRead2() {
+		name += "/2"
+	}
+
+	seq, qual := a.Seq, a.Qual
+	if qual == "*" {
+		qual = strings.Repeat(string(rune(defaultFASTQQual)), len(seq))
+	}
+	if a.IsReverse() {
+		seq = ReverseComplement(seq)
+		qual = ReverseString(qual)
+	}
+
+	_, err := io.WriteString(w, "@"+name+"\n"+seq+"\n+\n"+qual+"\n")
+	return err
+}
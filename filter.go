@@ -0,0 +1,106 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+// Filter returns the alignments for which pred is true, in their
+// original order.
+func Filter(alignments []*Alignment, pred func(*Alignment) bool) []*Alignment {
+	var kept []*Alignment
+	for _, a := range alignments {
+		if pred(a) {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// NextFiltered is like Next, but skips alignments for which pred is
+// false.
+func (sr *Reader) NextFiltered(pred func(*Alignment) bool) (*Alignment, error) {
+	for {
+		a, err := sr.Next()
+		if err != nil || pred(a) {
+			return a, err
+		}
+	}
+}
+
+// MinMapQ keeps alignments with MAPQ at least n, like samtools view -q.
+func MinMapQ(n uint8) func(*Alignment) bool {
+	return func(a *Alignment) bool { return a.Mapq >= n }
+}
+
+// RequireFlag keeps alignments with all of the bits of mask set, like
+// samtools view -f.
+func RequireFlag(mask uint16) func(*Alignment) bool {
+	return func(a *Alignment) bool { return a.Flag&mask == mask }
+}
+
+// ExcludeFlag keeps alignments with none of the bits of mask set, like
+// samtools view -F.
+func ExcludeFlag(mask uint16) func(*Alignment) bool {
+	return func(a *Alignment) bool { return a.Flag&mask == 0 }
+}
+
+// And combines predicates, keeping alignments all of them keep.
+func And(preds ...func(*Alignment) bool) func(*Alignment) bool {
+	return func(a *Alignment) bool {
+		for _, pred := range preds {
+			if !pred(a) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Subsample keeps each template with probability fraction, chosen by
+// hashing QNAME with seed, so that all the reads of a template are kept
+// or dropped together and the same seed always keeps the same reads.
+// The hash is the one samtools view -s uses.
+func Subsample(fraction float64, seed int64) func(*Alignment) bool {
+	return func(a *Alignment) bool {
+		k := wangHash(x31Hash(a.Qname) ^ uint32(seed))
+		return float64(k&0xffffff)/0x1000000 < fraction
+	}
+}
+
+// Downsample returns a reproducible random subset of alignments,
+// keeping each template with probability fraction, as Subsample does.
+func Downsample(alignments []*Alignment, fraction float64, seed int64) []*Alignment {
+	return Filter(alignments, Subsample(fraction, seed))
+}
+
+// x31Hash is htslib's string hash, __ac_X31_hash_string.
+func x31Hash(s string) uint32 {
+	var h uint32
+	for i := 0; i < len(s); i++ {
+		h = h<<5 - h + uint32(s[i])
+	}
+	return h
+}
+
+// wangHash is Thomas Wang's integer hash, as htslib's __ac_Wang_hash.
+func wangHash(key uint32) uint32 {
+	key += ^(key << 15)
+	key ^= key >> 10
+	key += key << 3
+	key ^= key >> 6
+	key += ^(key << 11)
+	key ^= key >> 16
+	return key
+}
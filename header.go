@@ -0,0 +1,287 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ReadHeader reads just the header of a SAM, BAM, or CRAM file from r,
+// telling which it is from how it starts, for when only the reference
+// sequences or read groups are wanted. It stops at the first line of
+// a SAM file that isn't a header line, and for BAM and CRAM it reads
+// only the header section, so alignments aren't read. Since r is read
+// through a buffer, it may be read a little way past the header.
+func ReadHeader(r io.Reader) (*Header, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	var sr *Reader
+	var err error
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		sr, err = NewBAMReader(br)
+	case string(magic) == string(cramMagic):
+		// No reference is needed until alignments are decoded
+		sr, err = NewCRAMReader(br, nil)
+	default:
+		sr, err = NewReader(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sr.Header, nil
+}
+
+// RefIndex maps the name of each reference sequence to its index in
+// the @SQ lines, which is the reference ID used by BAM. Names not in
+// the header aren't in the map.
+func (h *Header) RefIndex() map[string]int {
+	index := make(map[string]int, len(h.SQ))
+	for i, rsd := range h.SQ {
+		index[rsd.Name] = i
+	}
+	return index
+}
+
+// Reference returns the @SQ line of the reference sequence called
+// name, and whether there is one. Headers from a Reader, a
+// HeaderBuilder or MergeHeaders carry an index of SQ by name for this,
+// which RenameRefs keeps up to date. For other headers, or once lines
+// have been added to or removed from SQ, SQ is searched instead; a
+// name changed in SQ other than by RenameRefs may not be found. The
+// header isn't changed, so Reference is safe to call concurrently.
+func (h *Header) Reference(name string) (*RefSeqDict, bool) {
+	if h.refs != nil && len(h.refs) == len(h.SQ) {
+		i, ok := h.refs[name]
+		if !ok {
+			return nil, false
+		}
+		if h.SQ[i].Name == name {
+			return h.SQ[i], true
+		}
+	}
+	for _, rsd := range h.SQ {
+		if rsd.Name == name {
+			return rsd, true
+		}
+	}
+	return nil, false
+}
+
+// indexRefs builds the index of SQ by name that Reference uses, once
+// SQ has been filled in or its names changed.
+func (h *Header) indexRefs() {
+	h.refs = h.RefIndex()
+}
+
+// RefName returns the name of the reference sequence with index i in
+// the @SQ lines, and whether there is one.
+func (h *Header) RefName(i int) (string, bool) {
+	if i < 0 || i >= len(h.SQ) {
+		return "", false
+	}
+	return h.SQ[i].Name, true
+}
+
+// ProgramChain returns the @PG lines in the order the programs were
+// run, following the PP links back from the last program, the one no
+// other program's PP refers to, to the first, which has no PP. It's
+// an error for the links not to form a single chain: for there to be a
+// cycle, a PP that doesn't match any program, or more than one last
+// program.
+func (h *Header) ProgramChain() ([]*Program, error) {
+	if err := ValidatePrograms(h.PG); err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*Program, len(h.PG))
+	referenced := make(map[string]bool, len(h.PG))
+	for _, prog := range h.PG {
+		byID[prog.ID] = prog
+		if prog.PrevID != "" {
+			referenced[prog.PrevID] = true
+		}
+	}
+	var last *Program
+	for _, prog := range h.PG {
+		if referenced[prog.ID] {
+			continue
+		}
+		if last != nil {
+			return nil, SAMerror{str: fmt.Sprintf("Programs %s and %s both end a PP chain", last.ID, prog.ID), Field: "PP"}
+		}
+		last = prog
+	}
+
+	chain := make([]*Program, 0, len(h.PG))
+	for p := last; p != nil; p = byID[p.PrevID] {
+		chain = append(chain, p)
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// NewProgramRecord returns a @PG line for a program, usually the one
+// running, to be added to a header with AppendProgram. Any of the
+// arguments other than id may be empty.
+func NewProgramRecord(id, name, version, cmdLine string, prevID string) *Program {
+	return &Program{ID: id, Name: name, Version: version, CmdLine: cmdLine, PrevID: prevID}
+}
+
+// AppendProgram adds a @PG line to the header, as a tool that
+// modifies a file should. If prog has no PrevID, it's set to the ID of
+// the last program in the existing chain, so that the chain goes on
+// through prog. If prog's ID is already in use, a suffix of .1, .2,
+// and so on is added to it to make it unique, as samtools does.
+func (h *Header) AppendProgram(prog *Program) error {
+	if valid, err := validateProgram(prog); !valid {
+		return err
+	}
+	if prog.PrevID == "" && len(h.PG) > 0 {
+		chain, err := h.ProgramChain()
+		if err != nil {
+			return err
+		}
+		prog.PrevID = chain[len(chain)-1].ID
+	}
+
+	ids := make(map[string]bool, len(h.PG))
+	for _, p := range h.PG {
+		ids[p.ID] = true
+	}
+	if ids[prog.ID] {
+		for n := 1; ; n++ {
+			id := prog.ID + "." + strconv.Itoa(n)
+			if !ids[id] {
+				prog.ID = id
+				break
+			}
+		}
+	}
+	if prog.PrevID != "" && !ids[prog.PrevID] {
+		return SAMerror{str: fmt.Sprintf("Program %s has PP %s, which doesn't match any program ID", prog.ID, prog.PrevID), Field: "PP"}
+	}
+	h.PG = append(h.PG, prog)
+	return nil
+}
+
+// HeaderBuilder assembles a Header, for writing SAM from scratch. Its
+// methods return the builder, so they can be chained:
+//
+//	header, err := NewHeaderBuilder().
+//		SetSortOrder(SortCoordinate).
+//		AddReference("chr1", 248956422).
+//		Build()
+type HeaderBuilder struct {
+	hd     HeaderLine
+	header Header
+}
+
+// NewHeaderBuilder returns a builder for a header with an @HD line of
+// version 1.6, and nothing else.
+func NewHeaderBuilder() *HeaderBuilder {
+	return &HeaderBuilder{hd: HeaderLine{Version: "1.6"}}
+}
+
+// SetVersion sets the VN tag of the @HD line.
+func (b *HeaderBuilder) SetVersion(version string) *HeaderBuilder {
+	b.hd.Version = version
+	return b
+}
+
+// SetSortOrder sets the SO tag of the @HD line.
+func (b *HeaderBuilder) SetSortOrder(so SortOrder) *HeaderBuilder {
+	b.hd.SortOrder = so
+	return b
+}
+
+// AddReference adds an @SQ line.
+func (b *HeaderBuilder) AddReference(name string, length uint32) *HeaderBuilder {
+	b.header.SQ = append(b.header.SQ, &RefSeqDict{Name: name, Length: length})
+	return b
+}
+
+// AddReadGroup adds an @RG line.
+func (b *HeaderBuilder) AddReadGroup(rg *ReadGroup) *HeaderBuilder {
+	b.header.RG = append(b.header.RG, rg)
+	return b
+}
+
+// AddProgram adds a @PG line.
+func (b *HeaderBuilder) AddProgram(prog *Program) *HeaderBuilder {
+	b.header.PG = append(b.header.PG, prog)
+	return b
+}
+
+// AddComment adds a @CO line.
+func (b *HeaderBuilder) AddComment(co string) *HeaderBuilder {
+	b.header.CO = append(b.header.CO, co)
+	return b
+}
+
+// Build returns the header, after checking it as the reader would:
+// each line is validated, names and IDs must be unique, and program
+// chains must resolve.
+func (b *HeaderBuilder) Build() (*Header, error) {
+	hd := b.hd
+	if valid, err := validateHeader(&hd); !valid {
+		return nil, err
+	}
+	names := newHeaderNames()
+	for _, rsd := range b.header.SQ {
+		if valid, err := validateRefSeqDict(rsd); !valid {
+			return nil, err
+		}
+		if err := names.addRefSeq(rsd); err != nil {
+			return nil, err
+		}
+	}
+	for _, rg := range b.header.RG {
+		if valid, err := validateReadGroup(rg); !valid {
+			return nil, err
+		}
+		if err := names.addReadGroup(rg.ID); err != nil {
+			return nil, err
+		}
+	}
+	for _, prog := range b.header.PG {
+		if valid, err := validateProgram(prog); !valid {
+			return nil, err
+		}
+		if err := names.addProgram(prog.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := ValidatePrograms(b.header.PG); err != nil {
+		return nil, err
+	}
+
+	header := &Header{
+		HD: &hd,
+		SQ: append([]*RefSeqDict(nil), b.header.SQ...),
+		RG: append([]*ReadGroup(nil), b.header.RG...),
+		PG: append([]*Program(nil), b.header.PG...),
+		CO: append([]string(nil), b.header.CO...),
+	}
+	header.indexRefs()
+	return header, nil
+}
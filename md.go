@@ -0,0 +1,157 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ComputeNM returns the edit distance of the alignment to ref, the
+// sequence of the reference it's aligned to, which is what the NM tag
+// holds: the number of mismatched, inserted and deleted bases. As in
+// samtools, N bases never match, and '=' in SEQ always does.
+func (a *Alignment) ComputeNM(ref []byte) (int, error) {
+	nm, _, err := a.compareToRef(ref)
+	return nm, err
+}
+
+// ComputeMD returns the MD tag of the alignment against ref, the
+// sequence of the reference it's aligned to, with reference bases
+// uppercased.
+func (a *Alignment) ComputeMD(ref []byte) (string, error) {
+	_, md, err := a.compareToRef(ref)
+	return md, err
+}
+
+// compareToRef walks the aligned pairs of a against ref, finding its
+// NM and MD tags.
+func (a *Alignment) compareToRef(ref []byte) (int, string, error) {
+	if a.IsUnmapped() || a.Pos == 0 {
+		return 0, "", SAMerror{str: fmt.Sprintf("Alignment %s is unmapped", a.Qname)}
+	}
+	if a.Seq == "*" {
+		return 0, "", SAMerror{str: fmt.Sprintf("Alignment %s has no SEQ", a.Qname), Field: "SEQ"}
+	}
+	if _, err := a.CigarOps(); err != nil {
+		return 0, "", err
+	}
+
+	var md strings.Builder
+	nm, matches := 0, 0
+	inDeletion := false
+	for _, p := range a.AlignedPairs() {
+		if p.RefPos > len(ref) {
+			return 0, "", SAMerror{str: fmt.Sprintf("Alignment %s extends past the end of the reference", a.Qname)}
+		}
+		switch p.Op {
+		case 'M', '=', 'X':
+			inDeletion = false
+			if p.QueryPos >= len(a.Seq) {
+				return 0, "", SAMerror{str: fmt.Sprintf("Alignment %s has a SEQ shorter than its CIGAR", a.Qname), Field: "SEQ"}
+			}
+			r, q := upperBase(ref[p.RefPos-1]), upperBase(a.Seq[p.QueryPos])
+			if q == '=' || q == r && r != 'N' {
+				matches++
+				continue
+			}
+			md.WriteString(strconv.Itoa(matches))
+			md.WriteByte(r)
+			matches = 0
+			nm++
+		case 'D':
+			if !inDeletion {
+				md.WriteString(strconv.Itoa(matches))
+				md.WriteByte('^')
+				matches = 0
+				inDeletion = true
+			}
+			md.WriteByte(upperBase(ref[p.RefPos-1]))
+			nm++
+		case 'I':
+			nm++
+		}
+	}
+	md.WriteString(strconv.Itoa(matches))
+	return nm, md.String(), nil
+}
+
+func upperBase(b byte) byte {
+	if b >= 'a' && b <= 'z' {
+		return b - ('a' - 'A')
+	}
+	return b
+}
+
+// Identity returns the fraction of the alignment's columns that are
+// matches: the matching bases, divided by the aligned length, which
+// counts every base of M, = and X operations and every inserted and
+// deleted base, as BLAST's identity does. Skipped regions and clips
+// don't count. Bases of = and X operations are taken to match and
+// mismatch as the CIGAR says; those of M operations are compared with
+// ref, the sequence of the reference the read is aligned to, by the
+// same rules as ComputeNM. ref and SEQ aren't needed if the CIGAR has
+// no M operations.
+func (a *Alignment) Identity(ref []byte) (float64, error) {
+	if a.IsUnmapped() || a.Pos == 0 {
+		return 0, SAMerror{str: fmt.Sprintf("Alignment %s is unmapped", a.Qname)}
+	}
+	ops, err := a.CigarOps()
+	if err != nil {
+		return 0, err
+	}
+
+	matches, length := 0, 0
+	q, r := 0, int(a.Pos)-1
+	for _, op := range ops {
+		switch op.Op {
+		case '=':
+			matches += op.Len
+			length += op.Len
+		case 'X', 'I', 'D':
+			length += op.Len
+		case 'M':
+			if a.Seq == "*" {
+				return 0, SAMerror{str: fmt.Sprintf("Alignment %s has no SEQ", a.Qname), Field: "SEQ"}
+			}
+			if q+op.Len > len(a.Seq) {
+				return 0, SAMerror{str: fmt.Sprintf("Alignment %s has a SEQ shorter than its CIGAR", a.Qname), Field: "SEQ"}
+			}
+			if r+op.Len > len(ref) {
+				return 0, SAMerror{str: fmt.Sprintf("Alignment %s extends past the end of the reference", a.Qname)}
+			}
+			for i := 0; i < op.Len; i++ {
+				rb, qb := upperBase(ref[r+i]), upperBase(a.Seq[q+i])
+				if qb == '=' || qb == rb && rb != 'N' {
+					matches++
+				}
+			}
+			length += op.Len
+		}
+		if op.ConsumesQuery() {
+			q += op.Len
+		}
+		if op.ConsumesReference() {
+			r += op.Len
+		}
+	}
+	if length == 0 {
+		return 0, SAMerror{str: fmt.Sprintf("Alignment %s has no aligned bases", a.Qname), Field: "CIGAR"}
+	}
+	return float64(matches) / float64(length), nil
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// MergeHeaders combines the headers of files that are to be merged.
+// Reference sequences are unioned by name, in the order they're first
+// seen; a name with different lengths or MD5s, or shared names in a
+// different order, makes the dictionaries incompatible.  Read groups
+// and programs are unioned by ID, and it's an error for two headers
+// to define the same ID differently.  Comments are concatenated.
+//
+// The @HD line is taken from the first header that has one, with the
+// sort order kept only if every header agrees on it.
+func MergeHeaders(headers ...*Header) (*Header, error) {
+	merged := &Header{}
+	refIndex := make(map[string]int)
+	rgs := make(map[string]*ReadGroup)
+	progs := make(map[string]*Program)
+	sortOrder, sortOrderSet := SortOrder(""), false
+
+	for _, h := range headers {
+		so := SortOrder("")
+		if h.HD != nil {
+			so = h.HD.SortOrder
+			if merged.HD == nil {
+				hd := *h.HD
+				merged.HD = &hd
+			}
+		}
+		if !sortOrderSet {
+			sortOrder, sortOrderSet = so, true
+		} else if so != sortOrder {
+			sortOrder = SortUnknown
+		}
+
+		last := -1
+		for _, rsd := range h.SQ {
+			i, ok := refIndex[rsd.Name]
+			if !ok {
+				i = len(merged.SQ)
+				refIndex[rsd.Name] = i
+				r := *rsd
+				merged.SQ = append(merged.SQ, &r)
+			} else {
+				prev := merged.SQ[i]
+				if prev.Length != rsd.Length {
+					return nil, SAMerror{str: fmt.Sprintf("Reference sequence %s has length %d in one header and %d in another", rsd.Name, prev.Length, rsd.Length), Field: "LN"}
+				}
+				if prev.MD5 != "" && rsd.MD5 != "" && prev.MD5 != rsd.MD5 {
+					return nil, SAMerror{str: fmt.Sprintf("Reference sequence %s has different MD5s in different headers", rsd.Name), Field: "M5"}
+				}
+				if prev.MD5 == "" {
+					prev.MD5 = rsd.MD5
+				}
+			}
+			if i < last {
+				return nil, SAMerror{str: fmt.Sprintf("Reference sequence %s is in a different order in different headers", rsd.Name), Field: "SN"}
+			}
+			last = i
+		}
+
+		for _, rg := range h.RG {
+			if prev, ok := rgs[rg.ID]; ok {
+				if !reflect.DeepEqual(prev, rg) {
+					return nil, SAMerror{str: fmt.Sprintf("Read group %s is defined differently in different headers", rg.ID), Field: "ID"}
+				}
+				continue
+			}
+			rgs[rg.ID] = rg
+			merged.RG = append(merged.RG, rg)
+		}
+
+		for _, prog := range h.PG {
+			if prev, ok := progs[prog.ID]; ok {
+				if !reflect.DeepEqual(prev, prog) {
+					return nil, SAMerror{str: fmt.Sprintf("Program %s is defined differently in different headers", prog.ID), Field: "ID"}
+				}
+				continue
+			}
+			progs[prog.ID] = prog
+			merged.PG = append(merged.PG, prog)
+		}
+
+		merged.CO = append(merged.CO, h.CO...)
+	}
+
+	if merged.HD != nil {
+		merged.HD.SortOrder = sortOrder
+	}
+	merged.indexRefs()
+	return merged, nil
+}
+
+// mergeItem is the next alignment from one of the inputs to Merge.
+type mergeItem struct {
+	a     *Alignment
+	ref   int // index in the merged @SQ lines; unmapped reads last
+	input int
+}
+
+// mergeHeap orders the next alignment of each input by reference and
+// position, and then by input, so that ties keep the input order.
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].ref != h[j].ref {
+		return h[i].ref < h[j].ref
+	}
+	if h[i].a.Pos != h[j].a.Pos {
+		return h[i].a.Pos < h[j].a.Pos
+	}
+	return h[i].input < h[j].input
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeItem)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// Merge writes the alignments of coordinate-sorted inputs to w as a
+// single coordinate-sorted SAM file, with a header made by
+// MergeHeaders. It's an error for an input not to be sorted in the
+// merged reference order.
+func Merge(w io.Writer, inputs ...*Reader) error {
+	headers := make([]*Header, len(inputs))
+	for i, sr := range inputs {
+		headers[i] = sr.Header
+	}
+	header, err := MergeHeaders(headers...)
+	if err != nil {
+		return err
+	}
+	setSortOrder(header, SortCoordinate)
+
+	refIndex := header.RefIndex()
+	// next reads the next alignment from input i, checking that it
+	// doesn't sort before the last one.
+	last := make([]mergeItem, len(inputs))
+	next := func(h *mergeHeap, i int) error {
+		a, err := inputs[i].Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		item := mergeItem{a: a, ref: len(header.SQ), input: i}
+		if a.RefName != "*" {
+			ref, ok := refIndex[a.RefName]
+			if !ok {
+				return SAMerror{str: fmt.Sprintf("Alignment %s has RNAME %s, which isn't in the reference dictionary", a.Qname, a.RefName), Field: "RNAME"}
+			}
+			item.ref = ref
+		}
+		if prev := last[i]; prev.a != nil && (item.ref < prev.ref || item.ref == prev.ref && a.Pos < prev.a.Pos) {
+			return SAMerror{str: fmt.Sprintf("Alignment %s is out of coordinate order in input %d", a.Qname, i+1)}
+		}
+		last[i] = item
+		heap.Push(h, item)
+		return nil
+	}
+
+	h := &mergeHeap{}
+	for i := range inputs {
+		if err := next(h, i); err != nil {
+			return err
+		}
+	}
+
+	sw, err := NewWriter(w, header)
+	if err != nil {
+		return err
+	}
+	for h.Len() > 0 {
+		item := heap.Pop(h).(mergeItem)
+		if err := sw.Write(item.a); err != nil {
+			return err
+		}
+		if err := next(h, item.input); err != nil {
+			return err
+		}
+	}
+	return sw.Close()
+}
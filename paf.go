@@ -0,0 +1,111 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"fmt"
+	"io"
+)
+
+// WritePAF writes a as a line of PAF, the pairwise mapping format of
+// minimap2, given the length refLen of its reference sequence. The
+// query length includes hard clipped bases, and the query interval,
+// after the clips, is given on the strand the read was sequenced on,
+// so for a reverse strand read it's counted from the clip at the end
+// of the CIGAR. The number of matching bases is the bases of =
+// operations if the CIGAR uses only = and X for aligned bases, or
+// else the alignment block length less NM. Without an NM tag, a CIGAR
+// mixing M with = and X counts only its = bases, since M bases may be
+// mismatches, and one with just M counts all its M bases, mismatches
+// included. The block length is the bases of M, =, X, I, and D
+// operations. Nothing is written for an unmapped read, and
+// it's an error for the CIGAR to be invalid or unavailable.
+func WritePAF(w io.Writer, a *Alignment, refLen uint32) error {
+	if !isPlaced(a) {
+		return nil
+	}
+	ops, err := a.CigarOps()
+	if err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		return SAMerror{str: "Alignment " + a.Qname + " has no CIGAR to write as PAF", Field: "CIGAR"}
+	}
+
+	var qlen, leading, trailing, refSpan, blockLen, mLen, eqLen int
+	exact := false
+	aligned := false // past the leading clips
+	for _, op := range ops {
+		switch op.Op {
+		case 'S', 'H':
+			qlen += op.Len
+			if aligned {
+				trailing += op.Len
+			} else {
+				leading += op.Len
+			}
+			continue
+		case 'M':
+			mLen += op.Len
+			blockLen += op.Len
+		case '=', 'X':
+			exact = true
+			if op.Op == '=' {
+				eqLen += op.Len
+			}
+			blockLen += op.Len
+		case 'I', 'D':
+			blockLen += op.Len
+		}
+		aligned = true
+		if op.ConsumesQuery() {
+			qlen += op.Len
+		}
+		if op.ConsumesReference() {
+			refSpan += op.Len
+		}
+	}
+
+	matches := mLen
+	if exact {
+		matches = eqLen
+	}
+	if of, ok := a.OptFields["NM"]; ok && (mLen > 0 || !exact) {
+		// NM counts mismatched and inserted or deleted bases, X
+		// ones included, so this also corrects the M bases of a
+		// mixed CIGAR
+		if nm, isInt := of.Value.(int64); isInt {
+			matches = blockLen - int(nm)
+			if matches < 0 {
+				matches = 0
+			}
+		}
+	}
+
+	qstart, qend := leading, qlen-trailing
+	strand := '+'
+	if a.IsReverse() {
+		qstart, qend = trailing, qlen-leading
+		strand = '-'
+	}
+	tstart := int(a.Pos) - 1
+	_, err = fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%c\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n",
+		a.Qname, qlen, qstart, qend, strand,
+		a.RefName, refLen, tstart, tstart+refSpan,
+		matches, blockLen, a.Mapq)
+	return err
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"fmt"
+	"io"
+)
+
+// nextPrimary returns the next alignment that isn't secondary or
+// supplementary.
+func (sr *Reader) nextPrimary() (*Alignment, error) {
+	for {
+		a, err := sr.Next()
+		if err != nil {
+			return a, err
+		}
+		if !a.IsSecondary() && !a.IsSupplementary() {
+			return a, nil
+		}
+	}
+}
+
+// singleton returns a read whose mate isn't in the file in the slot
+// for its segment.
+func singleton(a *Alignment) (*Alignment, *Alignment, error) {
+	if a.IsRead2() {
+		return nil, a, nil
+	}
+	return a, nil, nil
+}
+
+// NextPair returns the next template's read 1 and read 2, for input
+// sorted by query name. Secondary and supplementary alignments are
+// skipped. If a read's mate isn't in the file, or the read isn't
+// paired, its partner is returned as nil; an unpaired read is
+// returned in the read 1 slot.
+//
+// Query name order is checked as the reads go by, and an error is
+// returned if a name comes before the one preceding it, both in
+// samtools' natural order and in plain lexicographic order (used by
+// Picard). Input that isn't sorted may still go unnoticed if the mates
+// happen to be next to each other.
+func (sr *Reader) NextPair() (*Alignment, *Alignment, error) {
+	a, err := sr.nextPrimary()
+	if err != nil {
+		return nil, nil, err
+	}
+	if sr.lastQname != "" && strnumCmp(a.Qname, sr.lastQname) < 0 && a.Qname < sr.lastQname {
+		return nil, nil, SAMerror{str: fmt.Sprintf("Input isn't sorted by query name: %s follows %s", a.Qname, sr.lastQname)}
+	}
+	sr.lastQname = a.Qname
+	if !a.IsPaired() {
+		return a, nil, nil
+	}
+
+	b, err := sr.nextPrimary()
+	if err == io.EOF {
+		return singleton(a)
+	}
+	if err != nil {
+		// Keep a, so that the caller can carry on past the bad record
+		sr.pending = a
+		return nil, nil, err
+	}
+	if b.Qname != a.Qname {
+		sr.pending = b
+		return singleton(a)
+	}
+	if a.IsRead1() == b.IsRead1() || a.IsRead2() == b.IsRead2() {
+		return nil, nil, SAMerror{str: fmt.Sprintf("Template %s doesn't have one primary read 1 and one primary read 2", a.Qname)}
+	}
+	if a.IsRead2() {
+		return b, a, nil
+	}
+	return a, b, nil
+}
+
+// MateRefName returns the name of the reference the next read in the
+// template is aligned to, resolving the "=" abbreviation in RNEXT to
+// RefName. It returns "" if the mate's reference is unavailable ("*").
+func (a *Alignment) MateRefName() string {
+	name := a.NextRef
+	if name == "=" {
+		name = a.RefName
+	}
+	if name == "*" {
+		return ""
+	}
+	return name
+}
+
+// ComputeTemplateLen returns the observed template length of the pair
+// r1 and r2, as it should appear in r1's TLEN: the distance from the
+// leftmost mapped base of either read to the rightmost, positive if r1
+// is the leftmost read and negative if r2 is. If both start at the same
+// position, r1 is taken to be leftmost. It returns 0 if either read is
+// unmapped, or they're on different references. r2's TLEN is the
+// negation of r1's.
+func ComputeTemplateLen(r1, r2 *Alignment) int32 {
+	if !isPlaced(r1) || !isPlaced(r2) || r1.RefName != r2.RefName {
+		return 0
+	}
+	left, right := r1.Start(), r1.linearEnd()
+	if start := r2.Start(); start < left {
+		left = start
+	}
+	if end := r2.linearEnd(); end > right {
+		right = end
+	}
+	tlen := int32(right - left + 1)
+	if r2.Start() < r1.Start() {
+		return -tlen
+	}
+	return tlen
+}
+
+// isPlaced reports whether a is mapped to a position on a reference.
+func isPlaced(a *Alignment) bool {
+	return !a.IsUnmapped() && a.RefName != "*" && a.Pos != 0
+}
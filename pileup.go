@@ -0,0 +1,114 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import "sort"
+
+// PileupRead is one read's contribution to a PileupColumn.
+type PileupRead struct {
+	Alignment *Alignment
+	QueryPos  int  // 0-based index into SEQ, or -1 in a deletion
+	Base      byte // the base from SEQ, 'N' if there's no SEQ, or '*' in a deletion
+	Qual      byte // the Phred quality, or 0xff without QUAL or in a deletion
+	Reverse   bool
+	IsDel     bool // the read has a deletion at this position
+
+	// Indel is the length of an insertion (positive) or deletion
+	// (negative) that follows this position, as in samtools, and
+	// Inserted is the inserted bases.
+	Indel    int
+	Inserted string
+}
+
+// PileupColumn holds the reads covering one reference position.
+type PileupColumn struct {
+	Pos   uint32 // 1-based
+	Depth int    // len(Reads), which counts deletions
+	Reads []PileupRead
+}
+
+// Pileup returns a column for each position in the region start to end
+// (1-based, inclusive) of reference ref that some read covers, in
+// order. Reads are taken in the order given, and columns are built
+// from AlignedPairs, so reads with an invalid CIGAR are left out, as
+// are unmapped reads. Bases in skipped regions don't count.
+func Pileup(alignments []*Alignment, ref string, start, end uint32) []PileupColumn {
+	if start < 1 || end < start {
+		return nil
+	}
+	// Columns are made only for covered positions, since the region
+	// may be far larger than the reads in it
+	var cols []PileupColumn
+	index := map[uint32]int{} // position to index in cols
+	for _, a := range alignments {
+		if a.IsUnmapped() || a.RefName != ref || a.Pos == 0 || a.Pos > end {
+			continue
+		}
+		pairs := a.AlignedPairs()
+		for i, p := range pairs {
+			if p.RefPos < int(start) || p.RefPos > int(end) || p.Op == 'N' {
+				continue
+			}
+			pr := PileupRead{
+				Alignment: a,
+				QueryPos:  p.QueryPos,
+				Base:      '*',
+				Qual:      0xff,
+				Reverse:   a.IsReverse(),
+				IsDel:     p.QueryPos < 0,
+			}
+			if !pr.IsDel {
+				pr.Base = 'N'
+				if a.Seq != "*" && p.QueryPos < len(a.Seq) {
+					pr.Base = a.Seq[p.QueryPos]
+				}
+				if a.Qual != "*" && p.QueryPos < len(a.Qual) {
+					pr.Qual = a.Qual[p.QueryPos] - 33
+				}
+			}
+			j := i + 1
+			for j < len(pairs) && pairs[j].Op == 'I' {
+				j++
+			}
+			if n := j - i - 1; n > 0 {
+				pr.Indel = n
+				if a.Seq != "*" && pairs[j-1].QueryPos < len(a.Seq) {
+					pr.Inserted = a.Seq[pairs[i+1].QueryPos : pairs[j-1].QueryPos+1]
+				}
+			} else if !pr.IsDel {
+				for j < len(pairs) && pairs[j].Op == 'D' {
+					j++
+				}
+				pr.Indel = -(j - i - 1)
+			}
+			pos := uint32(p.RefPos)
+			k, ok := index[pos]
+			if !ok {
+				k = len(cols)
+				index[pos] = k
+				cols = append(cols, PileupColumn{Pos: pos})
+			}
+			cols[k].Reads = append(cols[k].Reads, pr)
+		}
+	}
+
+	sort.Slice(cols, func(i, j int) bool { return cols[i].Pos < cols[j].Pos })
+	for i := range cols {
+		cols[i].Depth = len(cols[i].Reads)
+	}
+	return cols
+}
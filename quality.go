@@ -0,0 +1,88 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"fmt"
+)
+
+// QualScores returns the Phred quality score of each base. It's empty
+// if QUAL is "*". Characters outside the printable range give
+// meaningless scores; use DecodeQual to check for them.
+func (a *Alignment) QualScores() []uint8 {
+	if a.Qual == "*" {
+		return []uint8{}
+	}
+	scores := make([]uint8, len(a.Qual))
+	for i := 0; i < len(a.Qual); i++ {
+		scores[i] = a.Qual[i] - 33
+	}
+	return scores
+}
+
+// DecodeQual is like QualScores, but returns an error if QUAL has a
+// character outside the printable range '!' to '~'.
+func (a *Alignment) DecodeQual() ([]uint8, error) {
+	if a.Qual == "*" {
+		return []uint8{}, nil
+	}
+	scores := make([]uint8, len(a.Qual))
+	for i := 0; i < len(a.Qual); i++ {
+		c := a.Qual[i]
+		if c < '!' || c > '~' {
+			return nil, SAMerror{str: fmt.Sprintf("Invalid quality character %q at position %d of alignment %s", c, i+1, a.Qname)}
+		}
+		scores[i] = c - 33
+	}
+	return scores, nil
+}
+
+// MeanQuality returns the mean of the base quality scores, or 0 if
+// QUAL is "*".
+func (a *Alignment) MeanQuality() float64 {
+	scores := a.QualScores()
+	if len(scores) == 0 {
+		return 0
+	}
+	var sum int
+	for _, q := range scores {
+		sum += int(q)
+	}
+	return float64(sum) / float64(len(scores))
+}
+
+// maxQual is the highest Phred score QUAL can hold, '~' - 33.
+const maxQual = '~' - 33
+
+// RemapQuality rewrites QUAL in place, replacing the score q of the
+// base at each 0-based position pos with f(pos, q), e.g. to bin scores
+// into fewer levels. Scores above 93, the most QUAL can hold, are
+// clamped to 93. Nothing is done if QUAL is "*".
+func (a *Alignment) RemapQuality(f func(pos int, q uint8) uint8) {
+	if a.Qual == "*" {
+		return
+	}
+	qual := make([]byte, len(a.Qual))
+	for i := 0; i < len(a.Qual); i++ {
+		q := f(i, a.Qual[i]-33)
+		if q > maxQual {
+			q = maxQual
+		}
+		qual[i] = q + 33
+	}
+	a.Qual = string(qual)
+}
@@ -0,0 +1,267 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+// Reference sequences: checksums, fetching, and dictionaries.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultFetchTimeout is how long FetchReference waits for a network
+// fetch.
+const DefaultFetchTimeout = 5 * time.Minute
+
+// refMD5 returns the M5 checksum of seq, which is the MD5 of the
+// sequence uppercased, with whitespace and other characters outside
+// '!'-'~' removed.
+func refMD5(seq []byte) string {
+	h := md5.New()
+	buf := make([]byte, 0, 4096)
+	for _, c := range seq {
+		if c < '!' || c > '~' {
+			continue
+		}
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		buf = append(buf, c)
+		if len(buf) == cap(buf) {
+			h.Write(buf)
+			buf = buf[:0]
+		}
+	}
+	h.Write(buf)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ValidateRefMD5 checks that seq, the reference sequence as read from
+// a FASTA file, matches the M5 tag of rsd.  A sequence without an M5
+// tag has nothing to check against and is valid.
+func ValidateRefMD5(rsd *RefSeqDict, seq []byte) (bool, error) {
+	if rsd.MD5 == "" {
+		return true, nil
+	}
+	if sum := refMD5(seq); !strings.EqualFold(sum, rsd.MD5) {
+		return false, SAMerror{str: fmt.Sprintf("Reference sequence %s has MD5 %s, but M5 is %s", rsd.Name, sum, rsd.MD5), Field: "M5"}
+	}
+	return true, nil
+}
+
+// SetMD5 sets the M5 tag of rsd to the checksum of seq, the reference
+// sequence as read from a FASTA file.
+func (rsd *RefSeqDict) SetMD5(seq []byte) {
+	rsd.MD5 = refMD5(seq)
+}
+
+// FetchReference reads the sequence named by the UR tag of rsd, as
+// FetchReferenceContext does with a background context and the
+// default timeout.
+func (rsd *RefSeqDict) FetchReference() ([]byte, error) {
+	return rsd.FetchReferenceContext(context.Background(), 0)
+}
+
+// FetchReferenceContext reads the sequence named by the UR tag of
+// rsd. The URI may be a file: or http(s): URL, or, as the SAM
+// specification allows, a plain path. The file may be gzip or BGZF
+// compressed. If it's FASTA, the sequence is the record named by SN,
+// or the only record if there's just one, with line breaks removed;
+// otherwise it's the whole file.
+//
+// Network fetches give up after timeout, or DefaultFetchTimeout if
+// timeout is 0, or when ctx is done.
+func (rsd *RefSeqDict) FetchReferenceContext(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	if rsd.URI == "" {
+		return nil, SAMerror{str: fmt.Sprintf("Reference sequence %s has no UR tag", rsd.Name), Field: "UR"}
+	}
+	u, err := url.Parse(rsd.URI)
+	if err != nil {
+		return nil, SAMerror{str: fmt.Sprintf("Reference sequence %s has invalid UR %q: %v", rsd.Name, rsd.URI, err), Field: "UR"}
+	}
+
+	var data []byte
+	switch u.Scheme {
+	case "", "file":
+		path := rsd.URI
+		if u.Scheme == "file" {
+			path = u.Path
+			if path == "" {
+				path = u.Opaque
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err = os.ReadFile(path)
+	case "http", "https":
+		data, err = fetchURL(ctx, rsd.URI, timeout)
+	default:
+		return nil, SAMerror{str: fmt.Sprintf("Reference sequence %s has UR %s, with unsupported scheme %s", rsd.Name, rsd.URI, u.Scheme), Field: "UR"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = io.ReadAll(zr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) == 0 || data[0] != '>' {
+		return data, nil
+	}
+	return fastaRecord(data, rsd.Name)
+}
+
+// fetchURL gets the contents of an http(s) URL.
+func fetchURL(ctx context.Context, uri string, timeout time.Duration) ([]byte, error) {
+	if timeout == 0 {
+		timeout = DefaultFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, SAMerror{str: fmt.Sprintf("Fetching %s: %s", uri, resp.Status), Field: "UR"}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fastaRecord returns the sequence of the FASTA record called name in
+// data, or of the only record if there's just one.
+func fastaRecord(data []byte, name string) ([]byte, error) {
+	var names []string
+	var seqs []*bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(make([]byte, 64*1024), len(data)+1)
+	for s.Scan() {
+		line := bytes.TrimRight(s.Bytes(), "\r")
+		if len(line) > 0 && line[0] == '>' {
+			fields := strings.Fields(string(line[1:]))
+			if len(fields) == 0 {
+				fields = []string{""}
+			}
+			names = append(names, fields[0])
+			seqs = append(seqs, &bytes.Buffer{})
+			continue
+		}
+		if len(seqs) > 0 {
+			seqs[len(seqs)-1].Write(line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	for i, n := range names {
+		if n == name {
+			return seqs[i].Bytes(), nil
+		}
+	}
+	if len(seqs) == 1 {
+		return seqs[0].Bytes(), nil
+	}
+	return nil, SAMerror{str: fmt.Sprintf("Reference sequence %s isn't in the FASTA file", name), Field: "SN"}
+}
+
+// LoadSequenceDictionary reads a reference sequence dictionary from
+// path, which is either a samtools .fai index, giving the name and
+// length of each sequence, or a Picard .dict file, which holds the @SQ
+// lines of a SAM header, with their M5 and UR if they were recorded.
+// Which one it is is told from the content, since .dict files start
+// with a header line. The entries are validated as they would be in a
+// SAM header.
+func LoadSequenceDictionary(path string) ([]*RefSeqDict, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var dict []*RefSeqDict
+	names := newHeaderNames()
+	isDict, started := false, false
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSuffix(s.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		if !started {
+			isDict, started = text[0] == '@', true
+		}
+		rsd, err := parseDictLine(text, isDict)
+		if err == nil && rsd != nil {
+			if valid, verr := validateRefSeqDict(rsd); !valid {
+				err = verr
+			} else {
+				err = names.addRefSeq(rsd)
+			}
+		}
+		if err != nil {
+			if se, ok := err.(SAMerror); ok {
+				se.Line = line
+				err = se
+			}
+			return dict, err
+		}
+		if rsd != nil {
+			dict = append(dict, rsd)
+		}
+	}
+	return dict, s.Err()
+}
+
+// parseDictLine parses a line of a .dict file, if isDict, or else of a
+// .fai index. It returns nil for header lines other than @SQ.
+func parseDictLine(text string, isDict bool) (*RefSeqDict, error) {
+	if isDict {
+		if !strings.HasPrefix(text, "@SQ\t") {
+			return nil, nil
+		}
+		return parseRefSeqDict(text)
+	}
+	e, err := parseFAILine(text)
+	if err != nil {
+		return nil, err
+	}
+	return &RefSeqDict{Name: e.name, Length: e.length}, nil
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Renaming reference sequences, to reconcile files aligned to the
+// same assembly under different naming schemes, such as UCSC's chr1
+// and Ensembl's 1, and moving alignments along them.
+
+// isChromosomeName reports whether name, less any "chr" prefix, is
+// the name of a chromosome rather than some other contig: a number,
+// or X, Y, W, Z, M, or MT.
+func isChromosomeName(name string) bool {
+	name = strings.TrimPrefix(name, "chr")
+	switch name {
+	case "":
+		return false
+	case "X", "Y", "W", "Z", "M", "MT":
+		return true
+	}
+	for i := 0; i < len(name); i++ {
+		if !isDigit(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeChromosomes renames the chromosomes in the @SQ lines to
+// the UCSC style, chr1 and so on, if addChr, or else to the Ensembl
+// style, 1 and so on. The mitochondrial chromosome is chrM in one and
+// MT in the other. Other contigs, whose names differ in more than a
+// prefix, keep their names. It returns the renaming done, from old
+// name to new, to be applied to the alignments with RenameRef. The
+// header is left as it was if a new name would be invalid or would
+// duplicate another reference's.
+func (h *Header) NormalizeChromosomes(addChr bool) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, rsd := range h.SQ {
+		if !isChromosomeName(rsd.Name) {
+			continue
+		}
+		name := strings.TrimPrefix(rsd.Name, "chr")
+		if addChr {
+			if name == "MT" {
+				name = "M"
+			}
+			name = "chr" + name
+		} else if name == "M" {
+			name = "MT"
+		}
+		if name != rsd.Name {
+			mapping[rsd.Name] = name
+		}
+	}
+	if err := h.RenameRefs(mapping); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// RenameRefs renames the reference sequences in the @SQ lines
+// according to mapping, from old name to new. Names not in mapping
+// are kept. A reference renamed to one of its alternative names, from
+// its AN tag, has that alternative replaced by its old name. The
+// header is left as it was if a new name would be invalid or would
+// duplicate another reference's.
+func (h *Header) RenameRefs(mapping map[string]string) error {
+	names := newHeaderNames()
+	for _, rsd := range h.SQ {
+		renamed := *rsd
+		if name, ok := mapping[rsd.Name]; ok {
+			if !refNameRE.MatchString(name) {
+				return SAMerror{str: fmt.Sprintf("Invalid reference sequence name %q for %s", name, rsd.Name), Field: "SN"}
+			}
+			renamed.Name, renamed.AltNames = name, swapAltName(rsd, name)
+		}
+		if err := names.addRefSeq(&renamed); err != nil {
+			return err
+		}
+	}
+	for _, rsd := range h.SQ {
+		if name, ok := mapping[rsd.Name]; ok {
+			rsd.Name, rsd.AltNames = name, swapAltName(rsd, name)
+		}
+	}
+	h.indexRefs()
+	return nil
+}
+
+// swapAltName returns the alternative names of rsd for it being
+// renamed to name: with name replaced by the current name if it's one
+// of them.
+func swapAltName(rsd *RefSeqDict, name string) []string {
+	for i, alt := range rsd.AltNames {
+		if alt == name {
+			alts := append([]string(nil), rsd.AltNames...)
+			alts[i] = rsd.Name
+			return alts
+		}
+	}
+	return rsd.AltNames
+}
+
+// RenameRef renames the reference sequences a refers to according to
+// mapping, from old name to new, as given by NormalizeChromosomes:
+// those of RNAME and RNEXT, and of the other alignments listed in its
+// SA tag. Names not in mapping are kept. a is left as it was if a new
+// name is invalid.
+func (a *Alignment) RenameRef(mapping map[string]string) error {
+	for _, name := range []string{a.RefName, a.NextRef} {
+		if to, ok := mapping[name]; ok && !refNameRE.MatchString(to) {
+			return SAMerror{str: fmt.Sprintf("Invalid reference sequence name %q for %s", to, name), Field: "RNAME"}
+		}
+	}
+	of, hasSA := a.OptFields["SA"]
+	sa, _ := of.Value.(string)
+	hasSA = hasSA && of.Type == 'Z' && sa != ""
+	var segs []string
+	if hasSA {
+		segs = strings.Split(sa, ";")
+		for i, seg := range segs {
+			name, rest, found := strings.Cut(seg, ",")
+			to, ok := mapping[name]
+			if !found || !ok {
+				continue
+			}
+			if !refNameRE.MatchString(to) {
+				return SAMerror{str: fmt.Sprintf("Invalid reference sequence name %q for %s", to, name), Field: "SA"}
+			}
+			segs[i] = to + "," + rest
+		}
+	}
+
+	if to, ok := mapping[a.RefName]; ok {
+		a.RefName = to
+	}
+	if to, ok := mapping[a.NextRef]; ok {
+		a.NextRef = to
+	}
+	if hasSA {
+		of.Value = strings.Join(segs, ";")
+		a.OptFields["SA"] = of
+	}
+	return nil
+}
+
+// Shift moves the alignment, and its mate's position, delta bases
+// along the reference, e.g. to map alignments to a reference made by
+// joining contigs together back to the original contigs, given each
+// one's offset. POS and PNEXT are shifted only if they're set, not 0.
+// It's an error for either to end up outside 1 to 2^31-1, the range
+// the spec allows, in which case a is left as it was.
+func (a *Alignment) Shift(delta int64) error {
+	pos, err := shiftPos(a.Pos, delta, "POS", a.Qname)
+	if err != nil {
+		return err
+	}
+	nextPos, err := shiftPos(a.NextPos, delta, "PNEXT", a.Qname)
+	if err != nil {
+		return err
+	}
+	a.Pos, a.NextPos = pos, nextPos
+	return nil
+}
+
+func shiftPos(pos uint32, delta int64, field, qname string) (uint32, error) {
+	if pos == 0 {
+		return 0, nil
+	}
+	p := int64(pos) + delta
+	if p < 1 || p > maxCoord {
+		return 0, SAMerror{str: fmt.Sprintf("Shifting %s %d by %d in alignment %s puts it out of range", field, pos, delta, qname), Field: field, err: ErrOutOfRange}
+	}
+	return uint32(p), nil
+}
@@ -17,105 +17,222 @@
 package goSAM
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"bufio"
 	"strings"
 	"strconv"
 	"container/list"
 	"regexp"
+	"time"
+)
+
+// Validation patterns are compiled once here, since the alignment
+// patterns are matched against every line of the file.
+var (
+	versionRE = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+	subSortRE = regexp.MustCompile(`^(coordinate|queryname|unsorted)(:[A-Za-z0-9_-]+)+$`)
+	refNameRE = regexp.MustCompile(`^[!-)+-<>-~][!-~]*$`)
+	flowOrderRE = regexp.MustCompile(`^(\*|[ACMGRSVTWYHKDBN]+)$`)
+	qnameRE = regexp.MustCompile(`^(\*|[!-?A-~]{1,254})$`)
+	rnameRE = regexp.MustCompile(`^(\*|[!-()+-<>-~][!-~]*)$`)
+	cigarRE = regexp.MustCompile(`^(\*|([0-9]+[MIDNSHPX=])+)$`)
+	nextRefRE = regexp.MustCompile(`^(\*|=|[!-()+-<>-~][!-~]*)$`)
+	seqRE = regexp.MustCompile(`^(\*|[A-Za-z=.]+)$`)
+	qualRE = regexp.MustCompile(`^(\*|[!-~]+)$`)
+	optTagRE = regexp.MustCompile("^[A-Za-z][A-Za-z0-9]$")
 )
 
 type HeaderLine struct {
 	Version string // VN | /^[0-9]+\.[0-9]+$/ | required
-	SortOrder string // SO | unknown, unsorted, queryname, coordinate | optional
+	SortOrder SortOrder // SO | unknown, unsorted, queryname, coordinate | optional
+	Grouping string // GO | none, query, reference | optional
+	SubSort string // SS | (coordinate|queryname|unsorted)(:[A-Za-z0-9_-]+)+ | optional
+	Other map[string]string // non-standard tags
+}
+
+// SortOrder is the sort order given by the SO tag of the @HD line. An
+// empty SortOrder means there's no SO tag.
+type SortOrder string
+
+const (
+	SortUnknown SortOrder = "unknown"
+	SortUnsorted SortOrder = "unsorted"
+	SortQueryName SortOrder = "queryname"
+	SortCoordinate SortOrder = "coordinate"
+)
+
+func (so SortOrder) String() string {
+	return string(so)
+}
+
+// Valid reports whether so is one of the sort orders the SAM
+// specification allows.
+func (so SortOrder) Valid() bool {
+	switch so {
+	case SortUnknown, SortUnsorted, SortQueryName, SortCoordinate:
+		return true
+	}
+	return false
 }
 
 func validateHeader(hl *HeaderLine) (bool, error) {
-	m, _ := regexp.Match("^[0-9]+.[0-9]+$", []byte(hl.Version))
+	m := versionRE.MatchString(hl.Version)
 	if !m {
-		return m, SAMerror{"Invalid version in SAM Header"}
+		return m, SAMerror{str: "Invalid version in SAM Header", Field: "VN", err: ErrInvalidVersion}
 	} 
+	if hl.SortOrder != "" && !hl.SortOrder.Valid() {
+		return false, SAMerror{str: fmt.Sprintf("Invalid sort order %q in SAM Header", hl.SortOrder), Field: "SO"}
+	}
+	switch hl.Grouping {
+	case "", "none", "query", "reference":
+	default:
+		return false, SAMerror{str: fmt.Sprintf("Invalid grouping %q in SAM Header", hl.Grouping), Field: "GO"}
+	}
+	if hl.SubSort != "" {
+		if !subSortRE.MatchString(hl.SubSort) {
+			return false, SAMerror{str: fmt.Sprintf("Invalid sub-sort order %q in SAM Header", hl.SubSort), Field: "SS"}
+		}
+		// The sub-sort refines the sort order, so they have to agree
+		so := SortOrder(hl.SubSort[:strings.IndexByte(hl.SubSort, ':')])
+		if hl.SortOrder != "" && hl.SortOrder != so {
+			return false, SAMerror{str: fmt.Sprintf("Sub-sort order %q doesn't match sort order %s in SAM Header", hl.SubSort, hl.SortOrder), Field: "SS"}
+		}
+	}
 	return m, nil
 
 }
 
+// splitTag splits a header TAG:VALUE field. Only the first colon
+// separates, since values such as UR and CL may contain colons.
+func splitTag(tv string) (string, string, error) {
+	tva := strings.SplitN(tv, ":", 2)
+	if len(tva) != 2 {
+		return "", "", SAMerror{str: fmt.Sprintf("Malformed header field %q", tv)}
+	}
+	return tva[0], tva[1], nil
+}
+
 var hlParseMap = map[string]func(string, *HeaderLine) {
 	"VN": func(val string, hl *HeaderLine) {hl.Version = val},
-	"SO": func(val string, hl *HeaderLine) {hl.SortOrder = val},
+	"SO": func(val string, hl *HeaderLine) {hl.SortOrder = SortOrder(val)},
+	"GO": func(val string, hl *HeaderLine) {hl.Grouping = val},
+	"SS": func(val string, hl *HeaderLine) {hl.SubSort = val},
 }
 
-func parseHeader(line string) *HeaderLine {
+func parseHeader(line string) (*HeaderLine, error) {
 	tvs := strings.Split(line, "\t")
 	hl := HeaderLine{}
 	for _,tv := range tvs[1:] {
-		tva := strings.Split(tv,":")
-		tag := tva[0]
-		val := tva[1]
+		tag, val, err := splitTag(tv)
+		if err != nil {
+			return nil, err
+		}
 		parseFunc := hlParseMap[tag]
 		if parseFunc != nil {
 			parseFunc(val, &hl)
-		} // FIXME: catch and collect non-std tags?
+		} else {
+			if hl.Other == nil {
+				hl.Other = map[string]string{}
+			}
+			hl.Other[tag] = val
+		}
 	}
-	return &hl
+	return &hl, nil
 }
 
+// The values of the TP tag of an @SQ line
+const (
+	TopologyLinear = "linear"
+	TopologyCircular = "circular"
+)
+
 // Order of SQ lines defines the alignment sorting order
 type RefSeqDict struct {
 	Name string // SN | [!-)+-<>-~][!-~]*  | required | unique
-	Length uint32 // LN | Range: [1, 2^29 -1] | required
+	Length uint32 // LN | Range: [1, 2^31 -1] | required
 	AssemblyID string // AS | optional
 	MD5 string // M5 | optional
 	Species string // SP | optional
 	URI string // || UR | optional | use URL type?
+	AltNames []string // AN | comma-separated, each like SN | optional | unique, with SN
+	Topology string // TP | linear or circular | optional
 }
 
 func validateRefSeqDict(rsd *RefSeqDict) (bool, error) {
-	m , _ := regexp.Match("[!-)+-<>-~][!-~]*", []byte(rsd.Name))
+	m := refNameRE.MatchString(rsd.Name)
 	if !m {
-		return false, SAMerror{"Invalid reference sequence name"}
+		return false, SAMerror{str: "Invalid reference sequence name", Field: "SN"}
 	}
 
-	return ((rsd.Length >= 1) && (rsd.Length <= 0x1FFFFFFF)), nil
+	if rsd.Length < 1 || rsd.Length > maxCoord {
+		return false, SAMerror{str: "Reference sequence length out of valid range", Field: "LN", err: ErrOutOfRange}
+	}
+	for _, alt := range rsd.AltNames {
+		if !refNameRE.MatchString(alt) {
+			return false, SAMerror{str: fmt.Sprintf("Invalid alternative name %q for reference sequence %s", alt, rsd.Name), Field: "AN"}
+		}
+	}
+	if rsd.Topology != "" && rsd.Topology != TopologyLinear && rsd.Topology != TopologyCircular {
+		return false, SAMerror{str: fmt.Sprintf("Invalid topology %q for reference sequence %s", rsd.Topology, rsd.Name), Field: "TP"}
+	}
+	return true, nil
 }
 
-func parseRefSeqDict(line string) *RefSeqDict {
+func parseRefSeqDict(line string) (*RefSeqDict, error) {
 	tvs := strings.Split(line, "\t")
 	rsd := RefSeqDict{}
 	for _,tv := range tvs[1:] {
-		tva := strings.Split(tv,":")
-		switch tag := tva[0]; tag {
+		tag, val, err := splitTag(tv)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
 		case "SN":
-			rsd.Name = tva[1]
+			rsd.Name = val
 		case "LN":
-			v, _ := strconv.Atoi(tva[1])
+			v, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return nil, SAMerror{str: fmt.Sprintf("Invalid LN %q for reference sequence %s", val, rsd.Name), Field: "LN"}
+			}
 			rsd.Length = uint32(v)
 		case "AS":
-			rsd.AssemblyID = tva[1]
+			rsd.AssemblyID = val
 		case "M5":
-			rsd.MD5 = tva[1]
+			rsd.MD5 = val
 		case "SP":
-			rsd.Species = tva[1]
+			rsd.Species = val
 		case "UR":
-			rsd.URI = tva[1]
+			rsd.URI = val
+		case "AN":
+			rsd.AltNames = strings.Split(val, ",")
+		case "TP":
+			rsd.Topology = val
 		}
 	}
-	return &rsd
+	return &rsd, nil
 }
 
 type ReadGroup struct {
 	ID string // ID | unique | required
 	SeqCenter string // CN | optional 
 	Description string // DS | optional
-	Date string // DT | optional
+	Date string // DT | ISO8601 date or date-time | optional
+	DateParsed time.Time // Date, parsed; zero if absent or invalid
 	FlowOrder string // FO | /\*|[ACMGRSVTWYHKDBN]+/ | optional
 	KeySeq string // KS | optional
 	Lib string // LB | optional
 	Programs string // PG | optional
-	PMIS string // PI | optional | predicted median insert size
+	PMIS string // PI | integer | optional | predicted median insert size
+	PMISValue int // PMIS, parsed; 0 if absent or invalid
 	Platform string // PL | CAPILLARY LS454 ILLUMINA SOLID HELICOS IONTORRENT PACBIO | optional
 	Unit string // PU | Unique | optional
 	Sample string // SM | optional
+	Other map[string]string // non-standard tags
 }
 
 // The usefulness of checking platforms seems dubious to me. What
@@ -131,280 +248,1311 @@ var validPlatforms = map[string]bool{
 	"PACBIO": true,
 }
 
-// FIXME: make sure ID is unique
 func validateReadGroup (rg *ReadGroup) (bool, error) {
 	m := true
 	// FlowOrder is optional, so we have to check it's existence
 	// first, though I guess I could just include the empty string as
 	// an alternative in the match.
 	if rg.FlowOrder != "" {
-		m, _ = regexp.Match("*|[ACMGRSVTWYHKDBN]+",[]byte(rg.FlowOrder))
+		m = flowOrderRE.MatchString(rg.FlowOrder)
 		if !m {
-			return false, SAMerror{"Invalid flow order in read group"}
+			return false, SAMerror{str: "Invalid flow order in read group", Field: "FO"}
 		}
 	}
 	if rg.Platform != "" {
 		m = validPlatforms[rg.Platform]
-		if !m {return false, SAMerror{"Invalid platform in read group"}}
+		if !m {return false, SAMerror{str: "Invalid platform in read group", Field: "PL"}}
+	}
+	if rg.Date != "" {
+		if _, err := parseDate(rg.Date); err != nil {
+			return false, SAMerror{str: "Invalid date in read group: " + rg.Date, Field: "DT"}
+		}
+	}
+	// Checked last, since without the Strict option the reader lets
+	// this error pass
+	if rg.PMIS != "" {
+		if _, err := strconv.Atoi(rg.PMIS); err != nil {
+			return false, SAMerror{str: "Non-integer predicted median insert size in read group: " + rg.PMIS, Field: "PI"}
+		}
 	}
 	return true, nil
 }
 
+// dateLayouts are the ISO8601 forms accepted for the DT tag: a date,
+// or a date and time, with or without seconds and a time zone. The
+// time may have fractional seconds, which time.Parse allows without
+// their being in the layout.
+var dateLayouts = []string{
+	"2006-01-02",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04Z0700",
+	"2006-01-02T15:04",
+}
+
+// parseDate parses a DT value. Times without a zone are taken as UTC.
+func parseDate(s string) (time.Time, error) {
+	var err error
+	for _, layout := range dateLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
 var rgParseMap = map[string]func(string, *ReadGroup) {
 	"ID": func(s string, rg *ReadGroup) {rg.ID = s},
 	"CN": func(s string, rg *ReadGroup) {rg.SeqCenter = s},
 	"DS": func(s string, rg *ReadGroup) {rg.Description = s},
-	"DT": func(s string, rg *ReadGroup) {rg.Date = s},
+	"DT": func(s string, rg *ReadGroup) {rg.Date = s; rg.DateParsed, _ = parseDate(s)},
 	"FO": func(s string, rg *ReadGroup) {rg.FlowOrder = s},
 	"KS": func(s string, rg *ReadGroup) {rg.KeySeq = s},
 	"LB": func(s string, rg *ReadGroup) {rg.Lib = s},
 	"PG": func(s string, rg *ReadGroup) {rg.Programs = s},
-	"PI": func(s string, rg *ReadGroup) {rg.PMIS = s},
+	"PI": func(s string, rg *ReadGroup) {rg.PMIS = s; rg.PMISValue, _ = strconv.Atoi(s)},
 	"PL": func(s string, rg *ReadGroup) {rg.Platform = s},
 	"PU": func(s string, rg *ReadGroup) {rg.Unit = s},
 	"SM": func(s string, rg *ReadGroup) {rg.Sample = s},
 }
 
-func parseReadGroup(line string) *ReadGroup {
+func parseReadGroup(line string) (*ReadGroup, error) {
 	tvs := strings.Split(line, "\t")
 	rg := ReadGroup{}
 	for _,tv := range tvs[1:] {
-		tva := strings.Split(tv,":")
-		tag := tva[0]
-		val := tva[1]
+		tag, val, err := splitTag(tv)
+		if err != nil {
+			return nil, err
+		}
 		parseFunc := rgParseMap[tag]
 		if parseFunc != nil {
 			parseFunc(val, &rg)
-		} // FIXME: catch and collect non-std tags?
+		} else {
+			if rg.Other == nil {
+				rg.Other = map[string]string{}
+			}
+			rg.Other[tag] = val
+		}
 	}
-	return &rg
+	return &rg, nil
 }
 
 type Program struct {
 	ID string // ID | unique | required
 	Name string // PN | optional
+	Version string // VN | optional
 	CmdLine string // CL | optional
 	PrevID string // PP | must match another PG line ID | optional
+	Other map[string]string // non-standard tags
 }
 
 func validateProgram(prog *Program) (bool, error) {
-	if prog.ID == "" {return false, SAMerror{"Program ID is required"}}
+	if prog.ID == "" {return false, SAMerror{str: "Program ID is required", Field: "ID"}}
 	return true, nil
 }
 
+// ValidatePrograms checks the PP links between @PG lines: each PrevID
+// must be the ID of another program, and following the links must
+// not lead in a circle.
+func ValidatePrograms(progs []*Program) error {
+	byID := make(map[string]*Program, len(progs))
+	for _, prog := range progs {
+		byID[prog.ID] = prog
+	}
+	for _, prog := range progs {
+		if prog.PrevID != "" && byID[prog.PrevID] == nil {
+			return SAMerror{str: fmt.Sprintf("Program %s has PP %s, which doesn't match any program ID", prog.ID, prog.PrevID), Field: "PP"}
+		}
+	}
+	for _, prog := range progs {
+		seen := map[string]bool{}
+		for p := prog; p.PrevID != ""; p = byID[p.PrevID] {
+			if seen[p.ID] {
+				return SAMerror{str: fmt.Sprintf("Program %s is part of a PP cycle", prog.ID), Field: "PP"}
+			}
+			seen[p.ID] = true
+		}
+	}
+	return nil
+}
+
 var programParseMap = map[string]func(string, *Program) {
 	"ID": func(s string, prog *Program) {prog.ID = s},
 	"PN": func(s string, prog *Program) {prog.Name = s},
+	"VN": func(s string, prog *Program) {prog.Version = s},
 	"CL": func(s string, prog *Program) {prog.CmdLine = s},
 	"PP": func(s string, prog *Program) {prog.PrevID = s},
 }	
 
-func parseProgram(line string) *Program {
+func parseProgram(line string) (*Program, error) {
 	tvs := strings.Split(line, "\t")
 	prog := Program{}
 	for _,tv := range tvs[1:] {
-		tva := strings.Split(tv,":")
-		tag := tva[0]
-		val := tva[1]
+		tag, val, err := splitTag(tv)
+		if err != nil {
+			return nil, err
+		}
 		parseFunc := programParseMap[tag]
 		if parseFunc != nil {
 			parseFunc(val, &prog)
-		} // FIXME: catch and collect non-std tags?
+		} else {
+			if prog.Other == nil {
+				prog.Other = map[string]string{}
+			}
+			prog.Other[tag] = val
+		}
 	}
-	return &prog
+	return &prog, nil
+}
+
+// Header holds the lines of a SAM file's header section.
+type Header struct {
+	HD *HeaderLine
+	SQ []*RefSeqDict // in file order, which defines the sort order
+	RG []*ReadGroup
+	PG []*Program
+	CO []string // text of @CO lines
+
+	refs map[string]int // index of SQ by name, for Reference; see indexRefs
 }
 
 type Alignment struct {
-	Qname string // required | [!-?A-~]{1-255} | query template name
+	Qname string // required | \*|[!-?A-~]{1,254} | query template name
 	Flag uint16 // required | [0-2^16 - 1] | bitwise flag
 	RefName string // required | \*|[!-()+-<>-~][!-~]*
-	Pos uint32 // required | [0-2^29-1]
+	Pos uint32 // required | [0-2^31-1]
 	Mapq uint8 // required | [0-2^8-1]
 	Cigar string // required | \*|([0-9]+[MIDNSHPX=])+
 	NextRef string // required | \*|=|[!-()+-<>-~][!-~]*
-	NextPos uint32 // required | [0-2^29-1]
-	TemplateLen int32 // required | [-2^29+1 - 2^29-1]
+	NextPos uint32 // required | [0-2^31-1]
+	TemplateLen int32 // required | [-2^31+1 - 2^31-1]
 	Seq string // required | \*|[A-Za-z=.]+
 	Qual string // required ASCII Phred score+33
+	OptFields map[string]OptField // optional TAG:TYPE:VALUE fields, keyed by tag; Tags gives them in order
+
+	tagOrder []string // tags of OptFields in the order they came in, for Tags
+	circularLen uint32 // length of the reference if it's circular, or 0; set by Readers, ParseConcurrent and SetCircular
+}
+
+// Optional fields follow QUAL on an alignment line. Value holds the
+// decoded value: string for A and Z, int64 for i, float64 for f,
+// []byte for H, and a typed slice for B ([]int8, []uint8, []int16,
+// []uint16, []int32, []uint32, or []float32). Value is nil if it
+// couldn't be decoded according to Type. Fields of types the spec
+// doesn't define, perhaps from newer tools, keep their value as the
+// string it was read as, so that they're written back out unchanged.
+type OptField struct {
+	Tag string
+	Type rune
+	Value interface{}
+}
+
+func parseOptField(tok string) OptField {
+	// TAG:TYPE:VALUE, where TYPE is a single character
+	i := strings.IndexByte(tok, ':')
+	if i < 0 || len(tok) < i+3 || tok[i+2] != ':' {
+		// Leave Type unset so validation rejects the token
+		return OptField{Tag: tok}
+	}
+	of := OptField{Tag: tok[:i], Type: rune(tok[i+1])}
+	val := tok[i+3:]
+	switch of.Type {
+	case 'A':
+		if len(val) == 1 {
+			of.Value = val
+		}
+	case 'Z':
+		of.Value = val
+	case 'i':
+		if v, err := strconv.ParseInt(val, 10, 64); err == nil {
+			of.Value = v
+		}
+	case 'f':
+		if v, err := strconv.ParseFloat(val, 64); err == nil {
+			of.Value = v
+		}
+	case 'H':
+		if v, err := hex.DecodeString(val); err == nil {
+			of.Value = v
+		}
+	case 'B':
+		of.Value = parseOptArray(val)
+	default:
+		// Kept as it is, so that it can be written back out
+		of.Value = val
+	}
+	return of
+}
+
+// knownOptType reports whether t is one of the optional field types
+// the spec defines.
+func knownOptType(t rune) bool {
+	return strings.ContainsRune("AifZHB", t)
+}
+
+// B-type values look like "c,1,2,3", where the first character is
+// the element type. Returns nil if the array can't be decoded.
+func parseOptArray(val string) interface{} {
+	elems := strings.Split(val, ",")
+	if len(elems[0]) != 1 {
+		return nil
+	}
+	nums := elems[1:]
+	switch elems[0] {
+	case "c":
+		a := make([]int8, len(nums))
+		for i, n := range nums {
+			v, err := strconv.ParseInt(n, 10, 8)
+			if err != nil {
+				return nil
+			}
+			a[i] = int8(v)
+		}
+		return a
+	case "C":
+		a := make([]uint8, len(nums))
+		for i, n := range nums {
+			v, err := strconv.ParseUint(n, 10, 8)
+			if err != nil {
+				return nil
+			}
+			a[i] = uint8(v)
+		}
+		return a
+	case "s":
+		a := make([]int16, len(nums))
+		for i, n := range nums {
+			v, err := strconv.ParseInt(n, 10, 16)
+			if err != nil {
+				return nil
+			}
+			a[i] = int16(v)
+		}
+		return a
+	case "S":
+		a := make([]uint16, len(nums))
+		for i, n := range nums {
+			v, err := strconv.ParseUint(n, 10, 16)
+			if err != nil {
+				return nil
+			}
+			a[i] = uint16(v)
+		}
+		return a
+	case "i":
+		a := make([]int32, len(nums))
+		for i, n := range nums {
+			v, err := strconv.ParseInt(n, 10, 32)
+			if err != nil {
+				return nil
+			}
+			a[i] = int32(v)
+		}
+		return a
+	case "I":
+		a := make([]uint32, len(nums))
+		for i, n := range nums {
+			v, err := strconv.ParseUint(n, 10, 32)
+			if err != nil {
+				return nil
+			}
+			a[i] = uint32(v)
+		}
+		return a
+	case "f":
+		a := make([]float32, len(nums))
+		for i, n := range nums {
+			v, err := strconv.ParseFloat(n, 32)
+			if err != nil {
+				return nil
+			}
+			a[i] = float32(v)
+		}
+		return a
+	}
+	return nil
+}
+
+func validateOptField(of OptField) (bool, error) {
+	if !optTagRE.MatchString(of.Tag) {
+		return false, SAMerror{str: "Malformed optional field in alignment", Field: of.Tag}
+	}
+	if of.Type <= ' ' || of.Type > '~' {
+		return false, SAMerror{str: "Malformed optional field in alignment", Field: of.Tag}
+	}
+	if of.Value == nil {
+		if of.Type == 'B' {
+			return false, SAMerror{str: "Invalid array for optional field in alignment, whose elements must all be of its subtype", Field: of.Tag}
+		}
+		return false, SAMerror{str: "Invalid value for optional field in alignment", Field: of.Tag}
+	}
+	if !optValueMatches(of) {
+		return false, SAMerror{str: fmt.Sprintf("Value of type %T doesn't match type %c of optional field in alignment", of.Value, of.Type), Field: of.Tag}
+	}
+	return true, nil
+}
+
+// optValueMatches reports whether of.Value has the Go type OptField
+// documents for of.Type, so that it can be written back out.
+func optValueMatches(of OptField) bool {
+	switch v := of.Value.(type) {
+	case string:
+		return of.Type == 'Z' || (of.Type == 'A' && len(v) == 1) || !knownOptType(of.Type)
+	case int64:
+		return of.Type == 'i'
+	case float64:
+		return of.Type == 'f'
+	case []byte:
+		return of.Type == 'H' || of.Type == 'B'
+	case []int8, []int16, []uint16, []int32, []uint32, []float32:
+		return of.Type == 'B'
+	}
+	return false
 }
 
-// FIXME: These regexp patterns should be compiled, since they'll be
-// used over and over
 func validateAlignment(a *Alignment) (bool, error){
-	if m, _ := regexp.Match("*|[!-?A-~]+", []byte(a.Qname)); !m {
-		return false, SAMerror{"Invalid qname in alignment"}
+	if !qnameRE.MatchString(a.Qname) {
+		return false, SAMerror{str: "Invalid qname in alignment", Field: "QNAME"}
+	}
+	if !rnameRE.MatchString(a.RefName) {
+		return false, SAMerror{str: "Invalid reference sequence name in alignment", Field: "RNAME"}
+	}
+	if a.Pos > maxCoord {
+		return false, SAMerror{str: "Alignment mapping position out of valid range", Field: "POS", err: ErrOutOfRange}
 	}
-	if (a.Flag < 0 || a.Flag > 0xFFFF) {
-		return false, SAMerror{"Invalid flag in alignment"}
+	if !cigarRE.MatchString(a.Cigar) {	
+		return false, SAMerror{str: "Invalid CIGAR string in alignment", Field: "CIGAR"}
 	}
-	if m, _ := regexp.Match("*|[!-()+-<>-~][!-~]*", []byte(a.RefName)); !m {
-		return false, SAMerror{"Invalid reference sequence name in alignment"}
+	if err := ValidateCigar(a.Cigar); err != nil {
+		return false, err
 	}
-	if a.Pos < 0 || a.Pos > 0x1FFFFFFF {
-		return false, SAMerror{"Alignment mapping position out of valid range"}
+	if !nextRefRE.MatchString(a.NextRef) {
+		return false, SAMerror{str: "Invalid next reference name in alignment", Field: "RNEXT"}
 	}
-	if a.Mapq < 0 || a.Mapq > 0xFF {
-		return false, SAMerror{"Alignment mapping quality out of valid range"}
+	if a.NextPos > maxCoord {
+		return false, SAMerror{str: "Alignment mapping position out of valid range", Field: "PNEXT", err: ErrOutOfRange}
 	}
-	if m, _ := regexp.Match("*|([0-9]+[MIDNSHPX=])+", []byte(a.Cigar)); !m {	
-		return false, SAMerror{"Invalid CIGAR string in alignment"}
+	if a.TemplateLen < -maxCoord {
+		return false, SAMerror{str: "Invalid template length", Field: "TLEN", err: ErrOutOfRange}
 	}
-	if m, _ := regexp.Match("*|=|[!-()+-<>-~][!-~]*", []byte(a.NextRef)); !m {
-		return false, SAMerror{"Invalid next reference name in alignment"}
+	if !seqRE.MatchString(a.Seq) {
+		return false, SAMerror{str: "Invalid sequence in alignment", Field: "SEQ"}
 	}
-	if a.NextPos < 0 || a.NextPos > 0x1FFFFFFF {
-		return false, SAMerror{"Alignment mapping position out of valid range"}
+	if err := validateQual(a.Qual); err != nil {
+		return false, err
 	}
-	if a.TemplateLen < -0x1FFFFFFF || a.TemplateLen > 0x1FFFFFFF {
-		return false, SAMerror{"Invalid template length"}
+	if a.Seq == "*" && a.Qual != "*" {
+		return false, SAMerror{str: "QUAL given without SEQ in alignment", Field: "QUAL"}
 	}
-	if m, _ := regexp.Match("*|[A-Za-z=.]+",[]byte(a.Seq)); !m {
-		return false, SAMerror{"Invalid sequence in alignment"}
+	if a.Seq != "*" && a.Qual != "*" && len(a.Seq) != len(a.Qual) {
+		return false, SAMerror{str: fmt.Sprintf("SEQ length %d doesn't match QUAL length %d in alignment", len(a.Seq), len(a.Qual)), Field: "QUAL"}
+	}
+	if a.Seq != "*" && a.Cigar != "*" {
+		ops, err := ParseCigar(a.Cigar)
+		if err != nil {
+			return false, err
+		}
+		if n := queryLength(ops); n != len(a.Seq) {
+			return false, SAMerror{str: fmt.Sprintf("CIGAR query length %d doesn't match SEQ length %d in alignment", n, len(a.Seq)), Field: "CIGAR"}
+		}
+	}
+	for _, of := range a.OptFields {
+		if valid, err := validateOptField(of); !valid {
+			return false, err
+		}
 	}
-	if m, _ := regexp.Match("*|[!-~]+",[]byte(a.Qual)); !m {
-		return false, SAMerror{"Invalie Phred quality in alignment"}
-	}	
 	return true, nil
 }
 
-func parseAlignment(line string) *Alignment {
-	fields := strings.Split(line, "\t")
+// validateQual checks that qual is "*" or Phred scores + 33, each in
+// the printable range '!' (33) to '~' (126), naming the first one that
+// isn't.
+func validateQual(qual string) error {
+	if qualRE.MatchString(qual) {
+		return nil
+	}
+	if qual == "" {
+		return SAMerror{str: "Empty QUAL in alignment", Field: "QUAL"}
+	}
+	for i := 0; i < len(qual); i++ {
+		if c := qual[i]; c < '!' || c > '~' {
+			return SAMerror{str: fmt.Sprintf("Invalid Phred quality %q at position %d of QUAL in alignment", c, i+1), Field: "QUAL"}
+		}
+	}
+	return SAMerror{str: "Invalid Phred quality in alignment", Field: "QUAL"}
+}
+
+// maxCoord is the largest reference length or position the spec
+// allows, 2^31-1.
+const maxCoord = 1<<31 - 1
+
+// uintField converts the numeric alignment field called name, which
+// must fit in an unsigned integer of the given number of bits, so that
+// a malformed, negative, or too large value is reported rather than
+// silently becoming 0 or wrapping around.
+func uintField(name, val, qname string, bits int) (uint64, error) {
+	v, err := strconv.ParseUint(val, 10, bits)
+	if err != nil {
+		return 0, numFieldError(name, val, qname, err)
+	}
+	return v, nil
+}
+
+// intField is uintField for signed fields.
+func intField(name, val, qname string, bits int) (int64, error) {
+	v, err := strconv.ParseInt(val, 10, bits)
+	if err != nil {
+		return 0, numFieldError(name, val, qname, err)
+	}
+	return v, nil
+}
+
+func numFieldError(name, val, qname string, err error) error {
+	if errors.Is(err, strconv.ErrRange) {
+		return SAMerror{str: fmt.Sprintf("%s %s out of range in alignment %s", name, val, qname), Field: name, err: ErrOutOfRange}
+	}
+	return SAMerror{str: fmt.Sprintf("Invalid %s %q in alignment %s", name, val, qname), Field: name}
+}
+
+// cutField splits s at its first tab, returning the field before it and
+// the rest of s after it. more is false if s has no tab.
+func cutField(s string) (field, rest string, more bool) {
+	if i := strings.IndexByte(s, '\t'); i >= 0 {
+		return s[:i], s[i+1:], true
+	}
+	return s, "", false
+}
+
+func parseAlignment(line string) (*Alignment, error) {
+	a := &Alignment{}
+	if err := parseAlignmentInto(line, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
 
-	alignment := Alignment{}
-	alignment.Qname = fields[0]
+// parseAlignmentInto parses line into a, overwriting all of its fields.
+// a's OptFields map, if it has one, is cleared and reused.
+func parseAlignmentInto(line string, a *Alignment) error {
+	// Scan the mandatory fields into an array rather than splitting
+	// the line, which would allocate a slice for every alignment.
+	var fields [11]string
+	rest, more := line, true
+	n := 0
+	for ; n < len(fields) && more; n++ {
+		fields[n], rest, more = cutField(rest)
+	}
+	if n < len(fields) {
+		return SAMerror{str: fmt.Sprintf("Truncated alignment line, %d of 11 required fields: %q", n, line), err: ErrTruncatedRecord}
+	}
 
-	flagVal, _ := strconv.Atoi(fields[1])
-	alignment.Flag = uint16(flagVal)
+	opt, order := a.OptFields, a.tagOrder[:0]
+	*a = Alignment{}
+	a.Qname = fields[0]
 
-	alignment.RefName = fields[2]
+	flagVal, err := uintField("FLAG", fields[1], a.Qname, 16)
+	if err != nil {
+		return err
+	}
+	a.Flag = uint16(flagVal)
 
-	posVal, _ := strconv.Atoi(fields[3])
-	alignment.Pos = uint32(posVal)
+	a.RefName = fields[2]
+
+	posVal, err := uintField("POS", fields[3], a.Qname, 32)
+	if err != nil {
+		return err
+	}
+	a.Pos = uint32(posVal)
+
+	mapqVal, err := uintField("MAPQ", fields[4], a.Qname, 8)
+	if err != nil {
+		return err
+	}
+	a.Mapq = uint8(mapqVal)
 
-	mapqVal,  _ := strconv.Atoi(fields[4])
-	alignment.Mapq = uint8(mapqVal)
+	a.Cigar = fields[5]
+	a.NextRef = fields[6]
 
-	alignment.Cigar = fields[5]
-	alignment.NextRef = fields[6]
+	nextPosVal, err := uintField("PNEXT", fields[7], a.Qname, 32)
+	if err != nil {
+		return err
+	}
+	a.NextPos = uint32(nextPosVal)
 
-	nextPosVal, _ := strconv.Atoi(fields[7])
-	alignment.NextPos = uint32(nextPosVal)
+	templateLenVal, err := intField("TLEN", fields[8], a.Qname, 32)
+	if err != nil {
+		return err
+	}
+	a.TemplateLen = int32(templateLenVal)	
 
-	templateLenVal, _ := strconv.Atoi(fields[8])
-	alignment.TemplateLen = int32(templateLenVal)	
+	a.Seq = fields[9]
+	a.Qual = fields[10]
 
-	alignment.Seq = fields[9]
-	alignment.Qual = fields[10]
+	nOpt := 0
+	if more {
+		nOpt = strings.Count(rest, "\t") + 1
+	}
+	if opt != nil {
+		clear(opt)
+		a.OptFields = opt
+	} else {
+		a.OptFields = make(map[string]OptField, nOpt)
+	}
+	if order == nil && nOpt > 0 {
+		order = make([]string, 0, nOpt)
+	}
+	a.tagOrder = order
+	for more {
+		var tok string
+		tok, rest, more = cutField(rest)
+		a.SetTag(parseOptField(tok))
+	}
 
-	return &alignment
+	return nil
 }
 
-func bitIsSet(bit uint8, bitmap uint16) {
-		if (bitmap & bit) == bit {
+// Bits of the FLAG field
+const (
+	FlagPaired uint16 = 0x1 // template has multiple segments
+	FlagProperPair uint16 = 0x2 // each segment properly aligned
+	FlagUnmapped uint16 = 0x4 // segment unmapped
+	FlagMateUnmapped uint16 = 0x8 // next segment unmapped
+	FlagReverse uint16 = 0x10 // SEQ is reverse complemented
+	FlagMateReverse uint16 = 0x20 // next segment's SEQ reverse complemented
+	FlagRead1 uint16 = 0x40 // first segment in the template
+	FlagRead2 uint16 = 0x80 // last segment in the template
+	FlagSecondary uint16 = 0x100 // secondary alignment
+	FlagQCFail uint16 = 0x200 // not passing quality controls
+	FlagDuplicate uint16 = 0x400 // PCR or optical duplicate
+	FlagSupplementary uint16 = 0x800 // supplementary alignment
+)
+
+func bitIsSet(bit uint16, bitmap uint16) bool {
+	if (bitmap & bit) == bit {
 		return true
 	}
 	return false
 }
 
-func hasMultipleSegments(a *Alignment) bool {
-	return bitIsSet(0x01, a.Flag)
+func (a *Alignment) setBit(bit uint16, on bool) {
+	if on {
+		a.Flag |= bit
+	} else {
+		a.Flag &^= bit
+	}
 }
 
-func segmentIsUnmapped(a *Alignment) bool {
-	return bitIsSet(0x04, a.Flag)
-}
+func (a *Alignment) IsPaired() bool { return bitIsSet(FlagPaired, a.Flag) }
+func (a *Alignment) IsProperPair() bool { return bitIsSet(FlagProperPair, a.Flag) }
+func (a *Alignment) IsUnmapped() bool { return bitIsSet(FlagUnmapped, a.Flag) }
+func (a *Alignment) MateUnmapped() bool { return bitIsSet(FlagMateUnmapped, a.Flag) }
+func (a *Alignment) IsReverse() bool { return bitIsSet(FlagReverse, a.Flag) }
+func (a *Alignment) MateReverse() bool { return bitIsSet(FlagMateReverse, a.Flag) }
+func (a *Alignment) IsRead1() bool { return bitIsSet(FlagRead1, a.Flag) }
+func (a *Alignment) IsRead2() bool { return bitIsSet(FlagRead2, a.Flag) }
+func (a *Alignment) IsSecondary() bool { return bitIsSet(FlagSecondary, a.Flag) }
+func (a *Alignment) IsQCFail() bool { return bitIsSet(FlagQCFail, a.Flag) }
+func (a *Alignment) IsDuplicate() bool { return bitIsSet(FlagDuplicate, a.Flag) }
+func (a *Alignment) IsSupplementary() bool { return bitIsSet(FlagSupplementary, a.Flag) }
+
+func (a *Alignment) SetPaired(on bool) { a.setBit(FlagPaired, on) }
+func (a *Alignment) SetProperPair(on bool) { a.setBit(FlagProperPair, on) }
+func (a *Alignment) SetUnmapped(on bool) { a.setBit(FlagUnmapped, on) }
+func (a *Alignment) SetMateUnmapped(on bool) { a.setBit(FlagMateUnmapped, on) }
+func (a *Alignment) SetReverse(on bool) { a.setBit(FlagReverse, on) }
+func (a *Alignment) SetMateReverse(on bool) { a.setBit(FlagMateReverse, on) }
+func (a *Alignment) SetRead1(on bool) { a.setBit(FlagRead1, on) }
+func (a *Alignment) SetRead2(on bool) { a.setBit(FlagRead2, on) }
+func (a *Alignment) SetSecondary(on bool) { a.setBit(FlagSecondary, on) }
+func (a *Alignment) SetQCFail(on bool) { a.setBit(FlagQCFail, on) }
+func (a *Alignment) SetDuplicate(on bool) { a.setBit(FlagDuplicate, on) }
+func (a *Alignment) SetSupplementary(on bool) { a.setBit(FlagSupplementary, on) }
+
+// Errors for particular kinds of problem, which the SAMerror reporting
+// one wraps, so that they can be told apart with errors.Is.
+var (
+	ErrInvalidVersion = errors.New("sam: invalid version")
+	ErrNonUniqueRefName = errors.New("sam: reference sequence name is not unique")
+	ErrNonUniqueReadGroupID = errors.New("sam: read group ID is not unique")
+	ErrNonUniqueProgramID = errors.New("sam: program ID is not unique")
+	ErrTruncatedRecord = errors.New("sam: truncated alignment record")
+	ErrOutOfRange = errors.New("sam: value out of range")
+	ErrHeaderInAlignments = errors.New("sam: header line among the alignments")
+)
 
 type SAMerror struct {
 	str string
+	Field string // the field or tag involved, if known
+	Line int // 1-based line of the input, or 0 if unknown
+	err error // one of the Err values above, or nil
 }
 
 func (e SAMerror) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("sam: line %d: %s", e.Line, e.str)
+	}
 	return fmt.Sprintf("sam: %s", e.str)
 }
 
+// Unwrap returns the Err value for the kind of problem, if there is
+// one.
+func (e SAMerror) Unwrap() error {
+	return e.err
+}
+
+
+// openInput opens fileName for reading, with "-" meaning standard
+// input, as is usual for command-line tools.
+func openInput(fileName string) (io.ReadCloser, error) {
+	if fileName == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(fileName)
+}
 
+// ReadSAMFile reads a whole SAM file, returning the @HD line and lists
+// of the *RefSeqDict, *ReadGroup, *Program, and *Alignment values read.
+// If an error occurs, everything read before it is returned along
+// with the error: the four lists are never nil, though they may be
+// empty, and the @HD line is nil only if one hadn't been read. So
+// for a file with an invalid @RG line, the @HD line, the @SQ lines,
+// and any @RG lines before the bad one are returned.
 func ReadSAMFile(fileName string) (*HeaderLine, *list.List, *list.List, *list.List, *list.List, error) {
-	file, err := os.Open(fileName);
+	file, err := openInput(fileName);
 	if err != nil {
-		fmt.Println(err)
-        return nil, nil, nil, nil, nil, err
-    }
+		return samLists(nil, nil, err)
+	}
+	defer file.Close()
+
+	return ReadSAM(file)
+}
+
+// ReadSAM is like ReadSAMFile, but reads from r, e.g. a pipe or an
+// in-memory buffer. Closing r is left to the caller.
+func ReadSAM(r io.Reader) (*HeaderLine, *list.List, *list.List, *list.List, *list.List, error) {
+	return samLists(ReadSAM2(r))
+}
 
-	reader := bufio.NewReader(file)
+// samLists converts the results of ReadSAM2 to those of ReadSAM.
+func samLists(header *Header, alignments []*Alignment, err error) (*HeaderLine, *list.List, *list.List, *list.List, *list.List, error) {
 
-	// These will be returned so they must be declared in this scope
-	var header *HeaderLine
+	var hl *HeaderLine
 	var rsdl, rgl, progl, al = list.New(), list.New(), list.New(), list.New()
+	if header != nil {
+		hl = header.HD
+		for _, rsd := range header.SQ {
+			rsdl.PushBack(rsd)
+		}
+		for _, rg := range header.RG {
+			rgl.PushBack(rg)
+		}
+		for _, prog := range header.PG {
+			progl.PushBack(prog)
+		}
+	}
+	for _, a := range alignments {
+		al.PushBack(a)
+	}
+	return hl, rsdl, rgl, progl, al, err
+}
 
-	// Maps to keep track of values that must be unique. Used for checking for duplicate values.
-	var rsdNames, rgIDs, progIDs = map[string]bool{},  map[string]bool{}, map[string]bool{}
-
-	// separating the cases into separate handler functions doesn't
-	// seem to win much, so I'm leaving this as it is for now, though
-	// it is longer than I'd like.
-	for line, _, err := reader.ReadLine(); err == nil;  line, _, err = reader.ReadLine() {
-		s := string(line)
-		switch lineTag := s[1:3]; lineTag {
-		case "HD": 		
-			header = parseHeader(s)
-			if valid, err := validateHeader(header); !valid {
-					return header, nil, nil, nil, nil, err
-			}
-		case "SQ":
-			rsd := parseRefSeqDict(s)
-			if valid, err := validateRefSeqDict(rsd); !valid {
-				return  header, nil, nil, nil, nil, err
-			} else { 		
-				if rsdNames[rsd.Name] { // Make sure name is unique
-					return  header, rsdl, nil, nil, nil, SAMerror{"Reference sequence name is not unique"}
-				} else { // Everything is OK
-					rsdNames[rsd.Name] = true
-					rsdl.PushBack(rsd)
-				}
-			}
-		case "RG":
-			rg := parseReadGroup(s)
-			if valid, err := validateReadGroup(rg); !valid {
-				return header, rsdl, rgl, nil, nil, err
-			} else {
-				if rgIDs[rg.ID] {
-					return  header, rsdl, rgl, nil, nil, SAMerror{"Read group name is not unique"}
-				} else {
-					rgIDs[rg.ID] = true
-					rgl.PushBack(rg)
-				}
+// ReadSAMFile2 reads a whole SAM file, returning its header and
+// alignments. If an error occurs, whatever was read before the error
+// is returned along with it. A fileName of "-" reads standard input,
+// as do those of ReadSAMFile and ReadSAMFileContext.
+func ReadSAMFile2(fileName string) (*Header, []*Alignment, error) {
+	file, err := openInput(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	return ReadSAM2(file)
+}
+
+// ReadSAM2 is like ReadSAMFile2, but reads from r. Closing r is left
+// to the caller.
+func ReadSAM2(r io.Reader) (*Header, []*Alignment, error) {
+	header, alignments, _, err := ReadSAMOptions(r, ReaderOptions{})
+	return header, alignments, err
+}
+
+// ReadSAMOptions is like ReadSAM2, but with options other than the
+// defaults. With ContinueOnError, the alignments returned are the ones
+// without errors, the errors found are returned as the third result,
+// and the last result is only for I/O errors.
+func ReadSAMOptions(r io.Reader, opts ReaderOptions) (*Header, []*Alignment, []error, error) {
+	sr, err := NewReaderOptions(r, opts)
+	if err != nil {
+		return sr.Header, nil, sr.Errors(), err
+	}
+
+	var alignments []*Alignment
+	for {
+		a, err := sr.Next()
+		if err == io.EOF {
+			return sr.Header, alignments, sr.Errors(), nil
+		}
+		if err != nil {
+			return sr.Header, alignments, sr.Errors(), err
+		}
+		alignments = append(alignments, a)
+	}
+}
+
+// ReadSAMFileContext is like ReadSAMFile2, but stops with ctx.Err()
+// if ctx is done before the whole file is read.
+func ReadSAMFileContext(ctx context.Context, fileName string) (*Header, []*Alignment, error) {
+	file, err := openInput(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	return ReadSAMContext(ctx, file)
+}
+
+// ReadSAMContext is like ReadSAMFileContext, but reads from r.
+func ReadSAMContext(ctx context.Context, r io.Reader) (*Header, []*Alignment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	sr, err := NewReader(r)
+	if err != nil {
+		return sr.Header, nil, err
+	}
+
+	var alignments []*Alignment
+	for {
+		a, err := sr.NextContext(ctx)
+		if err == io.EOF {
+			return sr.Header, alignments, nil
+		}
+		if err != nil {
+			return sr.Header, alignments, err
+		}
+		alignments = append(alignments, a)
+	}
+}
+
+// Reader reads a SAM stream one alignment at a time, so that large
+// files don't have to be held in memory. The header section is read
+// by NewReader, or by NewBAMReader for BAM files.
+type Reader struct {
+	Header *Header
+	reader *bufio.Reader
+
+	// For BAM files: alignments are binary records, and refer to
+	// references by their index in refNames.
+	bam bool
+	bgzf *BlockReader
+	refNames []string
+	index *BAI
+
+	// For CRAM files
+	cram *cramReader
+
+	// An alignment read ahead by NextPair, to be returned next
+	pending *Alignment
+	lastQname string
+
+	opts ReaderOptions
+	line int // lines read so far, or records for BAM, for errors
+	errors []error // collected with ContinueOnError
+	warnings []error // normalizations made when not Strict
+	warned map[string]bool // kinds of warning already recorded
+
+	// Lengths of the circular references in circularOf, by name
+	circular map[string]uint32
+	circularOf *Header
+}
+
+// ReaderOptions controls how a Reader handles problems in its input.
+type ReaderOptions struct {
+	// ContinueOnError records errors in lines of the input, which are
+	// then skipped, instead of returning them. They can be retrieved
+	// with Errors. I/O errors are still returned.
+	ContinueOnError bool
+
+	// Strict reads the input exactly as the spec has it. Otherwise
+	// some common deviations from the spec are tolerated, and
+	// normalized: whitespace at the end of a line, where it would
+	// leave an empty field or an invalid QUAL, is trimmed, lowercase
+	// bases in SEQ are uppercased, and POS and MAPQ are set to 0 for
+	// alignments with no reference ("*" RNAME), which Strict rejects
+	// if they have a POS. Optional fields of types the spec doesn't
+	// define are kept, unparsed, where Strict rejects them, as is a
+	// PI tag in a read group that isn't an integer. Normalizations
+	// are reported by Warnings.
+	Strict bool
+
+	// Concatenated reads a series of SAM files joined together in one
+	// stream, each starting with its own header section. Next returns
+	// io.EOF at the end of each file's alignments, and NextFile moves
+	// on to the next file. Otherwise, a header line after the
+	// alignments have started is an error. QNAMEs can't start with
+	// '@', so any line that does is taken to be a header line.
+	Concatenated bool
+}
+
+// utf8BOM is the UTF-8 encoding of the byte order mark, U+FEFF.
+const utf8BOM = "\xef\xbb\xbf"
+
+// NewReader reads and validates the header section of r, leaving the
+// Reader positioned at the first alignment line. The header section is
+// the lines at the start of the stream beginning with '@'; the first
+// line that doesn't is taken to be an alignment, whatever its QNAME.
+func NewReader(r io.Reader) (*Reader, error) {
+	return NewReaderOptions(r, ReaderOptions{})
+}
+
+// NewReaderOptions is like NewReader, but with options other than the
+// defaults.
+func NewReaderOptions(r io.Reader, opts ReaderOptions) (*Reader, error) {
+	sr := &Reader{Header: &Header{}, reader: bufio.NewReader(r), opts: opts}
+
+	// Files saved by some Windows editors start with a UTF-8 byte
+	// order mark, which would hide the first header line's '@'.
+	if b, err := sr.reader.Peek(len(utf8BOM)); err == nil && string(b) == utf8BOM {
+		sr.reader.Discard(len(utf8BOM))
+	}
+
+	return sr, sr.readHeader()
+}
+
+// readHeader reads the header section at the start of a SAM file into
+// a new Header.
+func (sr *Reader) readHeader() error {
+	sr.Header = &Header{}
+	// Names and IDs that must be unique.
+	names := newHeaderNames()
+
+	for {
+		b, err := sr.reader.Peek(1)
+		if err == io.EOF { // Header only, no alignments
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if b[0] != '@' {
+			break
+		}
+		s, err := sr.readLine()
+		if err != nil {
+			return err
+		}
+		if !sr.opts.Strict {
+			s = sr.trimLine(s, false)
+		}
+		if err := sr.addHeaderLine(s, names); err != nil {
+			err = sr.atLine(err)
+			if !sr.opts.ContinueOnError {
+				return err
 			}
-		case "PG":
-			prog := parseProgram(s)
-			if valid, err := validateProgram(prog); !valid {
-				return header, rsdl, rgl, progl, nil, err
-			} else {
-				if progIDs[prog.ID] {
-					return header, rsdl, rgl, progl, nil, SAMerror{"Program ID is not unique"}
-				} else {
-					progIDs[prog.ID] = true
-					progl.PushBack(prog)
-				}
+			sr.errors = append(sr.errors, err)
+		}
+	}
+
+	sr.Header.indexRefs()
+
+	// Checks that need the whole header
+	if err := ValidatePrograms(sr.Header.PG); err != nil {
+		if !sr.opts.ContinueOnError {
+			return err
+		}
+		sr.errors = append(sr.errors, err)
+	}
+	return nil
+}
+
+// NextFile moves on to the next of a series of SAM files concatenated
+// together, for a Reader with the Concatenated option, returning its
+// header, which also becomes the Reader's Header. Next then returns
+// its alignments. Any alignments of the current file not yet read are
+// skipped. It returns io.EOF if there are no more files.
+func (sr *Reader) NextFile() (*Header, error) {
+	if sr.bam || sr.cram != nil || !sr.opts.Concatenated {
+		return nil, SAMerror{str: "NextFile needs a SAM Reader with the Concatenated option"}
+	}
+	sr.pending = nil
+	for {
+		b, err := sr.reader.Peek(1)
+		if err != nil {
+			return nil, err // io.EOF if there are no more files
+		}
+		if b[0] == '@' {
+			break
+		}
+		if _, err := sr.readLine(); err != nil {
+			return nil, err
+		}
+	}
+	if err := sr.readHeader(); err != nil {
+		return sr.Header, err
+	}
+	return sr.Header, nil
+}
+
+// errHeaderInAlignments is returned for a header line after the
+// alignments have started.
+var errHeaderInAlignments = SAMerror{str: "Header line among the alignments; the input may be SAM files concatenated together, which the Concatenated option allows", err: ErrHeaderInAlignments}
+
+
+// headerNames holds the names and IDs seen in a header so far, which
+// must be unique.
+type headerNames struct {
+	refs, readGroups, programs map[string]bool
+}
+
+func newHeaderNames() *headerNames {
+	return &headerNames{refs: map[string]bool{}, readGroups: map[string]bool{}, programs: map[string]bool{}}
+}
+
+// addUnique records name as seen in names, or returns an error naming it if
+// it was already.
+func addUnique(names map[string]bool, name, what, field string, kind error) error {
+	if names[name] {
+		return SAMerror{str: fmt.Sprintf("%s %s is not unique", what, name), Field: field, err: kind}
+	}
+	names[name] = true
+	return nil
+}
+
+func (hn *headerNames) addRef(name string) error {
+	return addUnique(hn.refs, name, "Reference sequence name", "SN", ErrNonUniqueRefName)
+}
+
+// addRefSeq adds the name of a reference sequence and its alternative
+// names, which share the same namespace.
+func (hn *headerNames) addRefSeq(rsd *RefSeqDict) error {
+	if err := hn.addRef(rsd.Name); err != nil {
+		return err
+	}
+	for _, alt := range rsd.AltNames {
+		if err := addUnique(hn.refs, alt, "Reference sequence name", "AN", ErrNonUniqueRefName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hn *headerNames) addReadGroup(id string) error {
+	return addUnique(hn.readGroups, id, "Read group ID", "ID", ErrNonUniqueReadGroupID)
+}
+
+func (hn *headerNames) addProgram(id string) error {
+	return addUnique(hn.programs, id, "Program ID", "ID", ErrNonUniqueProgramID)
+}
+
+// addHeaderLine parses and validates a header line, and adds it to the
+// header.
+func (sr *Reader) addHeaderLine(s string, names *headerNames) error {
+	if len(s) < 3 {
+		return SAMerror{str: "Malformed header line"}
+	}
+	switch lineTag := s[1:3]; lineTag {
+	case "HD":
+		hl, err := parseHeader(s)
+		if err != nil {
+			return err
+		}
+		if valid, err := validateHeader(hl); !valid {
+			return err
+		}
+		sr.Header.HD = hl
+	case "SQ":
+		rsd, err := parseRefSeqDict(s)
+		if err != nil {
+			return err
+		}
+		if valid, err := validateRefSeqDict(rsd); !valid {
+			return err
+		}
+		if err := names.addRefSeq(rsd); err != nil {
+			return err
+		}
+		sr.Header.SQ = append(sr.Header.SQ, rsd)
+	case "RG":
+		rg, err := parseReadGroup(s)
+		if err != nil {
+			return err
+		}
+		if valid, err := validateReadGroup(rg); !valid {
+			// Without Strict, a PI that isn't an integer, such as
+			// a decimal, is only a warning
+			se, ok := err.(SAMerror)
+			if !ok || se.Field != "PI" || sr.opts.Strict {
+				return err
 			}
-		case "CO":
-			// FIXME: It should be possible for the QNAME field of an
-			// alignment to have "HD", "SQ", "RG", "PG", or "CO" as
-			// characters 1 and 2, so making alignment the default
-			// lone type is not right.
-		default: 
-			a := parseAlignment(s)
-			if valid, err := validateAlignment(a); !valid {
-				return header, rsdl, rgl, progl, al , err
-			} else {
-				al.PushBack(a)
+			sr.warn("PI", "Non-integer predicted median insert size in read group")
+		}
+		if err := names.addReadGroup(rg.ID); err != nil {
+			return err
+		}
+		sr.Header.RG = append(sr.Header.RG, rg)
+	case "PG":
+		prog, err := parseProgram(s)
+		if err != nil {
+			return err
+		}
+		if valid, err := validateProgram(prog); !valid {
+			return err
+		}
+		if err := names.addProgram(prog.ID); err != nil {
+			return err
+		}
+		sr.Header.PG = append(sr.Header.PG, prog)
+	case "CO":
+		sr.Header.CO = append(sr.Header.CO, strings.TrimPrefix(s[3:], "\t"))
+	}
+	return nil
+}
+
+// atLine records the line just read in err, if it's a SAMerror.
+func (sr *Reader) atLine(err error) error {
+	if se, ok := err.(SAMerror); ok && se.Line == 0 {
+		se.Line = sr.line
+		return se
+	}
+	return err
+}
+
+// Errors returns the errors recorded with ContinueOnError, in the
+// order they were found.
+func (sr *Reader) Errors() []error {
+	return sr.errors
+}
+
+// Warnings returns the normalizations made to the input so far, when
+// it isn't read with Strict. To keep the list short for large files,
+// each kind of normalization is reported only once, for the first line
+// it was made to.
+func (sr *Reader) Warnings() []error {
+	return sr.warnings
+}
+
+// warn records a normalization of field in the line just read, unless
+// one like it has been already.
+func (sr *Reader) warn(field, msg string) {
+	if sr.warned[msg] {
+		return
+	}
+	if sr.warned == nil {
+		sr.warned = map[string]bool{}
+	}
+	sr.warned[msg] = true
+	sr.warnings = append(sr.warnings, SAMerror{str: msg, Field: field, Line: sr.line})
+}
+
+// trimLine trims whitespace from the end of line s which can't be
+// part of its last field: tabs, which would leave an empty field, and
+// for alignment lines, spaces, unless the last field is a Z-typed
+// optional field, whose value may end in spaces.
+func (sr *Reader) trimLine(s string, alignment bool) string {
+	t := strings.TrimRight(s, "\t")
+	if alignment {
+		u := strings.TrimRight(t, " \t")
+		last := u[strings.LastIndexByte(u, '\t')+1:]
+		if len(last) < 5 || last[2:5] != ":Z:" {
+			t = u
+		}
+	}
+	if len(t) != len(s) {
+		sr.warn("", "Trailing whitespace trimmed")
+	}
+	return t
+}
+
+// normalizeSeq uppercases a's SEQ, reporting whether it had any
+// lowercase bases.
+func normalizeSeq(a *Alignment) bool {
+	for i := 0; i < len(a.Seq); i++ {
+		if c := a.Seq[i]; c >= 'a' && c <= 'z' {
+			a.Seq = strings.ToUpper(a.Seq)
+			return true
+		}
+	}
+	return false
+}
+
+// readLine returns the next line without its trailing newline, which
+// may be a Windows-style "\r\n". Unlike bufio.Reader.ReadLine, it
+// doesn't split lines longer than the buffer.
+func (sr *Reader) readLine() (string, error) {
+	line, err := sr.reader.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	sr.line++
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+// Next returns the next alignment in the stream, or io.EOF when there
+// are no more. If the alignment fails validation, it is returned along
+// with the error, or if the line can't be parsed at all, nil is
+// returned with the error. Either way the stream can still be read
+// from, so it's up to the caller whether to stop. With ContinueOnError,
+// alignments with errors are skipped instead.
+func (sr *Reader) Next() (*Alignment, error) {
+	return sr.NextContext(context.Background())
+}
+
+// NextContext is like Next, but returns ctx.Err() instead if ctx is
+// done, so that a long scan can be abandoned. Lines skipped with
+// ContinueOnError are checked too.
+func (sr *Reader) NextContext(ctx context.Context) (*Alignment, error) {
+	return sr.read(ctx, nil)
+}
+
+// NextInto is like Next, but reads the alignment into a, overwriting
+// all of its fields, rather than allocating a new one; a's OptFields map
+// is cleared and reused. It's meant for streaming callers that are done
+// with each alignment before reading the next. The strings in a share
+// memory with the line they were parsed from, so keeping any of them
+// keeps the whole line alive: copy them with strings.Clone if they need
+// to outlive the loop. BAM and CRAM records are decoded as for Next and
+// then copied into a, so less is saved for those.
+//
+// As with Next, if the alignment fails validation a is filled in and
+// the error returned. If the line can't be parsed, a's contents are
+// unspecified.
+func (sr *Reader) NextInto(a *Alignment) error {
+	_, err := sr.read(context.Background(), a)
+	return err
+}
+
+// read returns the next alignment, read into into if it isn't nil.
+func (sr *Reader) read(ctx context.Context, into *Alignment) (*Alignment, error) {
+	if sr.pending != nil {
+		a := sr.pending
+		sr.pending = nil
+		if into != nil {
+			*into = *a
+			a = into
+		}
+		return a, nil
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		a, err := sr.next(into)
+		if err == nil || err == io.EOF {
+			return a, err
+		}
+		err = sr.atLine(err)
+		if _, ok := err.(SAMerror); !ok || !sr.opts.ContinueOnError {
+			return a, err
+		}
+		sr.errors = append(sr.errors, err)
+	}
+}
+
+func (sr *Reader) next(into *Alignment) (*Alignment, error) {
+	a, err := sr.nextRecord(into)
+	if err != nil {
+		return a, err
+	}
+	sr.markCircular(a)
+	if a.RefName == "*" && a.Pos != 0 {
+		if sr.opts.Strict {
+			return a, SAMerror{str: fmt.Sprintf("Alignment %s has POS %d but no reference", a.Qname, a.Pos), Field: "POS"}
+		}
+		unplace(a)
+		sr.warn("POS", "POS and MAPQ of alignment with no reference set to 0")
+	}
+	for _, of := range a.OptFields {
+		if !knownOptType(of.Type) {
+			if sr.opts.Strict {
+				return a, SAMerror{str: fmt.Sprintf("Unknown optional field type %c in alignment", of.Type), Field: of.Tag}
 			}
+			sr.warn(of.Tag, fmt.Sprintf("Optional field of unknown type %c kept as it is", of.Type))
 		}
 	}
+	return a, nil
+}
 
-	file.Close()
+// markCircular records the length of a's reference in a if the
+// header says it's circular, for End, Overlaps and Coverage.
+func (sr *Reader) markCircular(a *Alignment) {
+	if sr.circularOf != sr.Header {
+		sr.circular, sr.circularOf = circularRefs(sr.Header), sr.Header
+	}
+	a.circularLen = sr.circular[a.RefName]
+}
 
-	return header, rsdl, rgl, progl, al, err
+// circularRefs returns the lengths of the references h's @SQ lines
+// give as circular, by name, or nil if there are none.
+func circularRefs(h *Header) map[string]uint32 {
+	var circular map[string]uint32
+	for _, sq := range h.SQ {
+		if sq.Topology == TopologyCircular && sq.Length > 0 {
+			if circular == nil {
+				circular = map[string]uint32{}
+			}
+			circular[sq.Name] = sq.Length
+		}
+	}
+	return circular
+}
+
+// unplace clears the position and mapping quality of a, for an
+// alignment with no reference.
+func unplace(a *Alignment) {
+	a.Pos = 0
+	a.Mapq = 0
 }
 
-func ReadNextAlignment() {
+// nextRecord reads and validates the next record, in whatever format
+// the input is.
+func (sr *Reader) nextRecord(into *Alignment) (*Alignment, error) {
+	if sr.bam || sr.cram != nil {
+		var a *Alignment
+		var err error
+		if sr.bam {
+			a, err = sr.nextBAM()
+		} else {
+			a, err = sr.nextCRAM()
+		}
+		if a != nil && into != nil {
+			*into = *a
+			a = into
+		}
+		return a, err
+	}
+	if b, err := sr.reader.Peek(1); err == nil && b[0] == '@' && sr.opts.Concatenated {
+		return nil, io.EOF // the end of this file, and the start of the next
+	}
+	s, err := sr.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(s, "@") {
+		return nil, errHeaderInAlignments
+	}
+	if !sr.opts.Strict {
+		s = sr.trimLine(s, true)
+	}
+	a := into
+	if a == nil {
+		a = &Alignment{}
+	}
+	if err := parseAlignmentInto(s, a); err != nil {
+		return nil, err
+	}
+	if !sr.opts.Strict && normalizeSeq(a) {
+		sr.warn("SEQ", "Lowercase bases in SEQ uppercased")
+	}
+	if valid, err := validateAlignment(a); !valid {
+		return a, err
+	}
+	return a, nil
 }
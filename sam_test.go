@@ -0,0 +1,369 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const benchRecords = 1000000
+
+var (
+	benchOnce sync.Once
+	benchSAM  []byte
+)
+
+// syntheticSAM returns a SAM file of benchRecords paired reads on two
+// references, built the first time it's needed.
+func syntheticSAM() []byte {
+	benchOnce.Do(func() {
+		var buf bytes.Buffer
+		buf.WriteString("@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:chr1\tLN:248956422\n@SQ\tSN:chr2\tLN:242193529\n")
+		seq := "ACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTAC"
+		qual := "IIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIII"
+		for i := 0; i < benchRecords; i++ {
+			ref := "chr1"
+			if i >= benchRecords/2 {
+				ref = "chr2"
+			}
+			fmt.Fprintf(&buf, "read%d\t99\t%s\t%d\t60\t50M\t=\t%d\t350\t%s\t%s\tNM:i:0\tAS:i:50\tRG:Z:grp1\n",
+				i, ref, 1000+i*10, 1300+i*10, seq, qual)
+		}
+		benchSAM = buf.Bytes()
+	})
+	return benchSAM
+}
+
+// BenchmarkParse1M reads a million alignments with a Reader, which
+// validates each of them.
+func BenchmarkParse1M(b *testing.B) {
+	data := syntheticSAM()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sr, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		n := 0
+		var a Alignment
+		for {
+			if err := sr.NextInto(&a); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+			n++
+		}
+		if n != benchRecords {
+			b.Fatalf("read %d alignments, want %d", n, benchRecords)
+		}
+	}
+}
+
+// benchAlignments parses the records of syntheticSAM once, for the
+// validation benchmarks.
+func benchAlignments(b *testing.B) []*Alignment {
+	_, alignments, err := ReadSAM2(bytes.NewReader(syntheticSAM()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return alignments
+}
+
+// BenchmarkValidate1M validates a million alignments with the
+// precompiled patterns.
+func BenchmarkValidate1M(b *testing.B) {
+	alignments := benchAlignments(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, a := range alignments {
+			if valid, err := validateAlignment(a); !valid {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkValidate1MRecompiled matches the same fields as
+// BenchmarkValidate1M, compiling each pattern for every match as
+// validation used to, for comparison.
+func BenchmarkValidate1MRecompiled(b *testing.B) {
+	alignments := benchAlignments(b)
+	checks := []struct {
+		re    *regexp.Regexp
+		field func(a *Alignment) string
+	}{
+		{qnameRE, func(a *Alignment) string { return a.Qname }},
+		{rnameRE, func(a *Alignment) string { return a.RefName }},
+		{cigarRE, func(a *Alignment) string { return a.Cigar }},
+		{nextRefRE, func(a *Alignment) string { return a.NextRef }},
+		{seqRE, func(a *Alignment) string { return a.Seq }},
+		{qualRE, func(a *Alignment) string { return a.Qual }},
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, a := range alignments {
+			for _, c := range checks {
+				if m, err := regexp.MatchString(c.re.String(), c.field(a)); !m || err != nil {
+					b.Fatalf("%s doesn't match %q", c.re, c.field(a))
+				}
+			}
+		}
+	}
+}
+
+func TestValidateHeaderVersion(t *testing.T) {
+	for _, v := range []string{"1.0", "1.6", "10.12"} {
+		if valid, err := validateHeader(&HeaderLine{Version: v}); !valid {
+			t.Errorf("version %q rejected: %v", v, err)
+		}
+	}
+	for _, v := range []string{"", "1x2", "1.", ".6", "1.6.1", "v1.6", "1.6 "} {
+		if valid, _ := validateHeader(&HeaderLine{Version: v}); valid {
+			t.Errorf("version %q accepted", v)
+		}
+	}
+}
+
+func TestValidateAlignmentRejectsBadFields(t *testing.T) {
+	good := Alignment{Qname: "read1", RefName: "chr1", Pos: 100, Cigar: "10M", NextRef: "=", NextPos: 200, Seq: "ACGTACGTAC", Qual: "IIIIIIIIII"}
+	if valid, err := validateAlignment(&good); !valid {
+		t.Fatalf("valid alignment rejected: %v", err)
+	}
+	for _, tc := range []struct {
+		field string
+		set   func(a *Alignment)
+	}{
+		{"QNAME", func(a *Alignment) { a.Qname = "" }},
+		{"QNAME", func(a *Alignment) { a.Qname = "read@1" }},
+		{"QNAME", func(a *Alignment) { a.Qname = "read 1" }},
+		{"RNAME", func(a *Alignment) { a.RefName = "*chr1" }},
+		{"RNAME", func(a *Alignment) { a.RefName = "chr 1" }},
+		{"CIGAR", func(a *Alignment) { a.Cigar = "M10" }},
+		{"CIGAR", func(a *Alignment) { a.Cigar = "10M*" }},
+		{"RNEXT", func(a *Alignment) { a.NextRef = "==" }},
+		{"SEQ", func(a *Alignment) { a.Seq = "ACGT ACGTA" }},
+		{"SEQ", func(a *Alignment) { a.Seq = "*ACGTACGTA" }},
+		{"QUAL", func(a *Alignment) { a.Qual = "IIIII IIII" }},
+	} {
+		a := good
+		tc.set(&a)
+		valid, err := validateAlignment(&a)
+		if valid {
+			t.Errorf("%+v accepted", a)
+			continue
+		}
+		if se, ok := err.(SAMerror); !ok || se.Field != tc.field {
+			t.Errorf("%+v: error %v, want one for %s", a, err, tc.field)
+		}
+	}
+}
+
+const benchLine = "read1\t99\tchr1\t1000\t60\t50M\t=\t1300\t350\tACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTAC\tIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIII\tNM:i:0\tAS:i:50\tRG:Z:grp1"
+
+// Scanning the fields of a line, rather than splitting it, leaves
+// four allocations for an alignment with three tags, down from eight:
+// the Alignment, the OptFields map and its table, and the RG string
+// stored in an interface; small integers are boxed without
+// allocating. Keeping the tag order adds a fifth.
+func TestParseAlignmentAllocs(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := parseAlignment(benchLine); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 5 {
+		t.Errorf("parseAlignment made %v allocations, want at most 5", allocs)
+	}
+}
+
+func BenchmarkParseAlignment(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseAlignment(benchLine); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	sam := "@HD\tVN:1.6\tSO:unsorted\r\n" +
+		"@SQ\tSN:chr1\tLN:1000\r\n" +
+		"@RG\tID:grp1\tSM:sample\r\n" +
+		"@CO\tfrom Windows\r\n" +
+		"r1\t0\tchr1\t10\t60\t4M\t*\t0\t0\tACGT\tIIII\r\n" +
+		"r2\t0\tchr1\t20\t60\t4M\t*\t0\t0\tACGT\tIIII\tRG:Z:grp1\tNM:i:1\r\n"
+	header, alignments, err := ReadSAM2(strings.NewReader(sam))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.HD.SortOrder != SortUnsorted || header.RG[0].Sample != "sample" || header.CO[0] != "from Windows" {
+		t.Errorf("header has a stray CR: %+v %+v %q", header.HD, header.RG[0], header.CO)
+	}
+	if len(alignments) != 2 {
+		t.Fatalf("read %d alignments, want 2", len(alignments))
+	}
+	if a := alignments[0]; a.Qual != "IIII" {
+		t.Errorf("QUAL = %q, want IIII", a.Qual)
+	}
+	a := alignments[1]
+	if a.Seq != "ACGT" || a.Qual != "IIII" {
+		t.Errorf("SEQ, QUAL = %q, %q, want ACGT, IIII", a.Seq, a.Qual)
+	}
+	if v := a.OptFields["RG"].Value; v != "grp1" {
+		t.Errorf("RG = %q, want grp1", v)
+	}
+	if v := a.OptFields["NM"].Value; v != int64(1) {
+		t.Errorf("NM = %v, want 1", v)
+	}
+}
+
+// A file that fails at its second @RG line, which repeats an ID
+const badReadGroupSAM = "@HD\tVN:1.6\tSO:coordinate\n" +
+	"@SQ\tSN:chr1\tLN:1000\n" +
+	"@SQ\tSN:chr2\tLN:2000\n" +
+	"@RG\tID:grp1\tSM:sample\n" +
+	"@RG\tID:grp1\tSM:other\n" +
+	"@PG\tID:bwa\tPN:bwa\n" +
+	"r1\t0\tchr1\t10\t60\t4M\t*\t0\t0\tACGT\tIIII\n"
+
+func TestReadSAMFilePartial(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "bad.sam")
+	if err := os.WriteFile(name, []byte(badReadGroupSAM), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hl, rsdl, rgl, progl, al, err := ReadSAMFile(name)
+	if !errors.Is(err, ErrNonUniqueReadGroupID) {
+		t.Fatalf("error %v, want one for the repeated read group", err)
+	}
+	if hl == nil || hl.Version != "1.6" {
+		t.Errorf("@HD line = %+v, want the one read", hl)
+	}
+	if rsdl == nil || rsdl.Len() != 2 {
+		t.Errorf("@SQ list = %v, want both references", rsdl)
+	}
+	if rgl == nil || rgl.Len() != 1 || rgl.Front().Value.(*ReadGroup).ID != "grp1" {
+		t.Errorf("@RG list = %v, want the first read group", rgl)
+	}
+	// Nothing was read after the error, but the lists are still there
+	if progl == nil || progl.Len() != 0 || al == nil || al.Len() != 0 {
+		t.Errorf("@PG and alignment lists = %v, %v, want empty lists", progl, al)
+	}
+
+	if _, _, _, _, _, err := ReadSAMFile(filepath.Join(t.TempDir(), "missing.sam")); err == nil {
+		t.Fatal("no error for a missing file")
+	}
+}
+
+func TestHeaderReference(t *testing.T) {
+	sr, err := NewReader(strings.NewReader("@SQ\tSN:chr1\tLN:1000\n@SQ\tSN:chr2\tLN:2000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sr.Header
+
+	// Lookups don't change the header, so may run concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if rsd, ok := h.Reference("chr2"); !ok || rsd.Length != 2000 {
+					t.Errorf("Reference(chr2) = %v, %v", rsd, ok)
+				}
+				if _, ok := h.Reference("chr3"); ok {
+					t.Error("Reference(chr3) found a reference")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := h.RenameRefs(map[string]string{"chr1": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if rsd, ok := h.Reference("1"); !ok || rsd.Length != 1000 {
+		t.Errorf("Reference(1) after RenameRefs = %v, %v", rsd, ok)
+	}
+	if _, ok := h.Reference("chr1"); ok {
+		t.Error("Reference(chr1) found the renamed reference")
+	}
+
+	// A line added directly to SQ is found by searching
+	h.SQ = append(h.SQ, &RefSeqDict{Name: "chrM", Length: 16569})
+	if rsd, ok := h.Reference("chrM"); !ok || rsd.Length != 16569 {
+		t.Errorf("Reference(chrM) after appending to SQ = %v, %v", rsd, ok)
+	}
+	if _, ok := (&Header{SQ: h.SQ}).Reference("chrM"); !ok {
+		t.Error("Reference(chrM) of a header with no index found nothing")
+	}
+}
+
+func TestHeaderDiffIgnorePG(t *testing.T) {
+	read := func(pg string) *Header {
+		sr, err := NewReader(strings.NewReader("@SQ\tSN:chr1\tLN:1000\n" + pg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sr.Header
+	}
+	h := read("@PG\tID:bwa\tPN:bwa\tVN:0.7.17\tCL:bwa mem ref.fa r1.fq\n")
+	for _, tc := range []struct {
+		pg        string
+		ignorePG  bool
+		wantDiffs int
+	}{
+		{"@PG\tID:bwa\tPN:bwa\tVN:0.7.17\tCL:bwa mem ref.fa r2.fq\n", false, 1},
+		{"@PG\tID:bwa\tPN:bwa\tVN:0.7.17\tCL:bwa mem ref.fa r2.fq\n", true, 0},
+		{"@PG\tID:bwa\tPN:bwa\tVN:0.7.15\tCL:bwa mem ref.fa r2.fq\n", true, 1},
+		{"@PG\tID:bwa.1\tPN:bwa\tVN:0.7.17\tCL:bwa mem ref.fa r1.fq\n", true, 2},
+		{"", true, 1},
+	} {
+		if diffs := h.Diff(read(tc.pg), tc.ignorePG); len(diffs) != tc.wantDiffs {
+			t.Errorf("Diff with %q, ignorePG %v = %q, want %d differences", tc.pg, tc.ignorePG, diffs, tc.wantDiffs)
+		}
+	}
+}
+
+func TestSupplementaryAlignments(t *testing.T) {
+	a, err := parseAlignment("r1\t2048\tchr1\t100\t60\t50M50S\t*\t0\t0\t*\t*\tSA:Z:chr2,500,-,50S50M,30,1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	segs, err := a.SupplementaryAlignments()
+	want := SASegment{RefName: "chr2", Pos: 500, Reverse: true, Cigar: "50S50M", Mapq: 30, NM: 1}
+	if err != nil || len(segs) != 1 || segs[0] != want {
+		t.Errorf("SupplementaryAlignments() = %+v, %v, want [%+v]", segs, err, want)
+	}
+
+	a.DeleteTag("SA")
+	segs, err = a.SupplementaryAlignments()
+	if err != nil || segs == nil || len(segs) != 0 {
+		t.Errorf("SupplementaryAlignments() with no SA tag = %#v, %v, want an empty slice", segs, err)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import "io"
+
+// Scanner reads alignments from a Reader, or from any other
+// AlignmentIterator, in the style of bufio.Scanner:
+//
+//	s := NewScanner(sr)
+//	for s.Scan() {
+//		use(s.Alignment())
+//	}
+//	if err := s.Err(); err != nil {
+//		...
+//	}
+//
+// Scanning stops at the first error, including an alignment that
+// fails validation, so use Next directly, or ContinueOnError, to read
+// past bad records.
+type Scanner struct {
+	it  AlignmentIterator
+	a   *Alignment
+	err error
+}
+
+// NewScanner returns a Scanner reading from it.
+func NewScanner(it AlignmentIterator) *Scanner {
+	return &Scanner{it: it}
+}
+
+// Scan advances to the next alignment, which is then available from
+// Alignment. It returns false at the end of the input or on an error.
+func (s *Scanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	s.a, s.err = s.it.Next()
+	if s.err != nil {
+		s.a = nil
+		return false
+	}
+	return true
+}
+
+// Alignment returns the alignment read by the last call to Scan.
+func (s *Scanner) Alignment() *Alignment {
+	return s.a
+}
+
+// Err returns the error that stopped Scan, or nil if it reached the end
+// of the input.
+func (s *Scanner) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
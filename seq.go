@@ -0,0 +1,59 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"strings"
+)
+
+// Complements of the IUPAC nucleotide codes. Anything not in the
+// table, such as the '=' and '.' SEQ placeholders, is its own
+// complement.
+var complements [256]byte
+
+func init() {
+	for i := range complements {
+		complements[i] = byte(i)
+	}
+	pairs := []string{"AT", "CG", "RY", "SS", "WW", "KM", "BV", "DH", "NN"}
+	for _, p := range pairs {
+		for _, c := range []string{p, strings.ToLower(p)} {
+			complements[c[0]] = c[1]
+			complements[c[1]] = c[0]
+		}
+	}
+}
+
+// ReverseComplement returns the reverse complement of a nucleotide
+// sequence, preserving case.
+func ReverseComplement(seq string) string {
+	rc := make([]byte, len(seq))
+	for i := 0; i < len(seq); i++ {
+		rc[len(seq)-1-i] = complements[seq[i]]
+	}
+	return string(rc)
+}
+
+// ReverseString reverses s byte by byte, e.g. to put a quality string
+// in the same order as a reverse complemented sequence.
+func ReverseString(s string) string {
+	r := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		r[len(s)-1-i] = s[i]
+	}
+	return string(r)
+}
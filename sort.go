@@ -0,0 +1,278 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// setSortOrder records the sort order in the @HD line, adding one if
+// the header doesn't have it. A sub-sort order for a different sort
+// order no longer holds, so it's dropped.
+func setSortOrder(header *Header, so SortOrder) {
+	if header.HD == nil {
+		header.HD = &HeaderLine{Version: "1.6"}
+	}
+	header.HD.SortOrder = so
+	if !strings.HasPrefix(header.HD.SubSort, so.String()+":") {
+		header.HD.SubSort = ""
+	}
+}
+
+// SortByCoordinate sorts alignments by reference, in @SQ order, and
+// then by position, and marks the header as coordinate sorted.
+// Alignments with no reference come last, after any whose reference
+// isn't in the header. Ties are broken by QNAME and then FLAG, and
+// the sort is stable, so the result doesn't depend on the sort
+// algorithm.
+func SortByCoordinate(header *Header, alignments []*Alignment) {
+	cmp := coordinateCmp(header)
+	sort.SliceStable(alignments, func(i, j int) bool {
+		a, b := alignments[i], alignments[j]
+		if c := cmp(a, b); c != 0 {
+			return c < 0
+		}
+		if a.Qname != b.Qname {
+			return a.Qname < b.Qname
+		}
+		return a.Flag < b.Flag
+	})
+	setSortOrder(header, SortCoordinate)
+}
+
+// coordinateCmp returns a function comparing alignments by reference,
+// in @SQ order, and then by position, with alignments that have no
+// reference last, after any whose reference isn't in the header.
+func coordinateCmp(header *Header) func(a, b *Alignment) int {
+	refIndex := header.RefIndex()
+	index := func(a *Alignment) int {
+		if a.RefName == "*" {
+			return len(header.SQ) + 1
+		}
+		if i, ok := refIndex[a.RefName]; ok {
+			return i
+		}
+		return len(header.SQ)
+	}
+	return func(a, b *Alignment) int {
+		ai, bi := index(a), index(b)
+		switch {
+		case ai != bi:
+			return ai - bi
+		case a.RefName != b.RefName: // only for references not in the header
+			return strings.Compare(a.RefName, b.RefName)
+		case a.Pos < b.Pos:
+			return -1
+		case a.Pos > b.Pos:
+			return 1
+		}
+		return 0
+	}
+}
+
+// SortByTag sorts alignments by the value of their optional field
+// tag, such as CB for a cell barcode, and then by coordinate, as
+// SortByCoordinate does. Integer values come before strings, and are
+// compared as numbers. Alignments without the tag, or with a value of
+// some other type, come last. The header is marked as unsorted, with
+// the tag as the sub-sort order, since the order isn't one the SO tag
+// can describe.
+func SortByTag(header *Header, alignments []*Alignment, tag string) {
+	cmp := coordinateCmp(header)
+	// tagKey gives 0 and the value for integers, 1 and the value for
+	// strings, and 2 if there's no usable value.
+	tagKey := func(a *Alignment) (int, int64, string) {
+		of, ok := a.OptFields[tag]
+		if !ok {
+			return 2, 0, ""
+		}
+		switch v := of.Value.(type) {
+		case int64:
+			return 0, v, ""
+		case string:
+			if of.Type == 'A' || of.Type == 'Z' {
+				return 1, 0, v
+			}
+		}
+		return 2, 0, ""
+	}
+
+	sort.SliceStable(alignments, func(i, j int) bool {
+		a, b := alignments[i], alignments[j]
+		ak, an, as := tagKey(a)
+		bk, bn, bs := tagKey(b)
+		switch {
+		case ak != bk:
+			return ak < bk
+		case an != bn:
+			return an < bn
+		case as != bs:
+			return as < bs
+		}
+		if c := cmp(a, b); c != 0 {
+			return c < 0
+		}
+		if a.Qname != b.Qname {
+			return a.Qname < b.Qname
+		}
+		return a.Flag < b.Flag
+	})
+	setSortOrder(header, SortUnsorted)
+	header.HD.SubSort = SortUnsorted.String() + ":" + tag
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// strnumCmp compares strings the way samtools does when sorting by
+// name: runs of digits are compared as numbers, so r2 comes before
+// r10, and everything else byte by byte.
+func strnumCmp(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				return int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+			continue
+		}
+		// Skip leading zeros and matching digits
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		for i < len(a) && j < len(b) && isDigit(a[i]) && a[i] == b[j] {
+			i++
+			j++
+		}
+		// At the first difference; the longer number is larger, and
+		// for numbers of the same length the difference decides.
+		diff := byteAt(a, i) - byteAt(b, j)
+		for i < len(a) && j < len(b) && isDigit(a[i]) && isDigit(b[j]) {
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		} else if j < len(b) && isDigit(b[j]) {
+			return -1
+		} else if diff != 0 {
+			return diff
+		}
+	}
+	if i < len(a) {
+		return 1
+	} else if j < len(b) {
+		return -1
+	}
+	return 0
+}
+
+// byteAt returns s[i], or 0 past the end of s, like indexing a C
+// string.
+func byteAt(s string, i int) int {
+	if i < len(s) {
+		return int(s[i])
+	}
+	return 0
+}
+
+// SortByQueryName sorts alignments by QNAME, in the same order as
+// samtools sort -n, and marks the header as queryname sorted. Within
+// a template, read 1 comes before read 2, and primary alignments
+// before secondary and supplementary ones.
+func SortByQueryName(header *Header, alignments []*Alignment) {
+	sort.SliceStable(alignments, func(i, j int) bool {
+		a, b := alignments[i], alignments[j]
+		if c := strnumCmp(a.Qname, b.Qname); c != 0 {
+			return c < 0
+		}
+		if fa, fb := a.Flag&(FlagRead1|FlagRead2), b.Flag&(FlagRead1|FlagRead2); fa != fb {
+			return fa < fb
+		}
+		return a.Flag&(FlagSecondary|FlagSupplementary) < b.Flag&(FlagSecondary|FlagSupplementary)
+	})
+	setSortOrder(header, SortQueryName)
+}
+
+// SortChecker checks that alignments arrive in the order the header's
+// SO tag says they're sorted in, for verifying a file as it's read.
+// For coordinate order, references must come in @SQ order and
+// positions must not decrease within a reference. For queryname
+// order, QNAMEs must not decrease, compared as samtools sort -n
+// does, or byte by byte if the SS tag is queryname:lexicographical,
+// as for files sorted by Picard. Nothing is checked for other sort
+// orders.
+type SortChecker struct {
+	cmp  func(a, b *Alignment) int
+	so   SortOrder
+	prev *Alignment
+	n    int
+}
+
+// NewSortChecker returns a SortChecker for the sort order of header.
+func NewSortChecker(header *Header) *SortChecker {
+	c := &SortChecker{}
+	if header.HD == nil {
+		return c
+	}
+	c.so = header.HD.SortOrder
+	switch c.so {
+	case SortCoordinate:
+		c.cmp = coordinateCmp(header)
+	case SortQueryName:
+		if header.HD.SubSort == "queryname:lexicographical" {
+			c.cmp = func(a, b *Alignment) int { return strings.Compare(a.Qname, b.Qname) }
+		} else {
+			c.cmp = func(a, b *Alignment) int { return strnumCmp(a.Qname, b.Qname) }
+		}
+	}
+	return c
+}
+
+// Check returns an error naming a and the alignment before it if a
+// is out of order. It should be called with each alignment in turn.
+func (c *SortChecker) Check(a *Alignment) error {
+	c.n++
+	prev := c.prev
+	c.prev = a
+	if c.cmp == nil || prev == nil || c.cmp(prev, a) <= 0 {
+		return nil
+	}
+	return SAMerror{str: fmt.Sprintf("Alignment %d (%s at %s:%d) is out of %s order after %s at %s:%d",
+		c.n, a.Qname, a.RefName, a.Pos, c.so, prev.Qname, prev.RefName, prev.Pos)}
+}
+
+// VerifySorted checks that alignments are in the order the header's
+// SO tag claims, as SortChecker does, and returns an error describing
+// the first pair that's out of order.
+func VerifySorted(header *Header, alignments []*Alignment) error {
+	c := NewSortChecker(header)
+	for _, a := range alignments {
+		if err := c.Check(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"strings"
+	"testing"
+)
+
+// QNAMEs and flags in the order samtools sort -n puts them in
+const queryNameSorted = `A1	99
+A1	355
+A1	2147
+A1	147
+A2	83
+a1	0
+read.2	99
+read.2	147
+read.10	99
+read.10	147
+read.10a	0
+read.100	0
+read_b	4
+`
+
+func TestSortByQueryName(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(queryNameSorted), "\n")
+	var want []*Alignment
+	for _, line := range lines {
+		a, err := parseAlignment(line + "\t*\t0\t0\t*\t*\t0\t0\t*\t*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, a)
+	}
+	// Reverse them, then interleave the halves
+	var alignments []*Alignment
+	for i := len(want) - 1; i >= 0; i-- {
+		alignments = append(alignments, want[i])
+	}
+	half := len(alignments) / 2
+	var mixed []*Alignment
+	for i := 0; i < half; i++ {
+		mixed = append(mixed, alignments[i+half], alignments[i])
+	}
+	mixed = append(mixed, alignments[2*half:]...)
+
+	header := &Header{HD: &HeaderLine{Version: "1.6", SortOrder: SortCoordinate}}
+	SortByQueryName(header, mixed)
+	for i := range want {
+		if mixed[i] != want[i] {
+			for j := range mixed {
+				t.Logf("%s\t%d", mixed[j].Qname, mixed[j].Flag)
+			}
+			t.Fatalf("alignment %d is %s %d, want %s %d", i, mixed[i].Qname, mixed[i].Flag, want[i].Qname, want[i].Flag)
+		}
+	}
+	if header.HD.SortOrder != SortQueryName {
+		t.Errorf("SO is %s, want queryname", header.HD.SortOrder)
+	}
+}
+
+func TestStrnumCmp(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		sign int
+	}{
+		{"r2", "r10", -1},
+		{"r10", "r10", 0},
+		{"r10", "r9", 1},
+		{"r007", "r7", 0},
+		{"r7a", "r7b", -1},
+		{"r7", "r7a", -1},
+		{"A", "a", -1},
+	} {
+		c := strnumCmp(tc.a, tc.b)
+		if c < 0 && tc.sign >= 0 || c > 0 && tc.sign <= 0 || c == 0 && tc.sign != 0 {
+			t.Errorf("strnumCmp(%q, %q) = %d, want sign %d", tc.a, tc.b, c, tc.sign)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import "io"
+
+// SplitByReadGroup groups alignments by the read group in their RG
+// tag, keeping their order, with the reads that have no RG tag under
+// "". It also returns a header for each group, keyed the same way:
+// a copy of header with @RG cut down to just that group, or to none
+// for "" or a group header doesn't have. The headers share their other
+// entries with header. It's the inverse of merging files that each
+// have one read group.
+func SplitByReadGroup(header *Header, alignments []*Alignment) (map[string][]*Alignment, map[string]*Header) {
+	groups := map[string][]*Alignment{}
+	for _, a := range alignments {
+		id := readGroupID(a)
+		groups[id] = append(groups[id], a)
+	}
+
+	headers := make(map[string]*Header, len(groups))
+	for id := range groups {
+		h := *header
+		h.RG = nil
+		for _, rg := range header.RG {
+			if id != "" && rg.ID == id {
+				h.RG = []*ReadGroup{rg}
+				break
+			}
+		}
+		headers[id] = &h
+	}
+	return groups, headers
+}
+
+// readGroupID returns the ID in a's RG tag, or "" if it doesn't have
+// one.
+func readGroupID(a *Alignment) string {
+	if of, ok := a.OptFields["RG"]; ok && of.Type == 'Z' {
+		if id, ok := of.Value.(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// ForEachReference reads the rest of a coordinate-sorted input from r
+// and calls fn with the alignments for each reference sequence in
+// turn, so that a file can be processed a chromosome at a time
+// without holding all of it in memory. Unmapped reads with no
+// reference, which come last, are passed with ref "*". It stops with
+// an error if the input turns out not to be in coordinate order, or
+// with the error fn returns, if it returns one.
+func ForEachReference(r *Reader, fn func(ref string, al []*Alignment) error) error {
+	check := &SortChecker{cmp: coordinateCmp(r.Header), so: SortCoordinate}
+	var ref string
+	var group []*Alignment
+	for {
+		a, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := check.Check(a); err != nil {
+			return err
+		}
+		if len(group) > 0 && a.RefName != ref {
+			if err := fn(ref, group); err != nil {
+				return err
+			}
+			group = nil
+		}
+		ref = a.RefName
+		group = append(group, a)
+	}
+	if len(group) > 0 {
+		return fn(ref, group)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SASegment is one of the other alignments of a chimeric read, as
+// listed in its SA tag.
+type SASegment struct {
+	RefName string
+	Pos     uint32 // 1-based
+	Reverse bool
+	Cigar   string
+	Mapq    uint8
+	NM      int
+}
+
+// SupplementaryAlignments parses a's SA tag, which lists the other
+// alignments of a chimeric read as "rname,pos,strand,CIGAR,mapQ,NM;"
+// for each. It returns an empty slice, not nil, if a has no SA tag, so
+// that there's no need to tell that case apart. If a segment is
+// malformed, the ones before it are returned with the error.
+func (a *Alignment) SupplementaryAlignments() ([]SASegment, error) {
+	of, ok := a.OptFields["SA"]
+	if !ok {
+		return []SASegment{}, nil
+	}
+	sa, isString := of.Value.(string)
+	if of.Type != 'Z' || !isString {
+		return nil, SAMerror{str: fmt.Sprintf("SA tag of alignment %s isn't a string", a.Qname), Field: "SA"}
+	}
+
+	var segs []SASegment
+	for _, s := range strings.Split(strings.TrimSuffix(sa, ";"), ";") {
+		seg, err := parseSASegment(s)
+		if err != nil {
+			return segs, SAMerror{str: fmt.Sprintf("Malformed SA tag segment %q in alignment %s: %v", s, a.Qname, err), Field: "SA"}
+		}
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// parseSASegment parses one "rname,pos,strand,CIGAR,mapQ,NM" segment
+// of an SA tag.
+func parseSASegment(s string) (SASegment, error) {
+	f := strings.Split(s, ",")
+	if len(f) != 6 {
+		return SASegment{}, fmt.Errorf("%d of 6 fields", len(f))
+	}
+	seg := SASegment{RefName: f[0], Cigar: f[3]}
+	if !refNameRE.MatchString(seg.RefName) {
+		return seg, fmt.Errorf("invalid reference name")
+	}
+	pos, err := strconv.ParseUint(f[1], 10, 32)
+	if err != nil || pos == 0 {
+		return seg, fmt.Errorf("invalid position")
+	}
+	seg.Pos = uint32(pos)
+	switch f[2] {
+	case "+":
+	case "-":
+		seg.Reverse = true
+	default:
+		return seg, fmt.Errorf("invalid strand")
+	}
+	if ops, err := ParseCigar(seg.Cigar); err != nil || len(ops) == 0 {
+		return seg, fmt.Errorf("invalid CIGAR")
+	}
+	mapq, err := strconv.ParseUint(f[4], 10, 8)
+	if err != nil {
+		return seg, fmt.Errorf("invalid mapping quality")
+	}
+	seg.Mapq = uint8(mapq)
+	if seg.NM, err = strconv.Atoi(f[5]); err != nil || seg.NM < 0 {
+		return seg, fmt.Errorf("invalid NM")
+	}
+	return seg, nil
+}
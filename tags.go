@@ -0,0 +1,81 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import "sort"
+
+// Alignments keep the order of their optional fields, so that they're
+// written back out as they were read. OptFields is the index by tag,
+// and tagOrder the order. Fields added to OptFields directly, rather
+// than with SetTag, come after the others, in order of tag.
+
+// Tags returns the alignment's optional fields in the order they were
+// read or added with SetTag.
+func (a *Alignment) Tags() []OptField {
+	tags := make([]OptField, 0, len(a.OptFields))
+	seen := make(map[string]bool, len(a.tagOrder))
+	for _, tag := range a.tagOrder {
+		if of, ok := a.OptFields[tag]; ok && !seen[tag] {
+			tags = append(tags, of)
+			seen[tag] = true
+		}
+	}
+	if len(tags) == len(a.OptFields) {
+		return tags
+	}
+	var rest []string
+	for tag := range a.OptFields {
+		if !seen[tag] {
+			rest = append(rest, tag)
+		}
+	}
+	sort.Strings(rest)
+	for _, tag := range rest {
+		tags = append(tags, a.OptFields[tag])
+	}
+	return tags
+}
+
+// Tag returns the optional field called name, and whether there is
+// one.
+func (a *Alignment) Tag(name string) (OptField, bool) {
+	of, ok := a.OptFields[name]
+	return of, ok
+}
+
+// SetTag sets an optional field, replacing any with the same tag in
+// its place, or adding it after the others.
+func (a *Alignment) SetTag(of OptField) {
+	if a.OptFields == nil {
+		a.OptFields = map[string]OptField{}
+	}
+	if _, ok := a.OptFields[of.Tag]; !ok {
+		a.tagOrder = append(a.tagOrder, of.Tag)
+	}
+	a.OptFields[of.Tag] = of
+}
+
+// DeleteTag removes the optional field called name, if there is one.
+func (a *Alignment) DeleteTag(name string) {
+	delete(a.OptFields, name)
+	for i, tag := range a.tagOrder {
+		if tag == name {
+			a.tagOrder = append(a.tagOrder[:i:i], a.tagOrder[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,435 @@
+"""Writes mixed.cram, a CRAM 3.0 file, with mixed.sam holding the same
+records as SAM, and the reference mixed.fa with its .fai index.
+
+The encoder here follows the CRAM 3.0 specification independently of
+the Go decoder, for a fixture using the features it implements:
+EXTERNAL, HUFFMAN, BETA, SUBEXP, GAMMA and byte array codecs, raw,
+gzip, bzip2 and rANS order-0 and order-1 blocks, mates in the same
+slice and detached ones, multi-reference slices, and read features
+for substitutions, insertions, deletions, skips, soft and hard clips,
+padding and bases with qualities. Run it from this directory:
+
+    python3 mkcram.py
+"""
+import struct, zlib, gzip, bz2, random, math, sys
+random.seed(1)
+
+def itf8(v):
+    v &= 0xffffffff
+    if v < 0x80: return bytes([v])
+    if v < 0x4000: return bytes([0x80|v>>8, v&0xff])
+    if v < 0x200000: return bytes([0xc0|v>>16, v>>8&0xff, v&0xff])
+    if v < 0x10000000: return bytes([0xe0|v>>24, v>>16&0xff, v>>8&0xff, v&0xff])
+    return bytes([0xf0|(v>>28)&0xf, v>>20&0xff, v>>12&0xff, v>>4&0xff, v&0xf])
+def ltf8(v):
+    v &= 0xffffffffffffffff
+    for n in range(9):
+        if n == 8: return bytes([0xff]) + v.to_bytes(8,'big')
+        if v < (1 << (7*(n+1) - (0 if n<7 else 0))) and (n<7 or v < 1<<56):
+            # n extra bytes; first byte has n leading ones and (7-n) value bits
+            first_bits = 7-n
+            if v < 1 << (first_bits + 8*n):
+                prefix = (0xff << (8-n)) & 0xff
+                b = v.to_bytes(n+1,'big')
+                return bytes([prefix | b[0]]) + b[1:]
+    raise
+def arr(vals): return itf8(len(vals)) + b''.join(itf8(v) for v in vals)
+
+# ---- rANS 4x8 encoder
+L = 1<<23
+def normfreq(counts, tot=4095):
+    s = sum(counts.values()); F = {}
+    for k,c in counts.items(): F[k] = max(1, c*tot//s)
+    d = tot - sum(F.values()); m = max(F, key=lambda k: F[k]); F[m] += d
+    assert F[m] > 0
+    return F
+def writetab(F):
+    out = bytearray(); rle = 0
+    for j in range(256):
+        if F.get(j):
+            if rle: rle -= 1
+            else:
+                out.append(j)
+                if j and F.get(j-1):
+                    r = j+1
+                    while r < 256 and F.get(r): r += 1
+                    rle = r - (j+1); out.append(rle)
+            f = F[j]
+            if f < 128: out.append(f)
+            else: out += bytes([0x80|f>>8, f&0xff])
+    out.append(0)
+    return out
+def cumof(F):
+    C = {}; x = 0
+    for j in range(256):
+        if F.get(j): C[j] = x; x += F[j]
+    return C
+def encsym(x, f, c, outb):
+    xmax = ((L >> 12) << 8) * f
+    while x >= xmax:
+        outb.append(x & 0xff); x >>= 8
+    return ((x // f) << 12) + (x % f) + c
+def rans0(data):
+    n = len(data)
+    F = normfreq({b: data.count(b) for b in set(data)}) if n else {0:4095}
+    C = cumof(F); R = [L]*4; rev = bytearray()
+    for i in range(n-1, -1, -1):
+        j = i & 3; s = data[i]; R[j] = encsym(R[j], F[s], C[s], rev)
+    body = b''.join(struct.pack('<I', r) for r in R) + bytes(reversed(rev))
+    tab = writetab(F)
+    comp = tab + body
+    return bytes([0]) + struct.pack('<II', len(comp), n) + comp
+def rans1(data):
+    n = len(data); q = n // 4
+    def ctx(k):
+        if q == 0: return 0 if k == 0 else data[k-1]
+        if k in (0, q, 2*q, 3*q): return 0
+        return data[k-1]
+    counts = {}
+    for k in range(n): counts.setdefault(ctx(k), {}).setdefault(data[k], 0); counts[ctx(k)][data[k]] += 1
+    if not counts: counts = {0:{0:1}}
+    FF = {c: normfreq(v) for c, v in counts.items()}
+    CC = {c: cumof(F) for c, F in FF.items()}
+    R = [L]*4; rev = bytearray()
+    def enc(j, k):
+        c = ctx(k); s = data[k]; R[j] = encsym(R[j], FF[c][s], CC[c][s], rev)
+    for k in range(n-1, 4*q-1, -1): enc(3, k)
+    for i in range(q-1, -1, -1):
+        for j in (3,2,1,0): enc(j, j*q+i)
+    tab = bytearray(); rle = 0
+    for i in range(256):
+        if i not in FF: continue
+        if rle: rle -= 1
+        else:
+            tab.append(i)
+            if i and (i-1) in FF:
+                r = i+1
+                while r < 256 and r in FF: r += 1
+                rle = r-(i+1); tab.append(rle)
+        tab += writetab(FF[i])
+    tab.append(0)
+    body = b''.join(struct.pack('<I', r) for r in R) + bytes(reversed(rev))
+    comp = tab + body
+    return bytes([1]) + struct.pack('<II', len(comp), n) + comp
+
+def block(method, ctype, cid, raw):
+    if method == 0: d = raw
+    elif method == 1: d = gzip.compress(raw)
+    elif method == 2: d = bz2.compress(raw)
+    elif method == 4: d = rans0(raw) if cid % 2 == 0 else rans1(raw)
+    b = bytes([method, ctype]) + itf8(cid) + itf8(len(d)) + itf8(len(raw)) + d
+    return b + struct.pack('<I', zlib.crc32(b))
+def container(refid, start, span, nrec, counter, blocks, landmarks):
+    body = b''.join(blocks)
+    h = itf8(refid) + itf8(start) + itf8(span) + itf8(nrec) + ltf8(counter) + ltf8(0) + itf8(len(blocks)) + arr(landmarks)
+    h = struct.pack('<i', len(body)) + h
+    return h + struct.pack('<I', zlib.crc32(h)) + body
+
+# ---- bit writer
+class Bits:
+    def __init__(s): s.bits = []
+    def put(s, v, n):
+        for i in range(n-1, -1, -1): s.bits.append((v >> i) & 1)
+    def bytes(s):
+        b = s.bits + [0]*((-len(s.bits)) % 8)
+        return bytes(int(''.join(map(str, b[i:i+8])), 2) for i in range(0, len(b), 8))
+
+# ---- reference and reads
+bases = 'ACGT'
+refs = {'chr1': ''.join(random.choice(bases) for _ in range(3000)), 'chr2': ''.join(random.choice(bases) for _ in range(2000))}
+refnames = ['chr1', 'chr2']
+with open('mixed.fa', 'w') as f:
+    for n in refnames:
+        f.write('>%s\n' % n)
+        s = refs[n].lower() if n == 'chr2' else refs[n]
+        for i in range(0, len(s), 60): f.write(s[i:i+60] + '\n')
+
+CODE = {}
+for ri, r in enumerate('ACGTN'):
+    others = [b for b in 'ACGTN' if b != r]
+    for k, o in enumerate(others): CODE[(r, o)] = k   # SM bytes 0x1b = codes 0,1,2,3 in order
+
+def make_read(ref, pos):
+    """random cigar and read against ref at pos (1-based)"""
+    ops = []
+    if random.random() < 0.3: ops.append(('H', random.randint(1, 5)))
+    if random.random() < 0.4: ops.append(('S', random.randint(1, 6)))
+    for _ in range(random.randint(1, 4)):
+        ops.append(('M', random.randint(3, 30)))
+        k = random.random()
+        if k < 0.25: ops.append(('I', random.randint(1, 4)))
+        elif k < 0.5: ops.append(('D', random.randint(1, 4)))
+        elif k < 0.55: ops.append(('N', random.randint(50, 200)))
+        elif k < 0.6: ops.append(('P', 2))
+    ops.append(('M', random.randint(3, 20)))
+    if random.random() < 0.4: ops.append(('S', random.randint(1, 6)))
+    if random.random() < 0.3: ops.append(('H', random.randint(1, 5)))
+    seq = []; feats = []  # (pos, code, data)
+    rp = pos; qp = 1
+    for op, n in ops:
+        if op == 'M':
+            for i in range(n):
+                rb = ref[rp-1] if rp-1 < len(ref) else 'N'
+                k = random.random()
+                if k < 0.03:
+                    b = random.choice([x for x in 'ACGTN' if x != rb]); feats.append((qp, 'X', CODE[(rb, b)]))
+                elif k < 0.04:
+                    b = random.choice('RY'); feats.append((qp, 'B', (b, random.randint(2, 40))))  # base not in ACGTN
+                else: b = rb
+                seq.append(b); rp += 1; qp += 1
+        elif op == 'I':
+            ins = ''.join(random.choice(bases) for _ in range(n)); seq += ins
+            feats.append((qp, 'i' if n == 1 else 'I', ins)); qp += n
+        elif op == 'S':
+            sc = ''.join(random.choice(bases) for _ in range(n)); seq += sc
+            feats.append((qp, 'S', sc)); qp += n
+        elif op in 'DN':
+            feats.append((qp, op, n)); rp += n
+        elif op in 'HP':
+            feats.append((qp, op, n))
+    # merge adjacent same ops for the expected cigar
+    m = []
+    for op, n in ops:
+        if m and m[-1][0] == op: m[-1][1] += n
+        else: m.append([op, n])
+    cigar = ''.join('%d%s' % (n, op) for op, n in m)
+    return ''.join(seq), cigar, feats, rp - pos
+
+def refspan(cigar):
+    import re
+    return sum(int(n) for n, op in re.findall(r'(\d+)([MIDNSHP=X])', cigar) if op in 'MDN=X')
+
+rgs = ['rgA', 'rgB']
+records = []  # dicts
+def new(name, flag, ref, pos, mapped=True):
+    r = dict(name=name, flag=flag, ref=ref, pos=pos, mapq=random.randint(0, 60), tags=[], rg=random.choice([-1, 0, 1]))
+    if mapped:
+        r['seq'], r['cigar'], r['feats'], _ = make_read(refs[ref], pos)
+    else:
+        r['seq'] = ''.join(random.choice('ACGTN') for _ in range(random.randint(5, 40))); r['cigar'] = '*'; r['feats'] = []; r['mapq'] = 0
+    r['qual'] = ''.join(chr(33 + random.randint(0, 41)) for _ in r['seq']) if random.random() < 0.8 else None
+    # tags
+    if random.random() < 0.7: r['tags'].append(('NM', 'c', random.randint(0, 10)))
+    if random.random() < 0.5: r['tags'].append(('XA', 'Z', 'hello%d' % random.randint(0, 99)))
+    if random.random() < 0.3: r['tags'].append(('XB', 'B', ('S', [random.randint(0, 65535) for _ in range(3)])))
+    r['mate'] = None; r['detached'] = None
+    return r
+
+def slice_records(ref, n, counter_start):
+    recs = []
+    i = 0
+    while len(recs) < n:
+        pos = sorted([random.randint(1, 2500 if ref == 'chr1' else 1500) for _ in range(2)])
+        k = random.random()
+        if k < 0.4:
+            a = new('p%d' % len(records+recs), 0x1 | 0x40 | random.choice([0, 0x10]), ref, pos[0])
+            b = new(a['name'], 0x1 | 0x80 | random.choice([0, 0x10]), ref, pos[1])
+            a['mate'] = b; recs += [a, b]
+        elif k < 0.6:
+            a = new('d%d' % len(records+recs), 0x1 | random.choice([0x40, 0x80]) | random.choice([0, 0x10]), ref, pos[0])
+            a['detached'] = (random.choice([-1, 0, 1]), random.randint(0, 3000), random.randint(-500, 500), random.randint(0, 3))
+            recs.append(a)
+        else:
+            recs.append(new('s%d' % len(records+recs), random.choice([0, 0x10, 0x100, 0x800]), ref, pos[0]))
+    return recs
+
+# expected SAM
+def bamtag_bytes(t):
+    tag, ty, v = t
+    if ty == 'c': return struct.pack('<b', v)
+    if ty == 'Z': return v.encode() + b'\0'
+    if ty == 'B':
+        sub, vals = v
+        return sub.encode() + struct.pack('<i', len(vals)) + b''.join(struct.pack('<H', x) for x in vals)
+def sam_tag(t):
+    tag, ty, v = t
+    if ty == 'c': return '%s:i:%d' % (tag, v)
+    if ty == 'Z': return '%s:Z:%s' % (tag, v)
+    if ty == 'B': return '%s:B:%s,%s' % (tag, v[0], ','.join(map(str, v[1])))
+
+# ---- encode a slice
+def encode_slice(recs, refid_slice, apstart, tagdict, counter):
+    core = Bits(); ext = {}
+    def E(cid): return ext.setdefault(cid, bytearray())
+    cf_syms = sorted(set(CF(r) for r in recs))
+    huff = {}
+    def huffcodes(syms):
+        syms = sorted(syms)
+        if len(syms) == 1: return {syms[0]: (0, 0)}, syms, [0]
+        l = max(1, math.ceil(math.log2(len(syms))))
+        return {s: (i, l) for i, s in enumerate(syms)}, syms, [l]*len(syms)
+    pos = apstart
+    for idx, r in enumerate(recs):
+        E(1).extend(itf8(r['bf']))
+        c, l = r['cfcode']; core.put(c, l)
+        if refid_slice == -2: E(2).extend(itf8(r['refid']))
+        core.put(len(r['seq']), 8)
+        if r['refid'] == -1 and refid_slice != -2 or r['flag'] & 4 and r['pos'] == 0:
+            ap = 0
+        E(3).extend(itf8(r['pos'] - pos)); pos = r['pos']
+        c, l = r['rgcode']; core.put(c, l)
+        E(4).extend(r['name'].encode() + b'\0')
+        if r['detached']:
+            ns, np, ts, mf = r['detached']
+            E(5).extend(itf8(mf) + itf8(ns) + itf8(np) + itf8(ts))
+        elif r.get('nf') is not None:
+            v = r['nf'] + 1; nb = v.bit_length() - 1
+            core.put(0, nb); core.put(1, 1); core.put(v - (1 << nb), nb)
+        c, l = r['tlcode']; core.put(c, l)
+        for t in r['tags']:
+            b = bamtag_bytes(t); cid = 20 + tagdict_ids.index(tagid(t))
+            E(cid).extend(itf8(len(b)) + b)
+        if not r['flag'] & 4:
+            E(6).extend(itf8(len(r['feats'])))
+            prev = 0
+            for fp, code, data in r['feats']:
+                E(7).append(ord(code))
+                v = fp - prev; prev = fp
+                k = 2
+                if v < (1 << k): core.put(0, 1); core.put(v, k)
+                else:
+                    b = v.bit_length() - 1; i = b - k + 1
+                    core.put((1 << i) - 1, i); core.put(0, 1); core.put(v - (1 << b), b)
+                if code == 'X': c, l = bscodes[data]; core.put(c, l)
+                elif code in 'IS': E(10).extend(data.encode() + b'\0')
+                elif code == 'i': E(8).append(ord(data))
+                elif code in 'DNHP': E(12).extend(itf8(data))
+                elif code == 'B': E(8).append(ord(data[0])); E(9).append(data[1])
+            core.put(r['mapq'], 8)
+        else:
+            E(8).extend(r['seq'].encode())
+        if r['qual'] is not None:
+            E(9).extend(bytes(ord(q) - 33 for q in r['qual']))
+    return core.bytes(), ext
+
+def tagid(t):
+    ty = {'c': 'c', 'Z': 'Z', 'B': 'B'}[t[1]]
+    return (ord(t[0][0]) << 16) | (ord(t[0][1]) << 8) | ord(ty)
+def CF(r):
+    cf = 0
+    if r['qual'] is not None: cf |= 1
+    if r['detached']: cf |= 2
+    if r.get('nf') is not None: cf |= 4
+    return cf
+
+# build data
+header_text = '@HD\tVN:1.6\tSO:unsorted\n' + ''.join('@SQ\tSN:%s\tLN:%d\n' % (n, len(refs[n])) for n in refnames) + ''.join('@RG\tID:%s\tSM:x\n' % g for g in rgs)
+out = bytearray(b'CRAM' + bytes([3, 0]) + b'test'.ljust(20, b'\0'))
+hb = struct.pack('<i', len(header_text)) + header_text.encode()
+out += container(0, 0, 0, 0, 0, [block(0, 0, 0, hb)], [0])
+
+expected = []
+counter = 0
+slices_plan = [('chr1', 0, 30), ('chr2', 1, 20), (None, -2, 25)]
+bscodes = None
+for pi, (refname, sref, n) in enumerate(slices_plan):
+    if refname:
+        recs = slice_records(refname, n, counter)
+        for r in recs: r['refid'] = sref
+    else:
+        recs = []
+        for k in range(n):
+            if random.random() < 0.3:
+                r = new('u%d' % k, 0x4, None, 0, mapped=False); r['ref'] = '*'; r['refid'] = -1; r['pos'] = 0
+            else:
+                rn = random.choice(refnames)
+                r = new('m%d' % k, random.choice([0, 16]), rn, random.randint(1, 1500)); r['refid'] = refnames.index(rn)
+            recs.append(r)
+        recs.sort(key=lambda r: (r['refid'] == -1, r['pos']))
+    recs.sort(key=lambda r: r['pos']) if refname else None
+    # link mates downstream
+    for i, r in enumerate(recs):
+        if r['mate'] is not None:
+            j = recs.index(r['mate']); 
+            if j > i: r['nf'] = j - i - 1
+            else:
+                r['mate']['mate'] = None; r['mate']['nf'] = i - j - 1  # mate before, reverse link
+    for i, r in enumerate(recs):
+        if r.get('nf') is not None: r['mate'] = recs[i + r['nf'] + 1]
+    # expected fields
+    for i, r in enumerate(recs):
+        r['bf'] = r['flag']
+    for i, r in enumerate(recs):
+        if r.get('nf') is not None:
+            a, b = r, recs[i + r['nf'] + 1]
+            for x, y in ((a, b), (b, a)):
+                x['flag'] |= 0x1 | (0x20 if y['flag'] & 0x10 else 0)
+                x['nref'] = '='; x['npos'] = y['pos']
+            left = min(a['pos'], b['pos']); right = max(a['pos'] + refspan(a['cigar']) - 1, b['pos'] + refspan(b['cigar']) - 1)
+            t = right - left + 1
+            if a['pos'] <= b['pos']: a['tlen'], b['tlen'] = t, -t
+            else: a['tlen'], b['tlen'] = -t, t
+        elif r['detached']:
+            ns, np_, ts, mf = r['detached']
+            r['flag'] |= (0x20 if mf & 1 else 0) | (0x8 if mf & 2 else 0)
+            r['nref'] = '*' if ns == -1 else ('=' if ns == r['refid'] else refnames[ns])
+            r['npos'] = np_; r['tlen'] = ts
+        elif 'nref' not in r:
+            r['nref'] = '*'; r['npos'] = 0; r['tlen'] = 0
+    # tag dictionary lines
+    lines = []
+    tagdict_ids = []
+    for r in recs:
+        ids = [tagid(t) for t in r['tags']]
+        for x in ids:
+            if x not in tagdict_ids: tagdict_ids.append(x)
+        if ids not in lines: lines.append(ids)
+        r['tl'] = lines.index(ids)
+    bsyms = list(range(4))
+    cfs = sorted(set(CF(r) for r in recs)); rgsy = sorted(set(r['rg'] for r in recs)); tls = sorted(set(r['tl'] for r in recs))
+    def hc(syms):
+        syms = sorted(syms)
+        if len(syms) == 1: return {syms[0]: (0, 0)}, [0]
+        l = max(1, math.ceil(math.log2(len(syms))))
+        return {s: (i, l) for i, s in enumerate(syms)}, [l]*len(syms)
+    cfmap, cfl = hc(cfs); rgmap, rgl = hc(rgsy); tlmap, tll = hc(tls); bsmap, bsl = hc(bsyms)
+    bscodes = bsmap
+    for r in recs:
+        r['cfcode'] = cfmap[CF(r)]; r['rgcode'] = rgmap[r['rg']]; r['tlcode'] = tlmap[r['tl']]
+    apstart = recs[0]['pos'] if sref != -2 else 0
+    core, ext = encode_slice(recs, sref, apstart, None, counter)
+    # compression header
+    def enc(codec, params): return itf8(codec) + itf8(len(params)) + params
+    EXT = lambda cid: enc(1, itf8(cid))
+    HUF = lambda syms, lens: enc(3, arr(syms) + arr(lens))
+    ds = {
+        'BF': EXT(1), 'CF': HUF(cfs, cfl), 'RI': EXT(2), 'RL': enc(6, itf8(0) + itf8(8)), 'AP': EXT(3),
+        'RG': HUF(rgsy, rgl), 'RN': enc(5, b'\0' + itf8(4)), 'MF': EXT(5), 'NS': EXT(5), 'NP': EXT(5), 'TS': EXT(5),
+        'NF': enc(9, itf8(1)), 'TL': HUF(tls, tll), 'FN': EXT(6), 'FC': EXT(7), 'FP': enc(7, itf8(0) + itf8(2)),
+        'BS': HUF(bsyms, bsl), 'IN': enc(5, b'\0' + itf8(10)), 'SC': enc(5, b'\0' + itf8(10)), 'BA': EXT(8), 'QS': EXT(9),
+        'DL': EXT(12), 'RS': EXT(12), 'PD': EXT(12), 'HC': EXT(12), 'MQ': enc(6, itf8(0) + itf8(8)),
+    }
+    dsb = itf8(len(ds)) + b''.join(k.encode() + v for k, v in ds.items())
+    td = b''.join(b''.join(bytes([x >> 16, x >> 8 & 0xff, x & 0xff]) for x in line) + b'\0' for line in lines)
+    pm = [b'RN' + b'\1', b'AP' + b'\1', b'RR' + b'\1', b'SM' + bytes([0x1b]*5), b'TD' + itf8(len(td)) + td]
+    pmb = itf8(len(pm)) + b''.join(pm)
+    tm = [itf8(x) + enc(4, EXT(20 + tagdict_ids.index(x)) + EXT(20 + tagdict_ids.index(x))) for x in tagdict_ids]
+    tmb = itf8(len(tm)) + b''.join(tm)
+    comp = itf8(len(pmb)) + pmb + itf8(len(dsb)) + dsb + itf8(len(tmb)) + tmb
+    blocks = [block(1, 1, 0, comp)]
+    ids = sorted(ext)
+    sh = itf8(sref) + itf8(apstart) + itf8(0) + itf8(len(recs)) + ltf8(counter) + itf8(len(ids) + 1) + arr([0] + ids) + itf8(-1) + bytes(16)
+    sblocks = [block(0, 2, 0, sh), block(0, 5, 0, core)]
+    methods = [0, 1, 2, 4]
+    for cid in ids: sblocks.append(block(methods[(cid + pi) % 4], 4, cid, bytes(ext[cid])))
+    blocks += sblocks
+    out += container(sref, apstart, 0, len(recs), counter, blocks, [len(blocks[0])])
+    counter += len(recs)
+    for r in recs:
+        tags = list(r['tags'])
+        st = [sam_tag(t) for t in tags]
+        if r['rg'] >= 0: st.append('RG:Z:' + rgs[r['rg']])
+        st.sort()
+        expected.append('\t'.join([r['name'], str(r['flag']), r['ref'] if r['refid'] >= 0 else '*', str(r['pos']), str(r['mapq']), r['cigar'],
+                                   r['nref'], str(r['npos']), str(r['tlen']), r['seq'] or '*', r['qual'] or '*'] + st))
+# EOF container
+out += bytes.fromhex('0f000000ffffffff0fe0454f4600000000010005bdd94f0001000606010001000100ee63014b')
+open('mixed.cram', 'wb').write(out)
+open('mixed.sam', 'w').write(header_text + '\n'.join(expected) + '\n')
+# The .fai index, with 60 bases a line
+with open('mixed.fa.fai', 'w') as f:
+    off = 0
+    for n in refnames:
+        off += len('>%s\n' % n)
+        f.write('%s\t%d\t%d\t60\t61\n' % (n, len(refs[n]), off))
+        off += len(refs[n]) + (len(refs[n]) + 59) // 60
@@ -0,0 +1,152 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+// Checks between alignments and the header. These aren't done while
+// reading, since a whole file's alignments may not be at hand.
+
+import (
+	"fmt"
+	"io"
+)
+
+// ValidateReadGroupRefs checks that the RG tag of each alignment names
+// a read group in the header. The error names the first read that
+// doesn't.
+func ValidateReadGroupRefs(header *Header, alignments []*Alignment) error {
+	ids := readGroupIDs(header)
+	for _, a := range alignments {
+		if err := checkReadGroupRef(ids, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readGroupIDs(header *Header) map[string]bool {
+	ids := make(map[string]bool, len(header.RG))
+	for _, rg := range header.RG {
+		ids[rg.ID] = true
+	}
+	return ids
+}
+
+// checkReadGroupRef is ValidateReadGroupRefs for one alignment, given
+// the IDs of the header's read groups.
+func checkReadGroupRef(ids map[string]bool, a *Alignment) error {
+	of, ok := a.OptFields["RG"]
+	if !ok {
+		return nil
+	}
+	id, _ := of.Value.(string)
+	if of.Type != 'Z' || !ids[id] {
+		return SAMerror{str: fmt.Sprintf("Alignment %s has RG %v, which doesn't match any read group", a.Qname, of.Value)}
+	}
+	return nil
+}
+
+// ValidateRefNames checks that the RNAME and RNEXT of each alignment
+// are either unavailable or name a reference sequence in the header,
+// and that POS is within the reference sequence.
+func ValidateRefNames(header *Header, alignments []*Alignment) error {
+	refs := refsByName(header)
+	for _, a := range alignments {
+		if err := checkRefNames(refs, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func refsByName(header *Header) map[string]*RefSeqDict {
+	refs := make(map[string]*RefSeqDict, len(header.SQ))
+	for _, rsd := range header.SQ {
+		refs[rsd.Name] = rsd
+	}
+	return refs
+}
+
+// checkRefNames is ValidateRefNames for one alignment, given the
+// header's reference sequences by name.
+func checkRefNames(refs map[string]*RefSeqDict, a *Alignment) error {
+	if a.RefName != "*" {
+		rsd := refs[a.RefName]
+		if rsd == nil {
+			return SAMerror{str: fmt.Sprintf("Alignment %s has RNAME %s, which isn't in the reference dictionary", a.Qname, a.RefName)}
+		}
+		if a.Pos > rsd.Length {
+			return SAMerror{str: fmt.Sprintf("Alignment %s has POS %d, past the end of %s", a.Qname, a.Pos, a.RefName)}
+		}
+	}
+	if a.NextRef != "*" && a.NextRef != "=" && refs[a.NextRef] == nil {
+		return SAMerror{str: fmt.Sprintf("Alignment %s has RNEXT %s, which isn't in the reference dictionary", a.Qname, a.NextRef)}
+	}
+	return nil
+}
+
+// ValidateFile checks a whole SAM file, as a linter would, returning
+// every problem found rather than stopping at the first. The file is
+// read with the Strict and ContinueOnError options, so each line that
+// breaks the spec is reported, and each alignment is also checked
+// against the header as ValidateRefNames and ValidateReadGroupRefs
+// do, and against its sort order as SortChecker does. Uniqueness of
+// names and IDs, and the program chain, are checked as the header is
+// read. The errors give line numbers, and are in the order of the
+// lines. The second result is for I/O errors, which stop the check.
+// A fileName of "-" reads standard input.
+func ValidateFile(fileName string) ([]error, error) {
+	file, err := openInput(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ValidateSAM(file)
+}
+
+// ValidateSAM is like ValidateFile, but reads from r.
+func ValidateSAM(r io.Reader) ([]error, error) {
+	sr, err := NewReaderOptions(r, ReaderOptions{ContinueOnError: true, Strict: true})
+	if err != nil {
+		return sr.Errors(), err
+	}
+	refs, rgs := refsByName(sr.Header), readGroupIDs(sr.Header)
+	order := NewSortChecker(sr.Header)
+
+	var errs []error
+	seen := 0 // of the Reader's errors, those already in errs
+	for {
+		a, err := sr.Next()
+		errs = append(errs, sr.Errors()[seen:]...)
+		seen = len(sr.Errors())
+		if err == io.EOF {
+			return errs, nil
+		}
+		if err != nil {
+			return errs, err
+		}
+		if err := checkRefNames(refs, a); err != nil {
+			errs = append(errs, sr.atLine(err))
+		}
+		if err := checkReadGroupRef(rgs, a); err != nil {
+			errs = append(errs, sr.atLine(err))
+		}
+		if err := order.Check(a); err != nil {
+			errs = append(errs, sr.atLine(err))
+		}
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright (C) 2012 Phillip Garland <pgarland@gmail.com>
+
+// This program is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public License
+// as published by the Free Software Foundation, either version 3 of
+// the License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public
+// License along with this program.  If not, see
+// <http://www.gnu.org/licenses/>.
+
+package goSAM
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeHeaderLine writes a header line of record type rt from
+// alternating tag and value arguments. Tags with empty values are
+// optional ones that weren't set, so they're left out.
+func writeHeaderLine(w io.Writer, rt string, tvs ...string) error {
+	var b strings.Builder
+	b.WriteString("@" + rt)
+	for i := 0; i+1 < len(tvs); i += 2 {
+		if tvs[i+1] != "" {
+			b.WriteString("\t" + tvs[i] + ":" + tvs[i+1])
+		}
+	}
+	b.WriteByte('\n')
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// otherTags flattens non-standard tags into writeHeaderLine
+// arguments, sorted by tag, since the maps they're kept in don't
+// record the order they were read in.
+func otherTags(other map[string]string) []string {
+	tags := make([]string, 0, len(other))
+	for tag := range other {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	tvs := make([]string, 0, 2*len(tags))
+	for _, tag := range tags {
+		tvs = append(tvs, tag, other[tag])
+	}
+	return tvs
+}
+
+func WriteHeader(w io.Writer, hl *HeaderLine) error {
+	tvs := []string{
+		"VN", hl.Version,
+		"SO", hl.SortOrder.String(),
+		"GO", hl.Grouping,
+		"SS", hl.SubSort,
+	}
+	return writeHeaderLine(w, "HD", append(tvs, otherTags(hl.Other)...)...)
+}
+
+func WriteRefSeqDict(w io.Writer, rsd *RefSeqDict) error {
+	return writeHeaderLine(w, "SQ",
+		"SN", rsd.Name,
+		"LN", strconv.FormatUint(uint64(rsd.Length), 10),
+		"AN", strings.Join(rsd.AltNames, ","),
+		"AS", rsd.AssemblyID,
+		"M5", rsd.MD5,
+		"SP", rsd.Species,
+		"TP", rsd.Topology,
+		"UR", rsd.URI)
+}
+
+// WriteReadGroup writes an @RG line. DT and PI are written from Date
+// and PMIS, so that they're written as they were read; DateParsed, in
+// RFC3339 form, and PMISValue are used only if those are empty.
+func WriteReadGroup(w io.Writer, rg *ReadGroup) error {
+	date := rg.Date
+	if date == "" && !rg.DateParsed.IsZero() {
+		date = rg.DateParsed.Format(time.RFC3339)
+	}
+	pmis := rg.PMIS
+	if pmis == "" && rg.PMISValue != 0 {
+		pmis = strconv.Itoa(rg.PMISValue)
+	}
+	tvs := []string{
+		"ID", rg.ID,
+		"CN", rg.SeqCenter,
+		"DS", rg.Description,
+		"DT", date,
+		"FO", rg.FlowOrder,
+		"KS", rg.KeySeq,
+		"LB", rg.Lib,
+		"PG", rg.Programs,
+		"PI", pmis,
+		"PL", rg.Platform,
+		"PU", rg.Unit,
+		"SM", rg.Sample,
+	}
+	return writeHeaderLine(w, "RG", append(tvs, otherTags(rg.Other)...)...)
+}
+
+func WriteProgram(w io.Writer, prog *Program) error {
+	tvs := []string{
+		"ID", prog.ID,
+		"PN", prog.Name,
+		"VN", prog.Version,
+		"CL", prog.CmdLine,
+		"PP", prog.PrevID,
+	}
+	return writeHeaderLine(w, "PG", append(tvs, otherTags(prog.Other)...)...)
+}
+
+func WriteComment(w io.Writer, co string) error {
+	_, err := io.WriteString(w, "@CO\t"+co+"\n")
+	return err
+}
+
+// formatOptField is the inverse of parseOptField.
+func formatOptField(of OptField) string {
+	var val string
+	switch v := of.Value.(type) {
+	case string:
+		val = v
+	case int64:
+		val = strconv.FormatInt(v, 10)
+	case float64:
+		val = strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		if of.Type == 'H' {
+			val = strings.ToUpper(hex.EncodeToString(v))
+		} else { // B array of uint8
+			val = formatOptArray(v)
+		}
+	default:
+		val = formatOptArray(v)
+	}
+	return of.Tag + ":" + string(of.Type) + ":" + val
+}
+
+func formatOptArray(arr interface{}) string {
+	var subtype string
+	var vals []string
+	switch a := arr.(type) {
+	case []int8:
+		subtype = "c"
+		for _, v := range a {
+			vals = append(vals, strconv.FormatInt(int64(v), 10))
+		}
+	case []uint8:
+		subtype = "C"
+		for _, v := range a {
+			vals = append(vals, strconv.FormatUint(uint64(v), 10))
+		}
+	case []int16:
+		subtype = "s"
+		for _, v := range a {
+			vals = append(vals, strconv.FormatInt(int64(v), 10))
+		}
+	case []uint16:
+		subtype = "S"
+		for _, v := range a {
+			vals = append(vals, strconv.FormatUint(uint64(v), 10))
+		}
+	case []int32:
+		subtype = "i"
+		for _, v := range a {
+			vals = append(vals, strconv.FormatInt(int64(v), 10))
+		}
+	case []uint32:
+		subtype = "I"
+		for _, v := range a {
+			vals = append(vals, strconv.FormatUint(uint64(v), 10))
+		}
+	case []float32:
+		subtype = "f"
+		for _, v := range a {
+			vals = append(vals, strconv.FormatFloat(float64(v), 'g', -1, 32))
+		}
+	}
+	return strings.Join(append([]string{subtype}, vals...), ",")
+}
+
+// WriteAlignment writes a as a single alignment line. Optional fields
+// are written in the order Tags gives, the order they were read or set
+// in.
+func WriteAlignment(w io.Writer, a *Alignment) error {
+	fields := []string{
+		a.Qname,
+		strconv.FormatUint(uint64(a.Flag), 10),
+		a.RefName,
+		strconv.FormatUint(uint64(a.Pos), 10),
+		strconv.FormatUint(uint64(a.Mapq), 10),
+		a.Cigar,
+		a.NextRef,
+		strconv.FormatUint(uint64(a.NextPos), 10),
+		strconv.FormatInt(int64(a.TemplateLen), 10),
+		a.Seq,
+		a.Qual,
+	}
+	for _, of := range a.Tags() {
+		fields = append(fields, formatOptField(of))
+	}
+	_, err := io.WriteString(w, strings.Join(fields, "\t")+"\n")
+	return err
+}
+
+// WriteSAMFile writes the structures returned by ReadSAMFile to a new
+// file named fileName.
+func WriteSAMFile(fileName string, header *HeaderLine, rsdl, rgl, progl, al *list.List) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := WriteSAM(file, header, rsdl, rgl, progl, al); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// WriteSAM is like WriteSAMFile, but writes to w. Any of the arguments
+// may be nil, in which case those lines are left out.
+func WriteSAM(w io.Writer, header *HeaderLine, rsdl, rgl, progl, al *list.List) error {
+	bw := bufio.NewWriter(w)
+	if header != nil {
+		if err := WriteHeader(bw, header); err != nil {
+			return err
+		}
+	}
+	if rsdl != nil {
+		for e := rsdl.Front(); e != nil; e = e.Next() {
+			if err := WriteRefSeqDict(bw, e.Value.(*RefSeqDict)); err != nil {
+				return err
+			}
+		}
+	}
+	if rgl != nil {
+		for e := rgl.Front(); e != nil; e = e.Next() {
+			if err := WriteReadGroup(bw, e.Value.(*ReadGroup)); err != nil {
+				return err
+			}
+		}
+	}
+	if progl != nil {
+		for e := progl.Front(); e != nil; e = e.Next() {
+			if err := WriteProgram(bw, e.Value.(*Program)); err != nil {
+				return err
+			}
+		}
+	}
+	if al != nil {
+		for e := al.Front(); e != nil; e = e.Next() {
+			if err := WriteAlignment(bw, e.Value.(*Alignment)); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// writeHeaderSection writes all the lines of header.
+func writeHeaderSection(w io.Writer, header *Header) error {
+	if header.HD != nil {
+		if err := WriteHeader(w, header.HD); err != nil {
+			return err
+		}
+	}
+	for _, rsd := range header.SQ {
+		if err := WriteRefSeqDict(w, rsd); err != nil {
+			return err
+		}
+	}
+	for _, rg := range header.RG {
+		if err := WriteReadGroup(w, rg); err != nil {
+			return err
+		}
+	}
+	for _, prog := range header.PG {
+		if err := WriteProgram(w, prog); err != nil {
+			return err
+		}
+	}
+	for _, co := range header.CO {
+		if err := WriteComment(w, co); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writer writes a SAM stream one alignment at a time, the counterpart
+// of Reader, for pipelines that never hold the whole file in memory.
+// Output is buffered, so Close must be called to flush it.
+type Writer struct {
+	w    *bufio.Writer
+	opts WriterOptions
+
+	// For Validate, the header's references and read groups
+	refs map[string]*RefSeqDict
+	rgs  map[string]bool
+}
+
+// WriterOptions controls how a Writer checks what it writes.
+type WriterOptions struct {
+	// Validate checks each alignment before writing it, and returns
+	// the error instead if it isn't valid: it must pass the checks
+	// Reader makes, such as SEQ and QUAL being the same length, and
+	// ValidateRefNames and ValidateReadGroupRefs against the header.
+	// This catches a transformation that leaves an alignment
+	// inconsistent before the output is spoiled, at some cost in
+	// speed.
+	Validate bool
+}
+
+// NewWriter writes the header section to w, and returns a Writer for
+// the alignments that follow it.
+func NewWriter(w io.Writer, header *Header) (*Writer, error) {
+	return NewWriterOptions(w, header, WriterOptions{})
+}
+
+// NewWriterOptions is like NewWriter, but with options other than the
+// defaults.
+func NewWriterOptions(w io.Writer, header *Header, opts WriterOptions) (*Writer, error) {
+	sw := &Writer{w: bufio.NewWriter(w), opts: opts}
+	if opts.Validate {
+		sw.refs, sw.rgs = refsByName(header), readGroupIDs(header)
+	}
+	if err := writeHeaderSection(sw.w, header); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// Write writes a as the next alignment line.
+func (sw *Writer) Write(a *Alignment) error {
+	if sw.opts.Validate {
+		if valid, err := validateAlignment(a); !valid {
+			return err
+		}
+		if err := checkRefNames(sw.refs, a); err != nil {
+			return err
+		}
+		if err := checkReadGroupRef(sw.rgs, a); err != nil {
+			return err
+		}
+	}
+	return WriteAlignment(sw.w, a)
+}
+
+// Close flushes the buffered output. It doesn't close the underlying
+// writer.
+func (sw *Writer) Close() error {
+	return sw.w.Flush()
+}